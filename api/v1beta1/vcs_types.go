@@ -17,17 +17,288 @@ limitations under the License.
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// StorageSpec describes the PersistentVolumeClaim backing a component, it is
+// applied when the claim is created.
+type StorageSpec struct {
+	// Requested size of the volume, IE: 10Gi
+	Size *resource.Quantity `json:"size,omitempty"`
+	// StorageClass to provision the volume from, default: the cluster default
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// Access modes of the volume, default: ReadWriteOnce
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+	// Label query over the existing volumes to bind to
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// ImageSpec overrides an image of the version manifest compiled into the
+// operator, unset fields keep their default.
+type ImageSpec struct {
+	// Image repository, IE: gitea/gitea
+	Repository string `json:"repository,omitempty"`
+	// Image tag, IE: 1.11.4
+	Tag string `json:"tag,omitempty"`
+	// Pull policy of the image, default: IfNotPresent
+	// +kubebuilder:validation:Enum=Always;IfNotPresent;Never
+	PullPolicy corev1.PullPolicy `json:"pullPolicy,omitempty"`
+}
+
+// WorkloadSpec sizes and places the pods of a component
+type WorkloadSpec struct {
+	// Compute resources of the main container, replaces the built in defaults when set
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Node labels the pods must be scheduled on
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Taints the pods tolerate
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Node and pod affinity rules of the pods
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// PriorityClass of the pods
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// How the pods are spread across topology domains
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+}
+
+// ExternalPostgresSpec points a component at a database run outside of the VCS
+type ExternalPostgresSpec struct {
+	// Secret holding the host, port, database, user, password and sslmode keys, and
+	// ca.crt to verify the server with. port defaults to 5432 and sslmode to require
+	SecretName string `json:"secretName"`
+}
+
+// S3Spec points at a bucket of an S3 compatible object store
+type S3Spec struct {
+	// The object store, IE: http://minio:9000, default: https://s3.amazonaws.com
+	Endpoint string `json:"endpoint,omitempty"`
+	// The bucket, it has to exist
+	Bucket string `json:"bucket"`
+	// Prefix of the object keys, default: <namespace>/<vcs name>/<component>
+	Prefix string `json:"prefix,omitempty"`
+	// Secret holding the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY keys
+	SecretName string `json:"secretName"`
+}
+
+// PostgresBackupSpec schedules dumps of a database to an object store
+type PostgresBackupSpec struct {
+	// Cron schedule of the backups, IE: 0 3 * * *
+	Schedule string `json:"schedule"`
+	// The number of backups kept, default: 7
+	// +kubebuilder:validation:Minimum=1
+	Retention int32 `json:"retention,omitempty"`
+	// Where the backups are stored
+	S3 S3Spec `json:"s3"`
+	// The backup to seed the database with, IE: 20200501-030000. Only an
+	// empty database is restored into, before the component is started.
+	RestoreFrom string `json:"restoreFrom,omitempty"`
+	// The image uploading to the object store, default: minio/mc:RELEASE.2020-04-25T00-43-23Z
+	Image ImageSpec `json:"image,omitempty"`
+}
+
+// PostgresArchiveSpec continuously archives the WAL of a bundled instance to
+// an object store, along with scheduled base backups to replay it onto
+type PostgresArchiveSpec struct {
+	// Where the base backups and WAL are stored, under base/ and wal/
+	S3 S3Spec `json:"s3"`
+	// Cron schedule of the base backups, IE: 0 2 * * 0
+	BaseBackupSchedule string `json:"baseBackupSchedule"`
+	// The number of base backups kept, along with the WAL to recover from the
+	// oldest one, default: 2
+	// +kubebuilder:validation:Minimum=1
+	Retention int32 `json:"retention,omitempty"`
+	// The image moving the WAL and base backups, default: minio/mc:RELEASE.2020-04-25T00-43-23Z
+	Image ImageSpec `json:"image,omitempty"`
+}
+
+// PostgresRecoverySpec recovers an instance to a point in time
+type PostgresRecoverySpec struct {
+	// Replay the archived WAL up to this time, IE: 2020-05-01T13:37:00Z
+	TargetTime metav1.Time `json:"targetTime"`
+}
+
+// PostgresPoolerSpec puts PgBouncer in front of a bundled instance
+type PostgresPoolerSpec struct {
+	WorkloadSpec `json:",inline"`
+
+	// The PgBouncer pods, default: 1
+	// +kubebuilder:validation:Minimum=1
+	Replicas int32 `json:"replicas,omitempty"`
+	// When a server connection goes back to the pool, after each session or
+	// transaction, default: transaction
+	// +kubebuilder:validation:Enum=session;transaction
+	PoolMode string `json:"poolMode,omitempty"`
+	// Server connections per database and role, default: 20
+	// +kubebuilder:validation:Minimum=1
+	DefaultPoolSize int32 `json:"defaultPoolSize,omitempty"`
+	// Client connections accepted by each pod, default: 500
+	// +kubebuilder:validation:Minimum=1
+	MaxClientConn int32 `json:"maxClientConn,omitempty"`
+	// Server connections per database from each pod, default: 0, unlimited
+	// +kubebuilder:validation:Minimum=0
+	MaxDBConnections int32 `json:"maxDBConnections,omitempty"`
+	// The PgBouncer image, default: edoburu/pgbouncer:1.15.0
+	Image ImageSpec `json:"image,omitempty"`
+}
+
+// PostgresSpec configures the Postgres instance backing a component
+type PostgresSpec struct {
+	// Use an existing database instead of deploying Postgres
+	External *ExternalPostgresSpec `json:"external,omitempty"`
+
+	WorkloadSpec `json:",inline"`
+
+	// Streaming replicas next to the primary, served read-only by the <name>-ro
+	// Service. Writes fail over to the most up to date replica when the primary
+	// is drained or lost. A primary stuck terminating on a lost node holds the
+	// failover until its pod is force-deleted, default: 0
+	// +kubebuilder:validation:Minimum=0
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// The Postgres major version, IE: 13. Raising it upgrades a bundled
+	// instance by dumping it into new volumes, the former ones are kept until
+	// the upgrade is confirmed. Setting it back before then rolls back to the
+	// data as of the dump, losing every write made since, so it is refused
+	// once the new version has taken writes unless <instance>=<version> is
+	// listed in the gitifold.hyperspike.io/force-postgres-rollback annotation
+	// of the VCS, default: 12
+	// +kubebuilder:validation:Pattern=`^[0-9]+$`
+	Version string `json:"version,omitempty"`
+	// The Postgres image, the tag defaults to <version>-alpine and has to
+	// start with the version when set, default: postgres:12.2-alpine
+	Image ImageSpec `json:"image,omitempty"`
+	// The metrics exporter image, default: wrouesnel/postgres_exporter:v0.8.0
+	ExporterImage ImageSpec `json:"exporterImage,omitempty"`
+
+	// The volume holding the database, default size: 2Gi
+	Storage StorageSpec `json:"storage,omitempty"`
+
+	// Settings of a bundled instance, IE: work_mem: 16MB. Only the memory,
+	// connection, planner, checkpoint, autovacuum, timeout and logging
+	// settings are accepted, and values below the lowest postgres starts with
+	// are refused. Once any is set, shared_buffers, effective_cache_size,
+	// maintenance_work_mem and work_mem default to a share of the memory
+	// limit. Changes are reloaded, and roll the pods only
+	// for those needing a restart. With replicas max_connections,
+	// max_worker_processes, max_prepared_transactions and
+	// max_locks_per_transaction can only be raised.
+	Parameters map[string]string `json:"parameters,omitempty"`
+
+	// Scheduled backups of the database, also taken of an external one
+	Backup *PostgresBackupSpec `json:"backup,omitempty"`
+
+	// Continuous WAL archiving of a bundled instance, for point in time
+	// recovery
+	Archive *PostgresArchiveSpec `json:"archive,omitempty"`
+	// Pool the connections of the component through PgBouncer, served by the
+	// <name>-pooler Service
+	Pooler *PostgresPoolerSpec `json:"pooler,omitempty"`
+	// Recover the archive into a fresh <name>-recovery StatefulSet and Service
+	// next to the running instance, which is left alone. The recovered copy
+	// takes the same credentials, and is ready once it reached the target.
+	// Removing it, or changing the target, drops the copy.
+	Recovery *PostgresRecoverySpec `json:"recovery,omitempty"`
+}
+
+// SharedPostgresSpec configures a single Postgres instance holding a
+// database for every component
+type SharedPostgresSpec struct {
+	// Host the gitea, drone and clair databases in one instance, each with its
+	// own role, instead of deploying one instance per component. The postgres
+	// settings of the components are then ignored, but for external and
+	// backup, default: false.
+	// Existing data is not moved over.
+	Enabled bool `json:"enabled,omitempty"`
+
+	PostgresSpec `json:",inline"`
+}
+
+// IssuerRef names a cert-manager issuer
+type IssuerRef struct {
+	// Name of the issuer
+	Name string `json:"name"`
+	// Issuer or ClusterIssuer, default: Issuer
+	// +kubebuilder:validation:Enum=Issuer;ClusterIssuer
+	Kind string `json:"kind,omitempty"`
+	// API group of the issuer, default: cert-manager.io
+	Group string `json:"group,omitempty"`
+}
+
+// PostgresTLSSpec secures the connections to the bundled Postgres instances
+type PostgresTLSSpec struct {
+	// Serve TLS only, and have the components verify the server with
+	// sslmode=verify-full, default: false. Turning it on rolls every
+	// Postgres instance and the components using them.
+	Enabled *bool `json:"enabled,omitempty"`
+	// Issue the server certificates with cert-manager, the issuer has to hand
+	// out its ca.crt. Otherwise they are signed by a CA the operator keeps in
+	// the <vcs name>-gitifold-postgres-ca secret.
+	IssuerRef *IssuerRef `json:"issuerRef,omitempty"`
+}
+
+// PasswordRotationSpec rotates the Postgres passwords generated by the
+// operator
+type PasswordRotationSpec struct {
+	// Rotate the passwords this long after they were set, IE: 2160h. It is
+	// checked whenever the VCS is reconciled. A single password is rotated
+	// right away by annotating its secret with gitifold.hyperspike.io/rotate-password.
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// KeyDBPersistenceSpec keeps the KeyDB data on a volume
+type KeyDBPersistenceSpec struct {
+	// rdb snapshots, an aof log of every write, or both, default: rdb
+	// +kubebuilder:validation:Enum=rdb;aof;both
+	Mode string `json:"mode,omitempty"`
+	// The volume holding the data, default size: 1Gi
+	Storage StorageSpec `json:"storage,omitempty"`
+}
+
+// KeyDBSpec configures the KeyDB cache backing a component
+type KeyDBSpec struct {
+	WorkloadSpec `json:",inline"`
+
+	// The KeyDB pods, more than one run as active replicas of each other
+	// behind the same Service, so any of them takes writes, default: 1
+	// +kubebuilder:validation:Minimum=1
+	Replicas int32 `json:"replicas,omitempty"`
+	// The KeyDB image, default: eqalpha/keydb:v5.3.3
+	Image ImageSpec `json:"image,omitempty"`
+	// Keep the sessions and cache across restarts, they are only held in
+	// memory otherwise
+	Persistence *KeyDBPersistenceSpec `json:"persistence,omitempty"`
+}
+
 type GitSpec struct {
 	// The External Hostname to use for Ingress
 	Hostname string `json:"hostname,omitempty"`
 	// Ingress annotations, IE: for certs and dns
 	Annotations map[string]string `json:"annotations,omitempty"`
+
+	WorkloadSpec `json:",inline"`
+
+	// The Gitea image, default: gitea/gitea:1.11.4
+	Image ImageSpec `json:"image,omitempty"`
+	// The Gitea version, takes precedence over image.tag. Changing it runs a
+	// staged upgrade with a backup, and rolls back if the new version fails.
+	Version string `json:"version,omitempty"`
+	// The volume holding the pre-upgrade backups, default size: 5Gi
+	BackupStorage StorageSpec `json:"backupStorage,omitempty"`
+
+	// The volume holding the repositories, default size: 5Gi
+	Storage StorageSpec `json:"storage,omitempty"`
+	// The Gitea database
+	Postgres PostgresSpec `json:"postgres,omitempty"`
+	// The Gitea cache
+	KeyDB KeyDBSpec `json:"keydb,omitempty"`
 }
 
 type CISpec struct {
+	// Deploy this component, default: true
+	Enabled *bool `json:"enabled,omitempty"`
+
 	// The External Hostname to use for Ingress
 	Hostname string `json:"hostname,omitempty"`
 	// Ingress annotations, IE: for certs and dns
@@ -36,22 +307,72 @@ type CISpec struct {
 	// The the CI System you wish to use options are drone and agola, default: drone
 	// +kubebuilder:validation:Enum=drone;agola
 	System string `json:"system,omitempty"`
+
+	// Applied to every pod of the CI system
+	WorkloadSpec `json:",inline"`
+
+	// The Drone or Agola image, default: drone/drone:1.6.5 or sorintlab/agola:v0.5.0
+	Image ImageSpec `json:"image,omitempty"`
+	// The Drone runner image, default: drone/drone-runner-kube:1.0.0-beta.1
+	RunnerImage ImageSpec `json:"runnerImage,omitempty"`
+	// The etcd image of Agola, default: quay.io/coreos/etcd:v3.4.7
+	EtcdImage ImageSpec `json:"etcdImage,omitempty"`
+
+	// The volumes holding the Agola data and its etcd, default size: 5Gi for
+	// the data and 1Gi for etcd
+	Storage StorageSpec `json:"storage,omitempty"`
+	// The Drone database
+	Postgres PostgresSpec `json:"postgres,omitempty"`
 }
 
 type RegistrySpec struct {
+	// Deploy this component, default: true
+	Enabled *bool `json:"enabled,omitempty"`
+
 	// The External Hostname to use for Ingress
 	Hostname string `json:"hostname,omitempty"`
 	// Ingress annotations, IE: for certs and dns
 	Annotations map[string]string `json:"annotations,omitempty"`
+
+	WorkloadSpec `json:",inline"`
+
+	// The registry image, default: registry:2.7.1
+	Image ImageSpec `json:"image,omitempty"`
+
+	// The volume holding the images, default size: 1Gi
+	Storage StorageSpec `json:"storage,omitempty"`
 }
 
 type ClairSpec struct {
+	// Deploy this component, default: true
+	Enabled *bool `json:"enabled,omitempty"`
+
 	// The External Hostname to use for Ingress
 	Hostname string `json:"hostname,omitempty"`
 	// Ingress annotations, IE: for certs and dns
 	Annotations map[string]string `json:"annotations,omitempty"`
+
+	WorkloadSpec `json:",inline"`
+
+	// The Clair image, default: coreos/clair:v2.12
+	Image ImageSpec `json:"image,omitempty"`
+
+	// The Clair database
+	Postgres PostgresSpec `json:"postgres,omitempty"`
 }
 
+// RetentionPolicy decides what happens to the data of a VCS when it is deleted
+type RetentionPolicy string
+
+const (
+	// Delete removes every volume and credential along with the VCS
+	RetentionDelete RetentionPolicy = "Delete"
+	// Retain orphans the volumes and credentials so a new VCS of the same name adopts them
+	RetentionRetain RetentionPolicy = "Retain"
+	// Snapshot takes a VolumeSnapshot of every volume and keeps the credentials before deleting the volumes
+	RetentionSnapshot RetentionPolicy = "Snapshot"
+)
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
@@ -70,15 +391,302 @@ type VCSSpec struct {
 	Registry RegistrySpec `json:"registry,omitempty"`
 
 	Clair ClairSpec `json:"clair,omitempty"`
+
+	// One Postgres instance shared by the components
+	SharedPostgres SharedPostgresSpec `json:"sharedPostgres,omitempty"`
+
+	// TLS between the components and the bundled Postgres instances
+	PostgresTLS PostgresTLSSpec `json:"postgresTLS,omitempty"`
+
+	// Rotation of the generated Postgres passwords, the components are
+	// restarted onto the new ones
+	PostgresPasswordRotation PasswordRotationSpec `json:"postgresPasswordRotation,omitempty"`
+
+	// Registry mirroring the default images, it replaces the registry of every image, IE: registry.example.com/mirror
+	ImageRegistry string `json:"imageRegistry,omitempty"`
+	// Secrets used to pull every image
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// What to do with volumes and credentials when the VCS is deleted, options are Delete, Retain and Snapshot, default: Retain
+	// +kubebuilder:validation:Enum=Delete;Retain;Snapshot
+	RetentionPolicy RetentionPolicy `json:"retentionPolicy,omitempty"`
+	// The VolumeSnapshotClass used by the Snapshot retention policy, default: the cluster default
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// VCSPhase is a summary of the state of every component of a VCS
+type VCSPhase string
+
+const (
+	VCSPending     VCSPhase = "Pending"
+	VCSProgressing VCSPhase = "Progressing"
+	VCSReady       VCSPhase = "Ready"
+	VCSDegraded    VCSPhase = "Degraded"
+)
+
+// ConditionType is the type of a VCS or component condition
+type ConditionType string
+
+const (
+	// Ready is True when all replicas are available and up to date
+	ConditionReady ConditionType = "Ready"
+	// Progressing is True while a rollout is in flight
+	ConditionProgressing ConditionType = "Progressing"
+	// Degraded is True when a rollout is stuck or the operator failed to apply the component
+	ConditionDegraded ConditionType = "Degraded"
+)
+
+// Condition follows the shape of the upstream metav1.Condition
+type Condition struct {
+	// +kubebuilder:validation:Enum=Ready;Progressing;Degraded
+	Type ConditionType `json:"type"`
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	// The .metadata.generation the condition was computed against
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Last time the condition changed status
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// CamelCase reason for the last transition
+	Reason string `json:"reason,omitempty"`
+	// Human readable details about the last transition
+	Message string `json:"message,omitempty"`
+}
+
+// ComponentStatus holds the conditions of one of the workloads backing a VCS
+type ComponentStatus struct {
+	// Component name, IE: gitea, drone, gitea-postgres
+	Name string `json:"name"`
+
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// VCSEndpoints are the external URLs the VCS is served on
+type VCSEndpoints struct {
+	Git      string `json:"git,omitempty"`
+	CI       string `json:"ci,omitempty"`
+	Registry string `json:"registry,omitempty"`
+	Clair    string `json:"clair,omitempty"`
+}
+
+// UpgradePhase is the step a Gitea upgrade is at
+type UpgradePhase string
+
+const (
+	// BackingUp scales Gitea down and dumps Gitea and its database
+	UpgradeBackingUp UpgradePhase = "BackingUp"
+	// Migrating runs the database migrations of the new version
+	UpgradeMigrating UpgradePhase = "Migrating"
+	// RollingOut deploys the new version and waits for it to become healthy
+	UpgradeRollingOut UpgradePhase = "RollingOut"
+	// RollingBack restores the backup and deploys the previous version again
+	UpgradeRollingBack UpgradePhase = "RollingBack"
+	// Succeeded means the new version is running
+	UpgradeSucceeded UpgradePhase = "Succeeded"
+	// Failed means the upgrade was rolled back, it is not retried before the
+	// version is set back
+	UpgradeFailed UpgradePhase = "Failed"
+	// RollbackFailed keeps Gitea scaled down until the backup is restored by hand and the version is set back
+	UpgradeRollbackFailed UpgradePhase = "RollbackFailed"
+)
+
+// UpgradeStatus tracks the last Gitea upgrade
+type UpgradeStatus struct {
+	Phase       UpgradePhase `json:"phase"`
+	FromVersion string       `json:"fromVersion"`
+	ToVersion   string       `json:"toVersion"`
+	// Directory of the backup volume holding the pre-upgrade dumps
+	Backup string `json:"backup,omitempty"`
+	// Human readable details about the current phase
+	Message        string       `json:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Rows written to the new version by the restore, a rollback is refused
+	// once the count changed
+	RestoredRows *int64 `json:"restoredRows,omitempty"`
+}
+
+// GitStatus is the observed state of Gitea
+type GitStatus struct {
+	// The Gitea version running
+	Version string `json:"version,omitempty"`
+	// The last, or in flight, upgrade
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+}
+
+// PostgresUpgradePhase is the step a Postgres major upgrade is at
+type PostgresUpgradePhase string
+
+const (
+	// Dumping locks the instance read-only and dumps it
+	PostgresUpgradeDumping PostgresUpgradePhase = "Dumping"
+	// Restoring starts the new version on new volumes and restores the dump
+	PostgresUpgradeRestoring PostgresUpgradePhase = "Restoring"
+	// AwaitingConfirmation runs the new version, the volumes of the former one
+	// are kept until <instance>=<version> is listed in the
+	// gitifold.hyperspike.io/confirm-postgres-upgrade annotation of the VCS,
+	// IE: gitea=13. Setting the version back rolls back, writes taken by the
+	// new version are lost.
+	PostgresUpgradeAwaitingConfirmation PostgresUpgradePhase = "AwaitingConfirmation"
+	// RollingBack starts the former version on its volumes again and unlocks it
+	PostgresUpgradeRollingBack PostgresUpgradePhase = "RollingBack"
+	// Succeeded means the upgrade was confirmed and the former volumes deleted
+	PostgresUpgradeSucceeded PostgresUpgradePhase = "Succeeded"
+	// Failed means the upgrade was rolled back, it is not retried before the
+	// version is set back
+	PostgresUpgradeFailed PostgresUpgradePhase = "Failed"
+)
+
+// PostgresUpgradeStatus tracks the last major upgrade of a Postgres instance
+type PostgresUpgradeStatus struct {
+	Phase       PostgresUpgradePhase `json:"phase"`
+	FromVersion string               `json:"fromVersion"`
+	ToVersion   string               `json:"toVersion"`
+	// Human readable details about the current phase
+	Message        string       `json:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Rows written to the new version by the restore, a rollback is refused
+	// once the count changed
+	RestoredRows *int64 `json:"restoredRows,omitempty"`
+}
+
+// PostgresVersionStatus is the major version of a bundled Postgres instance
+type PostgresVersionStatus struct {
+	// The instance, gitea, drone, clair or shared
+	Name string `json:"name"`
+	// The major version running
+	Version string `json:"version"`
+	// The last, or in flight, upgrade
+	Upgrade *PostgresUpgradeStatus `json:"upgrade,omitempty"`
+}
+
+// PostgresStatus is the replication state of a Postgres instance with replicas
+type PostgresStatus struct {
+	// The instance, gitea, drone, clair or shared
+	Name string `json:"name"`
+	// The pod taking writes
+	Primary string `json:"primary,omitempty"`
+	// When writes last failed over to another pod
+	LastFailoverTime *metav1.Time `json:"lastFailoverTime,omitempty"`
+	// The streaming replicas
+	Replicas []PostgresReplicaStatus `json:"replicas,omitempty"`
+}
+
+// PostgresReplicaStatus is the replication state of a single replica
+type PostgresReplicaStatus struct {
+	// The pod
+	Name string `json:"name"`
+	// Whether it streams from the primary
+	Streaming bool `json:"streaming"`
+	// Bytes of WAL received by the primary but not replayed by the replica yet
+	LagBytes int64 `json:"lagBytes,omitempty"`
+}
+
+// PostgresBackupStatus lists the backups of a database
+type PostgresBackupStatus struct {
+	// The database, gitea, drone or clair
+	Name string `json:"name"`
+	// When the last backup completed
+	LastBackupTime *metav1.Time `json:"lastBackupTime,omitempty"`
+	// The backups kept in the object store, newest first
+	Backups []Backup `json:"backups,omitempty"`
+	// The backup the database was seeded with
+	RestoredFrom string `json:"restoredFrom,omitempty"`
+}
+
+// PostgresArchiveStatus lists the base backups of an archived instance
+type PostgresArchiveStatus struct {
+	// The instance
+	Name string `json:"name"`
+	// When the last base backup succeeded
+	LastBaseBackupTime *metav1.Time `json:"lastBaseBackupTime,omitempty"`
+	// The base backups kept, newest first. The oldest is the earliest time
+	// the instance can be recovered to.
+	BaseBackups []Backup `json:"baseBackups,omitempty"`
+}
+
+// Backup is a single backup in the object store
+type Backup struct {
+	// The name to restore it by
+	Name string `json:"name"`
+	// When it was taken
+	Time metav1.Time `json:"time"`
 }
 
 // VCSStatus defines the observed state of VCS
 type VCSStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Overall phase, the worst state of any component
+	Phase VCSPhase `json:"phase,omitempty"`
+	// The .metadata.generation last acted upon by the operator
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Rolled up Ready, Progressing and Degraded conditions
+	Conditions []Condition `json:"conditions,omitempty"`
+	// Per component conditions
+	Components []ComponentStatus `json:"components,omitempty"`
+	// Resolved external URLs
+	Endpoints VCSEndpoints `json:"endpoints,omitempty"`
+	// Gitea version and upgrades
+	Git GitStatus `json:"git,omitempty"`
+	// Replication of the Postgres instances running replicas
+	Postgres []PostgresStatus `json:"postgres,omitempty"`
+	// Backups of the databases
+	Backups []PostgresBackupStatus `json:"backups,omitempty"`
+	// Base backups of the instances archiving their WAL
+	Archives []PostgresArchiveStatus `json:"archives,omitempty"`
+	// Major versions of the bundled Postgres instances
+	PostgresVersions []PostgresVersionStatus `json:"postgresVersions,omitempty"`
+}
+
+// FindCondition returns the condition of the given type, or nil
+func FindCondition(conditions []Condition, conditionType ConditionType) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates a condition, bumping LastTransitionTime only
+// when the status actually changes.
+func SetCondition(conditions *[]Condition, condition Condition) {
+	existing := FindCondition(*conditions, condition.Type)
+	if existing == nil {
+		if condition.LastTransitionTime.IsZero() {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		*conditions = append(*conditions, condition)
+		return
+	}
+	if existing.Status != condition.Status {
+		existing.Status = condition.Status
+		existing.LastTransitionTime = metav1.Now()
+	}
+	existing.Reason = condition.Reason
+	existing.Message = condition.Message
+	existing.ObservedGeneration = condition.ObservedGeneration
+}
+
+// Component returns the status entry for the named component, creating it
+// if needed.
+func (s *VCSStatus) Component(name string) *ComponentStatus {
+	for i := range s.Components {
+		if s.Components[i].Name == name {
+			return &s.Components[i]
+		}
+	}
+	s.Components = append(s.Components, ComponentStatus{Name: name})
+	return &s.Components[len(s.Components)-1]
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Git",type="string",JSONPath=".status.endpoints.git"
+// +kubebuilder:printcolumn:name="CI",type="string",JSONPath=".status.endpoints.ci"
+// +kubebuilder:printcolumn:name="Registry",type="string",JSONPath=".status.endpoints.registry",priority=1
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".status.git.version",priority=1
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // VCS is the Schema for the vcs API
 type VCS struct {
@@ -21,12 +21,35 @@ limitations under the License.
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Backup) DeepCopyInto(out *Backup) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Backup.
+func (in *Backup) DeepCopy() *Backup {
+	if in == nil {
+		return nil
+	}
+	out := new(Backup)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CISpec) DeepCopyInto(out *CISpec) {
 	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
 	if in.Annotations != nil {
 		in, out := &in.Annotations, &out.Annotations
 		*out = make(map[string]string, len(*in))
@@ -34,6 +57,12 @@ func (in *CISpec) DeepCopyInto(out *CISpec) {
 			(*out)[key] = val
 		}
 	}
+	in.WorkloadSpec.DeepCopyInto(&out.WorkloadSpec)
+	out.Image = in.Image
+	out.RunnerImage = in.RunnerImage
+	out.EtcdImage = in.EtcdImage
+	in.Storage.DeepCopyInto(&out.Storage)
+	in.Postgres.DeepCopyInto(&out.Postgres)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CISpec.
@@ -49,6 +78,11 @@ func (in *CISpec) DeepCopy() *CISpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClairSpec) DeepCopyInto(out *ClairSpec) {
 	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
 	if in.Annotations != nil {
 		in, out := &in.Annotations, &out.Annotations
 		*out = make(map[string]string, len(*in))
@@ -56,6 +90,9 @@ func (in *ClairSpec) DeepCopyInto(out *ClairSpec) {
 			(*out)[key] = val
 		}
 	}
+	in.WorkloadSpec.DeepCopyInto(&out.WorkloadSpec)
+	out.Image = in.Image
+	in.Postgres.DeepCopyInto(&out.Postgres)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClairSpec.
@@ -68,6 +105,59 @@ func (in *ClairSpec) DeepCopy() *ClairSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ComponentStatus) DeepCopyInto(out *ComponentStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ComponentStatus.
+func (in *ComponentStatus) DeepCopy() *ComponentStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ComponentStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Condition) DeepCopyInto(out *Condition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Condition.
+func (in *Condition) DeepCopy() *Condition {
+	if in == nil {
+		return nil
+	}
+	out := new(Condition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalPostgresSpec) DeepCopyInto(out *ExternalPostgresSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalPostgresSpec.
+func (in *ExternalPostgresSpec) DeepCopy() *ExternalPostgresSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalPostgresSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitSpec) DeepCopyInto(out *GitSpec) {
 	*out = *in
@@ -78,6 +168,12 @@ func (in *GitSpec) DeepCopyInto(out *GitSpec) {
 			(*out)[key] = val
 		}
 	}
+	in.WorkloadSpec.DeepCopyInto(&out.WorkloadSpec)
+	out.Image = in.Image
+	in.BackupStorage.DeepCopyInto(&out.BackupStorage)
+	in.Storage.DeepCopyInto(&out.Storage)
+	in.Postgres.DeepCopyInto(&out.Postgres)
+	in.KeyDB.DeepCopyInto(&out.KeyDB)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitSpec.
@@ -90,6 +186,94 @@ func (in *GitSpec) DeepCopy() *GitSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitStatus) DeepCopyInto(out *GitStatus) {
+	*out = *in
+	if in.Upgrade != nil {
+		in, out := &in.Upgrade, &out.Upgrade
+		*out = new(UpgradeStatus)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitStatus.
+func (in *GitStatus) DeepCopy() *GitStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(GitStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageSpec) DeepCopyInto(out *ImageSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageSpec.
+func (in *ImageSpec) DeepCopy() *ImageSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IssuerRef) DeepCopyInto(out *IssuerRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IssuerRef.
+func (in *IssuerRef) DeepCopy() *IssuerRef {
+	if in == nil {
+		return nil
+	}
+	out := new(IssuerRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeyDBPersistenceSpec) DeepCopyInto(out *KeyDBPersistenceSpec) {
+	*out = *in
+	in.Storage.DeepCopyInto(&out.Storage)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeyDBPersistenceSpec.
+func (in *KeyDBPersistenceSpec) DeepCopy() *KeyDBPersistenceSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(KeyDBPersistenceSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeyDBSpec) DeepCopyInto(out *KeyDBSpec) {
+	*out = *in
+	in.WorkloadSpec.DeepCopyInto(&out.WorkloadSpec)
+	out.Image = in.Image
+	if in.Persistence != nil {
+		in, out := &in.Persistence, &out.Persistence
+		*out = new(KeyDBPersistenceSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeyDBSpec.
+func (in *KeyDBSpec) DeepCopy() *KeyDBSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(KeyDBSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Org) DeepCopyInto(out *Org) {
 	*out = *in
@@ -179,6 +363,26 @@ func (in *OrgStatus) DeepCopy() *OrgStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PasswordRotationSpec) DeepCopyInto(out *PasswordRotationSpec) {
+	*out = *in
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PasswordRotationSpec.
+func (in *PasswordRotationSpec) DeepCopy() *PasswordRotationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PasswordRotationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Pipeline) DeepCopyInto(out *Pipeline) {
 	*out = *in
@@ -268,9 +472,296 @@ func (in *PipelineStatus) DeepCopy() *PipelineStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresArchiveSpec) DeepCopyInto(out *PostgresArchiveSpec) {
+	*out = *in
+	out.S3 = in.S3
+	out.Image = in.Image
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresArchiveSpec.
+func (in *PostgresArchiveSpec) DeepCopy() *PostgresArchiveSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresArchiveSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresArchiveStatus) DeepCopyInto(out *PostgresArchiveStatus) {
+	*out = *in
+	if in.LastBaseBackupTime != nil {
+		in, out := &in.LastBaseBackupTime, &out.LastBaseBackupTime
+		*out = (*in).DeepCopy()
+	}
+	if in.BaseBackups != nil {
+		in, out := &in.BaseBackups, &out.BaseBackups
+		*out = make([]Backup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresArchiveStatus.
+func (in *PostgresArchiveStatus) DeepCopy() *PostgresArchiveStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresArchiveStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresBackupSpec) DeepCopyInto(out *PostgresBackupSpec) {
+	*out = *in
+	out.S3 = in.S3
+	out.Image = in.Image
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresBackupSpec.
+func (in *PostgresBackupSpec) DeepCopy() *PostgresBackupSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresBackupSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresBackupStatus) DeepCopyInto(out *PostgresBackupStatus) {
+	*out = *in
+	if in.LastBackupTime != nil {
+		in, out := &in.LastBackupTime, &out.LastBackupTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Backups != nil {
+		in, out := &in.Backups, &out.Backups
+		*out = make([]Backup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresBackupStatus.
+func (in *PostgresBackupStatus) DeepCopy() *PostgresBackupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresBackupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresPoolerSpec) DeepCopyInto(out *PostgresPoolerSpec) {
+	*out = *in
+	in.WorkloadSpec.DeepCopyInto(&out.WorkloadSpec)
+	out.Image = in.Image
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresPoolerSpec.
+func (in *PostgresPoolerSpec) DeepCopy() *PostgresPoolerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresPoolerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresRecoverySpec) DeepCopyInto(out *PostgresRecoverySpec) {
+	*out = *in
+	in.TargetTime.DeepCopyInto(&out.TargetTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresRecoverySpec.
+func (in *PostgresRecoverySpec) DeepCopy() *PostgresRecoverySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresRecoverySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresReplicaStatus) DeepCopyInto(out *PostgresReplicaStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresReplicaStatus.
+func (in *PostgresReplicaStatus) DeepCopy() *PostgresReplicaStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresReplicaStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresSpec) DeepCopyInto(out *PostgresSpec) {
+	*out = *in
+	if in.External != nil {
+		in, out := &in.External, &out.External
+		*out = new(ExternalPostgresSpec)
+		**out = **in
+	}
+	in.WorkloadSpec.DeepCopyInto(&out.WorkloadSpec)
+	out.Image = in.Image
+	out.ExporterImage = in.ExporterImage
+	in.Storage.DeepCopyInto(&out.Storage)
+	if in.Parameters != nil {
+		in, out := &in.Parameters, &out.Parameters
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = new(PostgresBackupSpec)
+		**out = **in
+	}
+	if in.Archive != nil {
+		in, out := &in.Archive, &out.Archive
+		*out = new(PostgresArchiveSpec)
+		**out = **in
+	}
+	if in.Pooler != nil {
+		in, out := &in.Pooler, &out.Pooler
+		*out = new(PostgresPoolerSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Recovery != nil {
+		in, out := &in.Recovery, &out.Recovery
+		*out = new(PostgresRecoverySpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresSpec.
+func (in *PostgresSpec) DeepCopy() *PostgresSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresStatus) DeepCopyInto(out *PostgresStatus) {
+	*out = *in
+	if in.LastFailoverTime != nil {
+		in, out := &in.LastFailoverTime, &out.LastFailoverTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = make([]PostgresReplicaStatus, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresStatus.
+func (in *PostgresStatus) DeepCopy() *PostgresStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresTLSSpec) DeepCopyInto(out *PostgresTLSSpec) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.IssuerRef != nil {
+		in, out := &in.IssuerRef, &out.IssuerRef
+		*out = new(IssuerRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresTLSSpec.
+func (in *PostgresTLSSpec) DeepCopy() *PostgresTLSSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresTLSSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresUpgradeStatus) DeepCopyInto(out *PostgresUpgradeStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.RestoredRows != nil {
+		in, out := &in.RestoredRows, &out.RestoredRows
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresUpgradeStatus.
+func (in *PostgresUpgradeStatus) DeepCopy() *PostgresUpgradeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresUpgradeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresVersionStatus) DeepCopyInto(out *PostgresVersionStatus) {
+	*out = *in
+	if in.Upgrade != nil {
+		in, out := &in.Upgrade, &out.Upgrade
+		*out = new(PostgresUpgradeStatus)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresVersionStatus.
+func (in *PostgresVersionStatus) DeepCopy() *PostgresVersionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresVersionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RegistrySpec) DeepCopyInto(out *RegistrySpec) {
 	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
 	if in.Annotations != nil {
 		in, out := &in.Annotations, &out.Annotations
 		*out = make(map[string]string, len(*in))
@@ -278,6 +769,9 @@ func (in *RegistrySpec) DeepCopyInto(out *RegistrySpec) {
 			(*out)[key] = val
 		}
 	}
+	in.WorkloadSpec.DeepCopyInto(&out.WorkloadSpec)
+	out.Image = in.Image
+	in.Storage.DeepCopyInto(&out.Storage)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistrySpec.
@@ -290,6 +784,100 @@ func (in *RegistrySpec) DeepCopy() *RegistrySpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *S3Spec) DeepCopyInto(out *S3Spec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3Spec.
+func (in *S3Spec) DeepCopy() *S3Spec {
+	if in == nil {
+		return nil
+	}
+	out := new(S3Spec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SharedPostgresSpec) DeepCopyInto(out *SharedPostgresSpec) {
+	*out = *in
+	in.PostgresSpec.DeepCopyInto(&out.PostgresSpec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SharedPostgresSpec.
+func (in *SharedPostgresSpec) DeepCopy() *SharedPostgresSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SharedPostgresSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageSpec) DeepCopyInto(out *StorageSpec) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.AccessModes != nil {
+		in, out := &in.AccessModes, &out.AccessModes
+		*out = make([]corev1.PersistentVolumeAccessMode, len(*in))
+		copy(*out, *in)
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageSpec.
+func (in *StorageSpec) DeepCopy() *StorageSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpgradeStatus) DeepCopyInto(out *UpgradeStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.RestoredRows != nil {
+		in, out := &in.RestoredRows, &out.RestoredRows
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpgradeStatus.
+func (in *UpgradeStatus) DeepCopy() *UpgradeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(UpgradeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *User) DeepCopyInto(out *User) {
 	*out = *in
@@ -385,7 +973,7 @@ func (in *VCS) DeepCopyInto(out *VCS) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VCS.
@@ -406,6 +994,21 @@ func (in *VCS) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VCSEndpoints) DeepCopyInto(out *VCSEndpoints) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VCSEndpoints.
+func (in *VCSEndpoints) DeepCopy() *VCSEndpoints {
+	if in == nil {
+		return nil
+	}
+	out := new(VCSEndpoints)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VCSList) DeepCopyInto(out *VCSList) {
 	*out = *in
@@ -452,6 +1055,14 @@ func (in *VCSSpec) DeepCopyInto(out *VCSSpec) {
 	in.CI.DeepCopyInto(&out.CI)
 	in.Registry.DeepCopyInto(&out.Registry)
 	in.Clair.DeepCopyInto(&out.Clair)
+	in.SharedPostgres.DeepCopyInto(&out.SharedPostgres)
+	in.PostgresTLS.DeepCopyInto(&out.PostgresTLS)
+	in.PostgresPasswordRotation.DeepCopyInto(&out.PostgresPasswordRotation)
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]corev1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VCSSpec.
@@ -467,6 +1078,50 @@ func (in *VCSSpec) DeepCopy() *VCSSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VCSStatus) DeepCopyInto(out *VCSStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Components != nil {
+		in, out := &in.Components, &out.Components
+		*out = make([]ComponentStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	out.Endpoints = in.Endpoints
+	in.Git.DeepCopyInto(&out.Git)
+	if in.Postgres != nil {
+		in, out := &in.Postgres, &out.Postgres
+		*out = make([]PostgresStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Backups != nil {
+		in, out := &in.Backups, &out.Backups
+		*out = make([]PostgresBackupStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Archives != nil {
+		in, out := &in.Archives, &out.Archives
+		*out = make([]PostgresArchiveStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PostgresVersions != nil {
+		in, out := &in.PostgresVersions, &out.PostgresVersions
+		*out = make([]PostgresVersionStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VCSStatus.
@@ -478,3 +1133,49 @@ func (in *VCSStatus) DeepCopy() *VCSStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadSpec) DeepCopyInto(out *WorkloadSpec) {
+	*out = *in
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(corev1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(corev1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TopologySpreadConstraints != nil {
+		in, out := &in.TopologySpreadConstraints, &out.TopologySpreadConstraints
+		*out = make([]corev1.TopologySpreadConstraint, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadSpec.
+func (in *WorkloadSpec) DeepCopy() *WorkloadSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,880 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+const agolaOAuthName = "Agola"
+
+// agolaRemoteSourceAnnotation records a hash of the Gitea remote source
+// last registered in Agola, so it is only pushed again when it changes.
+const agolaRemoteSourceAnnotation = "gitifold.hyperspike.io/agola-remote-source"
+
+// agolaComponent is one of the agola processes, each runs in its own
+// Deployment with the same configuration file.
+type agolaComponent struct {
+	name       string
+	components string
+	port       int32
+	storage    bool
+}
+
+var agolaComponents = []agolaComponent{
+	{name: "gateway", components: "gateway,scheduler,notification", port: 8000},
+	{name: "runservice", components: "runservice", port: 4000, storage: true},
+	{name: "executor", components: "executor", port: 4001},
+	{name: "configstore", components: "configstore", port: 4002, storage: true},
+	{name: "gitserver", components: "gitserver", port: 4003, storage: true},
+}
+
+type AgolaConfig struct {
+	Hostname        string
+	Gateway         string
+	RunService      string
+	ConfigStore     string
+	GitServer       string
+	Etcd            string
+	TokenSigningKey string
+	AdminToken      string
+}
+
+func agolaLabelNames(component string, cr *gitifold.VCS) (string, map[string]string) {
+	labels := map[string]string{
+		"app.kubernetes.io/name":       "agola",
+		"app.kubernetes.io/component":  component,
+		"app.kubernetes.io/deployment": "gitifold",
+		"app.kubernetes.io/instance":   cr.Name,
+	}
+
+	name := strings.Join([]string{cr.Name, component, "gitifold", "agola"}, "-")
+
+	return name, labels
+}
+
+func agolaOAuthClient(cr *gitifold.VCS) oauthClient {
+	name, _ := agolaLabelNames("app", cr)
+	return oauthClient{
+		name:         agolaOAuthName,
+		secret:       name,
+		clientIDKey:  "gitea_client_id",
+		secretKey:    "gitea_client_secret",
+		redirectURIs: []string{strings.Join([]string{"https://", cr.Spec.CI.Hostname, "/oauth2/callback"}, "")},
+	}
+}
+
+func agolaEtcdClaimName(cr *gitifold.VCS) string {
+	name, _ := agolaLabelNames("etcd", cr)
+	return strings.Join([]string{name, name, "0"}, "-")
+}
+
+func createAgolaService(gitClient *gitea.Client, cr *gitifold.VCS, r *VCSReconciler) error {
+	oauthApp, err := reconcileOAuthApp(gitClient, agolaOAuthClient(cr), cr, r)
+	if err != nil {
+		return wrapComponent("agola-gateway", err)
+	}
+
+	if err = reconcileService(cr, r, newAgolaEtcdServiceCr(cr)); err != nil {
+		return wrapComponent("agola-etcd", err)
+	}
+	if err = reconcileStatefulSet(cr, r, newAgolaEtcdStatefulSetCr(cr)); err != nil {
+		return wrapComponent("agola-etcd", err)
+	}
+	if err = expandClaim(agolaEtcdClaimName(cr), claimSize(cr.Spec.CI.Storage, "1Gi"), cr, r); err != nil {
+		return wrapComponent("agola-etcd", err)
+	}
+
+	name, _ := agolaLabelNames("app", cr)
+	found, err := lookupSecret(name, cr, r)
+	if err != nil {
+		return wrapComponent("agola-gateway", err)
+	}
+	secret, err := newAgolaSecretCr(oauthApp, cr, found)
+	if err != nil {
+		return wrapComponent("agola-gateway", err)
+	}
+	if err = reconcileSecret(cr, r, secret); err != nil {
+		return wrapComponent("agola-gateway", err)
+	}
+	configHash := hashData(secret.Data)
+
+	if err = reconcileServiceAccount(cr, r, newAgolaExecutorServiceAccountCr(cr)); err != nil {
+		return wrapComponent("agola-executor", err)
+	}
+	if err = reconcileRole(cr, r, newAgolaExecutorRoleCr(cr)); err != nil {
+		return wrapComponent("agola-executor", err)
+	}
+	if err = reconcileRoleBinding(cr, r, newAgolaExecutorRoleBindingCr(cr)); err != nil {
+		return wrapComponent("agola-executor", err)
+	}
+
+	for _, component := range agolaComponents {
+		if err = reconcileService(cr, r, newAgolaServiceCr(component, cr)); err != nil {
+			return wrapComponent("agola-"+component.name, err)
+		}
+		if component.storage {
+			if err = reconcilePVC(cr, r, newAgolaPVCCr(component, cr)); err != nil {
+				return wrapComponent("agola-"+component.name, err)
+			}
+		}
+		deployment := newAgolaDeploymentCr(component, cr)
+		deployment.Spec.Template.Annotations = map[string]string{
+			configHashAnnotation: configHash,
+		}
+		if err = reconcileDeployment(cr, r, deployment); err != nil {
+			return wrapComponent("agola-"+component.name, err)
+		}
+	}
+	if err = reconcileIngress(cr, r, newAgolaIngressCr(cr)); err != nil {
+		return wrapComponent("agola-gateway", err)
+	}
+
+	return wrapComponent("agola-gateway", registerAgolaRemoteSource(secret, cr, r))
+}
+
+// removeAgolaService tears agola down after switching to another CI system,
+// its volumes and credentials follow the retention policy.
+func removeAgolaService(gitClient *gitea.Client, cr *gitifold.VCS, r *VCSReconciler) error {
+	if err := deleteOAuthApp(gitClient, agolaOAuthClient(cr), cr, r); err != nil {
+		return err
+	}
+
+	name, _ := agolaLabelNames("app", cr)
+	etcdName, _ := agolaLabelNames("etcd", cr)
+	executorName, _ := agolaLabelNames("executor", cr)
+
+	objects := []managedObject{
+		&netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: etcdName}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: etcdName}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: executorName}},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: executorName}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: executorName}},
+	}
+	for _, component := range agolaComponents {
+		componentName, _ := agolaLabelNames(component.name, cr)
+		objects = append(objects,
+			&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: componentName}},
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: componentName}},
+		)
+		if component.storage && retentionPolicy(cr) == gitifold.RetentionDelete {
+			objects = append(objects, &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: componentName}})
+		}
+	}
+	if retentionPolicy(cr) == gitifold.RetentionDelete {
+		objects = append(objects,
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name}},
+			&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: agolaEtcdClaimName(cr)}},
+		)
+	}
+
+	return deleteObjects(objects, cr, r)
+}
+
+// registerAgolaRemoteSource points Agola at Gitea, so users log in and add
+// projects with their Gitea accounts.
+func registerAgolaRemoteSource(secret *corev1.Secret, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	apiURL := strings.Join([]string{"https://", cr.Spec.Git.Hostname}, "")
+	hash := hashData(map[string][]byte{
+		"apiurl":        []byte(apiURL),
+		"client_id":     secret.Data["gitea_client_id"],
+		"client_secret": secret.Data["gitea_client_secret"],
+	})
+
+	found, err := lookupSecret(secret.Name, cr, r)
+	if err != nil || found == nil {
+		return err
+	}
+	if found.Annotations[agolaRemoteSourceAnnotation] == hash {
+		return nil
+	}
+
+	base := agolaRemoteSourcesURL(cr)
+	client := &http.Client{Timeout: 10 * time.Second}
+	notReady := &requeueError{reason: "agola gateway not ready yet", after: 15 * time.Second}
+
+	req, err := agolaRequest(http.MethodGet, base+"/gitea", nil, secret)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return notReady
+	}
+	res.Body.Close()
+
+	method, url := http.MethodPut, base+"/gitea"
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		method, url = http.MethodPost, base
+	case res.StatusCode >= 500:
+		return notReady
+	case res.StatusCode != http.StatusOK:
+		return fmt.Errorf("agola remote source lookup failed: %s", res.Status)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"name":                    "gitea",
+		"type":                    "gitea",
+		"apiurl":                  apiURL,
+		"auth_type":               "oauth2",
+		"oauth2_client_id":        string(secret.Data["gitea_client_id"]),
+		"oauth2_client_secret":    string(secret.Data["gitea_client_secret"]),
+		"skip_ssh_host_key_check": true,
+		"registration_enabled":    true,
+		"login_enabled":           true,
+	})
+	if err != nil {
+		return err
+	}
+	req, err = agolaRequest(method, url, body, secret)
+	if err != nil {
+		return err
+	}
+	res, err = client.Do(req)
+	if err != nil {
+		return notReady
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("agola remote source registration failed: %s", res.Status)
+	}
+	logger.Info("Registered Gitea remote source in Agola", "Method", method)
+
+	if found.Annotations == nil {
+		found.Annotations = make(map[string]string)
+	}
+	found.Annotations[agolaRemoteSourceAnnotation] = hash
+	return r.Client.Update(context.TODO(), found)
+}
+
+// deregisterAgolaRemoteSource removes the Gitea remote source from Agola,
+// the OAuth2 application it logs in with is deleted along with the VCS.
+func deregisterAgolaRemoteSource(cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	name, _ := agolaLabelNames("app", cr)
+	found, err := lookupSecret(name, cr, r)
+	if err != nil || found == nil {
+		return err
+	}
+	if _, ok := found.Annotations[agolaRemoteSourceAnnotation]; !ok {
+		return nil
+	}
+
+	req, err := agolaRequest(http.MethodDelete, agolaRemoteSourcesURL(cr)+"/gitea", nil, found)
+	if err != nil {
+		return err
+	}
+	res, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("agola remote source removal failed: %s", res.Status)
+	}
+	logger.Info("Deregistered Gitea remote source from Agola")
+
+	delete(found.Annotations, agolaRemoteSourceAnnotation)
+	return r.Client.Update(context.TODO(), found)
+}
+
+func agolaRemoteSourcesURL(cr *gitifold.VCS) string {
+	gatewayName, _ := agolaLabelNames("gateway", cr)
+	return strings.Join([]string{"http://", gatewayName, ".", cr.Namespace, ".svc/api/v1alpha/remotesources"}, "")
+}
+
+func agolaRequest(method, url string, body []byte, secret *corev1.Secret) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", strings.Join([]string{"token", string(secret.Data["admin_token"])}, " "))
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func newAgolaSecretCr(oauthApp *gitea.Oauth2, cr *gitifold.VCS, found *corev1.Secret) (*corev1.Secret, error) {
+	name, labels := agolaLabelNames("app", cr)
+	config := template.New("config")
+
+	signingKey, err := secretValue(found, "token_signing_key", func() (string, error) {
+		return getRandomString(64)
+	})
+	if err != nil {
+		return nil, err
+	}
+	adminToken, err := secretValue(found, "admin_token", func() (string, error) {
+		return getRandomString(48)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, _ := agolaLabelNames("gateway", cr)
+	runService, _ := agolaLabelNames("runservice", cr)
+	configStore, _ := agolaLabelNames("configstore", cr)
+	gitServer, _ := agolaLabelNames("gitserver", cr)
+	etcd, _ := agolaLabelNames("etcd", cr)
+	data := AgolaConfig{
+		Hostname:        cr.Spec.CI.Hostname,
+		Gateway:         gateway,
+		RunService:      runService,
+		ConfigStore:     configStore,
+		GitServer:       gitServer,
+		Etcd:            etcd,
+		TokenSigningKey: signingKey,
+		AdminToken:      adminToken,
+	}
+	config, err = config.Parse(`gateway:
+  apiExposedURL: "https://{{ .Hostname }}"
+  webExposedURL: "https://{{ .Hostname }}"
+  runserviceURL: "http://{{ .RunService }}:4000"
+  configstoreURL: "http://{{ .ConfigStore }}:4002"
+  gitserverURL: "http://{{ .GitServer }}:4003"
+  web:
+    listenAddress: ":8000"
+  tokenSigning:
+    duration: 12h
+    method: hmac
+    key: "{{ .TokenSigningKey }}"
+  adminToken: "{{ .AdminToken }}"
+
+scheduler:
+  runserviceURL: "http://{{ .RunService }}:4000"
+
+notification:
+  webExposedURL: "https://{{ .Hostname }}"
+  runserviceURL: "http://{{ .RunService }}:4000"
+  configstoreURL: "http://{{ .ConfigStore }}:4002"
+  etcd:
+    endpoints: "http://{{ .Etcd }}:2379"
+
+configstore:
+  dataDir: /data/agola/configstore
+  etcd:
+    endpoints: "http://{{ .Etcd }}:2379"
+  objectStorage:
+    type: posix
+    path: /data/agola/configstore/ost
+  web:
+    listenAddress: ":4002"
+
+runservice:
+  dataDir: /data/agola/runservice
+  etcd:
+    endpoints: "http://{{ .Etcd }}:2379"
+  objectStorage:
+    type: posix
+    path: /data/agola/runservice/ost
+  web:
+    listenAddress: ":4000"
+
+executor:
+  dataDir: /data/agola/executor
+  toolboxPath: /bin
+  runserviceURL: "http://{{ .RunService }}:4000"
+  web:
+    listenAddress: ":4001"
+  activeTasksLimit: 2
+  driver:
+    type: kubernetes
+
+gitserver:
+  dataDir: /data/agola/gitserver
+  gatewayURL: "http://{{ .Gateway }}:8000"
+  web:
+    listenAddress: ":4003"
+`)
+	if err != nil {
+		return nil, err
+	}
+	var str bytes.Buffer
+	if err = config.Execute(&str, data); err != nil {
+		return nil, err
+	}
+
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Annotations: map[string]string{
+				oauthAppAnnotation: strconv.FormatInt(oauthApp.ID, 10),
+			},
+			Labels: labels,
+		},
+		Data: map[string][]byte{
+			"config.yml":          str.Bytes(),
+			"token_signing_key":   []byte(signingKey),
+			"admin_token":         []byte(adminToken),
+			"gitea_client_id":     []byte(oauthApp.ClientID),
+			"gitea_client_secret": []byte(oauthApp.ClientSecret),
+		},
+	}, nil
+}
+
+func newAgolaServiceCr(component agolaComponent, cr *gitifold.VCS) *corev1.Service {
+	name, labels := agolaLabelNames(component.name, cr)
+
+	port := component.port
+	if component.name == "gateway" {
+		port = 80
+	}
+
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Service",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Type:     "ClusterIP",
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http",
+					Protocol:   "TCP",
+					Port:       port,
+					TargetPort: intstr.FromString("http"),
+				},
+			},
+		},
+	}
+}
+
+func newAgolaIngressCr(cr *gitifold.VCS) *netv1.Ingress {
+	name, labels := agolaLabelNames("app", cr)
+	gatewayName, _ := agolaLabelNames("gateway", cr)
+
+	annotations := make(map[string]string)
+	for key, value := range cr.Spec.CI.Annotations {
+		annotations[key] = value
+	}
+	return &netv1.Ingress{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Ingress",
+			APIVersion: "networking.k8s.io/v1beta1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: annotations,
+			Labels:      labels,
+		},
+		Spec: netv1.IngressSpec{
+			Rules: []netv1.IngressRule{
+				{
+					Host: cr.Spec.CI.Hostname,
+					IngressRuleValue: netv1.IngressRuleValue{
+						HTTP: &netv1.HTTPIngressRuleValue{
+							Paths: []netv1.HTTPIngressPath{
+								{
+									Backend: netv1.IngressBackend{
+										ServiceName: gatewayName,
+										ServicePort: intstr.FromInt(80),
+									},
+									Path: "/",
+								},
+							},
+						},
+					},
+				},
+			},
+			TLS: []netv1.IngressTLS{
+				{
+					Hosts: []string{
+						cr.Spec.CI.Hostname,
+					},
+					SecretName: strings.Join([]string{cr.Name, "agola", "ingress", "tls"}, "-"),
+				},
+			},
+		},
+	}
+}
+
+func newAgolaPVCCr(component agolaComponent, cr *gitifold.VCS) *corev1.PersistentVolumeClaim {
+	name, labels := agolaLabelNames(component.name, cr)
+
+	return &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: claimSpec(cr.Spec.CI.Storage, "5Gi"),
+	}
+}
+
+func newAgolaDeploymentCr(component agolaComponent, cr *gitifold.VCS) *appsv1.Deployment {
+	name, labels := agolaLabelNames(component.name, cr)
+	image, pullPolicy := containerImage("agola", cr.Spec.CI.Image, cr)
+	configName, _ := agolaLabelNames("app", cr)
+
+	rc := int32(1)
+	fal := false
+
+	data := corev1.VolumeSource{
+		EmptyDir: &corev1.EmptyDirVolumeSource{},
+	}
+	strategy := appsv1.DeploymentStrategy{
+		Type: appsv1.RollingUpdateDeploymentStrategyType,
+	}
+	if component.storage {
+		data = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: name,
+			},
+		}
+		// The claim is ReadWriteOnce, the old pod has to let go of it first
+		strategy = appsv1.DeploymentStrategy{
+			Type: appsv1.RecreateDeploymentStrategyType,
+		}
+	}
+
+	spec := corev1.PodSpec{
+		ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+		AutomountServiceAccountToken: &fal,
+		Volumes: []corev1.Volume{
+			{
+				Name: "config",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: configName,
+						Items: []corev1.KeyToPath{
+							{
+								Key:  "config.yml",
+								Path: "config.yml",
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:         "data",
+				VolumeSource: data,
+			},
+		},
+		Containers: []corev1.Container{
+			{
+				Name:            component.name,
+				Image:           image,
+				ImagePullPolicy: pullPolicy,
+				Command: []string{
+					"/bin/agola",
+					"serve",
+					"--config",
+					"/etc/agola/config.yml",
+					"--components",
+					component.components,
+				},
+				Ports: []corev1.ContainerPort{
+					{
+						ContainerPort: component.port,
+						Name:          "http",
+						Protocol:      "TCP",
+					},
+				},
+				ReadinessProbe: &corev1.Probe{
+					Handler: corev1.Handler{
+						TCPSocket: &corev1.TCPSocketAction{
+							Port: intstr.FromString("http"),
+						},
+					},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:      "config",
+						MountPath: "/etc/agola",
+						ReadOnly:  true,
+					},
+					{
+						Name:      "data",
+						MountPath: "/data/agola",
+					},
+				},
+				Resources: workloadResources(cr.Spec.CI.WorkloadSpec, corev1.ResourceRequirements{}),
+			},
+		},
+	}
+	if component.name == "executor" {
+		// The executor schedules the run containers as pods
+		tru := true
+		spec.ServiceAccountName = name
+		spec.AutomountServiceAccountToken = &tru
+	}
+	schedulePod(cr.Spec.CI.WorkloadSpec, &spec)
+
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Deployment",
+			APIVersion: "apps/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &rc,
+			Strategy: strategy,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: spec,
+			},
+		},
+	}
+}
+
+func newAgolaExecutorServiceAccountCr(cr *gitifold.VCS) *corev1.ServiceAccount {
+	name, labels := agolaLabelNames("executor", cr)
+	return &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ServiceAccount",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+	}
+}
+
+func newAgolaExecutorRoleCr(cr *gitifold.VCS) *rbacv1.Role {
+	name, labels := agolaLabelNames("executor", cr)
+	return &rbacv1.Role{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Role",
+			APIVersion: "rbac.authorization.k8s.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{
+					"",
+				},
+				Resources: []string{
+					"pods",
+					"pods/exec",
+					"configmaps",
+					"secrets",
+				},
+				Verbs: []string{
+					"get",
+					"create",
+					"delete",
+					"list",
+					"watch",
+					"update",
+				},
+			},
+			{
+				APIGroups: []string{
+					"coordination.k8s.io",
+				},
+				Resources: []string{
+					"leases",
+				},
+				Verbs: []string{
+					"get",
+					"create",
+					"delete",
+					"list",
+					"watch",
+					"update",
+				},
+			},
+		},
+	}
+}
+
+func newAgolaExecutorRoleBindingCr(cr *gitifold.VCS) *rbacv1.RoleBinding {
+	name, labels := agolaLabelNames("executor", cr)
+
+	return &rbacv1.RoleBinding{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "RoleBinding",
+			APIVersion: "rbac.authorization.k8s.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "Role",
+			Name:     name,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      "ServiceAccount",
+				Name:      name,
+				Namespace: cr.Namespace,
+			},
+		},
+	}
+}
+
+func newAgolaEtcdServiceCr(cr *gitifold.VCS) *corev1.Service {
+	name, labels := agolaLabelNames("etcd", cr)
+
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Service",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Type:     "ClusterIP",
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "client",
+					Protocol:   "TCP",
+					Port:       2379,
+					TargetPort: intstr.FromString("client"),
+				},
+			},
+		},
+	}
+}
+
+func newAgolaEtcdStatefulSetCr(cr *gitifold.VCS) *appsv1.StatefulSet {
+	name, labels := agolaLabelNames("etcd", cr)
+	image, pullPolicy := containerImage("etcd", cr.Spec.CI.EtcdImage, cr)
+
+	rc := int32(1)
+	fal := false
+	sts := &appsv1.StatefulSet{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "StatefulSet",
+			APIVersion: "apps/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Labels:      labels,
+			Annotations: make(map[string]string),
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &rc,
+			ServiceName: name,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{
+					TypeMeta: metav1.TypeMeta{
+						Kind:       "PersistentVolumeClaim",
+						APIVersion: "v1",
+					},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      name,
+						Namespace: cr.Namespace,
+						Labels:    labels,
+					},
+					Spec: claimSpec(cr.Spec.CI.Storage, "1Gi"),
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+					AutomountServiceAccountToken: &fal,
+					Containers: []corev1.Container{
+						{
+							Name:            "etcd",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Command: []string{
+								"etcd",
+								"--name=agola",
+								"--data-dir=/var/lib/etcd",
+								"--listen-client-urls=http://0.0.0.0:2379",
+								strings.Join([]string{"--advertise-client-urls=http://", name, ":2379"}, ""),
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									ContainerPort: 2379,
+									Name:          "client",
+									Protocol:      "TCP",
+								},
+							},
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									HTTPGet: &corev1.HTTPGetAction{
+										Path: "/health",
+										Port: intstr.FromString("client"),
+									},
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      name,
+									MountPath: "/var/lib/etcd",
+								},
+							},
+							Resources: workloadResources(cr.Spec.CI.WorkloadSpec, corev1.ResourceRequirements{}),
+						},
+					},
+				},
+			},
+		},
+	}
+	schedulePod(cr.Spec.CI.WorkloadSpec, &sts.Spec.Template.Spec)
+	return sts
+}
@@ -0,0 +1,452 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1beta1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// configHashAnnotation is stamped on pod templates so pods roll whenever
+// the configuration they mount or source from a secret changes.
+const configHashAnnotation = "gitifold.hyperspike.io/config-hash"
+
+// managedLabelsAnnotation and managedAnnotationsAnnotation list the keys the
+// operator last set on an object, so the ones it no longer sets are taken
+// off again while those added by others are left alone.
+const (
+	managedLabelsAnnotation      = "gitifold.hyperspike.io/managed-labels"
+	managedAnnotationsAnnotation = "gitifold.hyperspike.io/managed-annotations"
+)
+
+type managedObject interface {
+	metav1.Object
+	runtime.Object
+}
+
+// reconcileObject creates obj if it does not exist, otherwise it brings the
+// labels and annotations it manages on the live copy back to the desired
+// ones and lets mutate patch the rest of the spec back to the desired state.
+func reconcileObject(kind string, cr *gitifold.VCS, r *VCSReconciler, obj managedObject, mutate func()) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	// copied, reading the live object decodes into the maps of obj
+	labels := mergeStringMaps(nil, obj.GetLabels())
+	annotations := mergeStringMaps(nil, obj.GetAnnotations())
+
+	op, err := controllerutil.CreateOrUpdate(context.TODO(), r.Client, obj, func() error {
+		managedLabels := obj.GetAnnotations()[managedLabelsAnnotation]
+		managedAnnotations := obj.GetAnnotations()[managedAnnotationsAnnotation]
+		obj.SetLabels(applyStringMap(obj.GetLabels(), labels, managedLabels))
+		live := applyStringMap(obj.GetAnnotations(), annotations, managedAnnotations)
+		live = setManagedKeys(live, managedLabelsAnnotation, labels)
+		obj.SetAnnotations(setManagedKeys(live, managedAnnotationsAnnotation, annotations))
+		mutate()
+		return controllerutil.SetControllerReference(cr, obj, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		logger.Info("Reconciled "+kind, "Name", obj.GetName(), "Operation", op)
+	}
+	return nil
+}
+
+// deleteObject removes an object the operator no longer wants around, it is
+// a no-op when the object is already gone.
+func deleteObject(kind string, cr *gitifold.VCS, r *VCSReconciler, obj managedObject) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	err := r.Client.Delete(context.TODO(), obj, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	logger.Info("Deleted "+kind, "Name", obj.GetName())
+	return nil
+}
+
+// deleteObjects deletes every object in objs from the VCS namespace.
+func deleteObjects(objs []managedObject, cr *gitifold.VCS, r *VCSReconciler) error {
+	for _, obj := range objs {
+		obj.SetNamespace(cr.Namespace)
+		if err := deleteObject(reflect.TypeOf(obj).Elem().Name(), cr, r, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// specMatches tells whether live already holds everything in desired. Fields
+// left empty in desired are taken to be defaulted by the API server, but the
+// slices and maps have to hold the same elements, so an env var, port,
+// container or annotation taken out of desired is also taken out of live.
+func specMatches(desired, live interface{}) bool {
+	return equality.Semantic.DeepDerivative(desired, live) && sameShape(reflect.ValueOf(desired), reflect.ValueOf(live))
+}
+
+// sameShape compares the length of every slice and the keys of every map
+// reachable from desired with those in live.
+func sameShape(desired, live reflect.Value) bool {
+	switch desired.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if desired.IsNil() || live.IsNil() {
+			return true
+		}
+		return sameShape(desired.Elem(), live.Elem())
+	case reflect.Struct:
+		for i := 0; i < desired.NumField(); i++ {
+			// like the amounts of a resource.Quantity
+			if desired.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if !sameShape(desired.Field(i), live.Field(i)) {
+				return false
+			}
+		}
+	case reflect.Slice:
+		if desired.Len() != live.Len() {
+			return false
+		}
+		for i := 0; i < desired.Len(); i++ {
+			if !sameShape(desired.Index(i), live.Index(i)) {
+				return false
+			}
+		}
+	case reflect.Map:
+		if desired.Len() != live.Len() {
+			return false
+		}
+		for _, key := range desired.MapKeys() {
+			value := live.MapIndex(key)
+			if !value.IsValid() || !sameShape(desired.MapIndex(key), value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func reconcileService(cr *gitifold.VCS, r *VCSReconciler, svc *corev1.Service) error {
+	desired := svc.Spec.DeepCopy()
+	return reconcileObject("Service", cr, r, svc, func() {
+		if specMatches(*desired, svc.Spec) {
+			return
+		}
+		clusterIP := svc.Spec.ClusterIP
+		svc.Spec = *desired
+		svc.Spec.ClusterIP = clusterIP
+	})
+}
+
+func reconcileIngress(cr *gitifold.VCS, r *VCSReconciler, ing *netv1.Ingress) error {
+	desired := ing.Spec.DeepCopy()
+	return reconcileObject("Ingress", cr, r, ing, func() {
+		if specMatches(*desired, ing.Spec) {
+			return
+		}
+		ing.Spec = *desired
+	})
+}
+
+func reconcileSecret(cr *gitifold.VCS, r *VCSReconciler, secret *corev1.Secret) error {
+	desired := secret.DeepCopy()
+	return reconcileObject("Secret", cr, r, secret, func() {
+		if equality.Semantic.DeepEqual(desired.Data, secret.Data) {
+			return
+		}
+		secret.Data = desired.Data
+	})
+}
+
+// reconcilePVC creates the claim and afterwards only grows its storage
+// request, everything else in a bound claim's spec is immutable and
+// shrinking is refused by the API server.
+func reconcilePVC(cr *gitifold.VCS, r *VCSReconciler, pvc *corev1.PersistentVolumeClaim) error {
+	desired := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	return reconcileObject("PersistentVolumeClaim", cr, r, pvc, func() {
+		growClaim(pvc, desired)
+	})
+}
+
+func reconcileServiceAccount(cr *gitifold.VCS, r *VCSReconciler, sa *corev1.ServiceAccount) error {
+	return reconcileObject("ServiceAccount", cr, r, sa, func() {})
+}
+
+func reconcileRole(cr *gitifold.VCS, r *VCSReconciler, role *rbacv1.Role) error {
+	desired := role.DeepCopy()
+	return reconcileObject("Role", cr, r, role, func() {
+		if equality.Semantic.DeepEqual(desired.Rules, role.Rules) {
+			return
+		}
+		role.Rules = desired.Rules
+	})
+}
+
+func reconcileRoleBinding(cr *gitifold.VCS, r *VCSReconciler, rb *rbacv1.RoleBinding) error {
+	desired := rb.DeepCopy()
+	return reconcileObject("RoleBinding", cr, r, rb, func() {
+		// RoleRef is immutable, only the subjects can be brought back
+		if rb.RoleRef.Name == "" {
+			rb.RoleRef = desired.RoleRef
+		}
+		if equality.Semantic.DeepEqual(desired.Subjects, rb.Subjects) {
+			return
+		}
+		rb.Subjects = desired.Subjects
+	})
+}
+
+// reconcilePDB brings a PodDisruptionBudget back to the spec asked for. The
+// spec can not be changed before Kubernetes 1.15, so one that drifted is
+// deleted and created again.
+func reconcilePDB(cr *gitifold.VCS, r *VCSReconciler, pdb *policyv1beta1.PodDisruptionBudget) error {
+	found := &policyv1beta1.PodDisruptionBudget{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: pdb.Name, Namespace: pdb.Namespace}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && !specMatches(pdb.Spec, found.Spec) {
+		if err := deleteObject("PodDisruptionBudget", cr, r, found); err != nil {
+			return err
+		}
+	}
+	return reconcileObject("PodDisruptionBudget", cr, r, pdb, func() {})
+}
+
+func reconcileDeployment(cr *gitifold.VCS, r *VCSReconciler, dep *appsv1.Deployment) error {
+	desired := dep.Spec.DeepCopy()
+	defaultPodTemplate(&desired.Template)
+	return reconcileObject("Deployment", cr, r, dep, func() {
+		if specMatches(*desired, dep.Spec) && samePlacement(&desired.Template.Spec, &dep.Spec.Template.Spec) {
+			return
+		}
+		selector := dep.Spec.Selector
+		dep.Spec = *desired
+		if selector != nil {
+			dep.Spec.Selector = selector
+		}
+	})
+}
+
+func reconcileStatefulSet(cr *gitifold.VCS, r *VCSReconciler, sts *appsv1.StatefulSet) error {
+	desired := sts.Spec.DeepCopy()
+	defaultPodTemplate(&desired.Template)
+	return reconcileObject("StatefulSet", cr, r, sts, func() {
+		// Only replicas, the pod template and the update strategy may be
+		// changed on a live StatefulSet.
+		if sts.Spec.Selector == nil {
+			sts.Spec = *desired
+			return
+		}
+		sts.Spec.Replicas = desired.Replicas
+		if !specMatches(desired.Template, sts.Spec.Template) || !samePlacement(&desired.Template.Spec, &sts.Spec.Template.Spec) {
+			sts.Spec.Template = desired.Template
+		}
+		if desired.UpdateStrategy.Type != "" {
+			sts.Spec.UpdateStrategy = desired.UpdateStrategy
+		}
+	})
+}
+
+// defaultPodTemplate fills in the probe and pull policy fields the API
+// server defaults, otherwise the desired template never compares equal to
+// the live one. Requests are only defaulted to the limits on Pods, never on
+// the templates compared here.
+func defaultPodTemplate(tmpl *corev1.PodTemplateSpec) {
+	for i := range tmpl.Spec.Containers {
+		defaultPullPolicy(&tmpl.Spec.Containers[i])
+		defaultProbe(tmpl.Spec.Containers[i].LivenessProbe)
+		defaultProbe(tmpl.Spec.Containers[i].ReadinessProbe)
+	}
+	for i := range tmpl.Spec.InitContainers {
+		defaultPullPolicy(&tmpl.Spec.InitContainers[i])
+		defaultProbe(tmpl.Spec.InitContainers[i].LivenessProbe)
+		defaultProbe(tmpl.Spec.InitContainers[i].ReadinessProbe)
+	}
+}
+
+func defaultPullPolicy(container *corev1.Container) {
+	if container.ImagePullPolicy != "" {
+		return
+	}
+	if strings.HasSuffix(container.Image, ":latest") || !strings.Contains(path.Base(container.Image), ":") {
+		container.ImagePullPolicy = corev1.PullAlways
+		return
+	}
+	container.ImagePullPolicy = corev1.PullIfNotPresent
+}
+
+func defaultProbe(probe *corev1.Probe) {
+	if probe == nil {
+		return
+	}
+	if probe.TimeoutSeconds == 0 {
+		probe.TimeoutSeconds = 1
+	}
+	if probe.PeriodSeconds == 0 {
+		probe.PeriodSeconds = 10
+	}
+	if probe.SuccessThreshold == 0 {
+		probe.SuccessThreshold = 1
+	}
+	if probe.FailureThreshold == 0 {
+		probe.FailureThreshold = 3
+	}
+}
+
+// applyStringMap merges desired into live, after deleting the keys in the
+// comma separated managed list which desired no longer holds.
+func applyStringMap(live, desired map[string]string, managed string) map[string]string {
+	for _, key := range strings.Split(managed, ",") {
+		if _, ok := desired[key]; !ok {
+			delete(live, key)
+		}
+	}
+	return mergeStringMaps(live, desired)
+}
+
+// setManagedKeys records the keys of desired under the annotation name.
+func setManagedKeys(annotations map[string]string, name string, desired map[string]string) map[string]string {
+	if len(desired) == 0 {
+		delete(annotations, name)
+		return annotations
+	}
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return mergeStringMaps(annotations, map[string]string{name: strings.Join(keys, ",")})
+}
+
+func mergeStringMaps(dst, src map[string]string) map[string]string {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for key, value := range src {
+		dst[key] = value
+	}
+	return dst
+}
+
+// lookupSecret returns the live copy of a secret, or nil if it has not
+// been created yet.
+func lookupSecret(name string, cr *gitifold.VCS, r *VCSReconciler) (*corev1.Secret, error) {
+	found := &corev1.Secret{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, found)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return found, nil
+}
+
+// secretValue returns the value already stored under key in found, and only
+// falls back to generate when there is none, so generated credentials
+// survive a re-render of the secret.
+func secretValue(found *corev1.Secret, key string, generate func() (string, error)) (string, error) {
+	if found != nil {
+		if value, ok := found.Data[key]; ok && len(value) > 0 {
+			return string(value), nil
+		}
+	}
+	return generate()
+}
+
+func hashData(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write(data[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// jobFailedError is returned for a Job that gave up retrying.
+type jobFailedError struct {
+	name    string
+	message string
+}
+
+func (e *jobFailedError) Error() string {
+	return fmt.Sprintf("job %s failed: %s", e.name, e.message)
+}
+
+// jobFailure returns a jobFailedError if job gave up retrying, or nil.
+func jobFailure(job *batchv1.Job) *jobFailedError {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return &jobFailedError{name: job.Name, message: c.Message}
+		}
+	}
+	return nil
+}
+
+// runJob creates job if needed and returns nil once it succeeded, a
+// jobFailedError once it gave up, and a requeueError while it runs.
+func runJob(job *batchv1.Job, cr *gitifold.VCS, r *VCSReconciler) error {
+	// A Job's pod template is immutable, so it is only ever created
+	if err := reconcileObject("Job", cr, r, job, func() {}); err != nil {
+		return err
+	}
+	if job.Status.Succeeded > 0 {
+		return nil
+	}
+	if failed := jobFailure(job); failed != nil {
+		return failed
+	}
+	return &requeueError{reason: "waiting for job " + job.Name, after: 10 * time.Second}
+}
+
+// jobMessage returns what container left in its termination log, in a pod
+// of the Job named name that succeeded.
+func jobMessage(name, container string, cr *gitifold.VCS, r *VCSReconciler) (string, error) {
+	pods := &corev1.PodList{}
+	if err := r.Client.List(context.TODO(), pods, client.InNamespace(cr.Namespace), client.MatchingLabels{"job-name": name}); err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == container && status.State.Terminated != nil && status.State.Terminated.ExitCode == 0 {
+				return status.State.Terminated.Message, nil
+			}
+		}
+	}
+	return "", nil
+}
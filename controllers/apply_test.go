@@ -0,0 +1,265 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestSpecMatches(t *testing.T) {
+	template := func() corev1.PodTemplateSpec {
+		return corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:  "gitea",
+						Image: "gitea/gitea:1.11.4",
+						Env: []corev1.EnvVar{
+							{Name: "USER", Value: "git"},
+							{Name: "SSH_PORT", Value: "22"},
+						},
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 3000},
+							{Name: "ssh", ContainerPort: 22},
+						},
+						Resources: corev1.ResourceRequirements{
+							Limits: corev1.ResourceList{
+								corev1.ResourceMemory: resource.MustParse("1Gi"),
+							},
+						},
+					},
+					{
+						Name:  "metrics",
+						Image: "prom/statsd-exporter:v0.15.0",
+					},
+				},
+			},
+		}
+	}
+	withAnnotation := template()
+	withAnnotation.Annotations = map[string]string{configHashAnnotation: "abc"}
+
+	tests := []struct {
+		name    string
+		desired func(*corev1.PodTemplateSpec)
+		live    func(*corev1.PodTemplateSpec)
+		want    bool
+	}{
+		{
+			name: "unchanged",
+			want: true,
+		},
+		{
+			name: "server defaults",
+			live: func(live *corev1.PodTemplateSpec) {
+				grace := int64(30)
+				live.Spec.TerminationGracePeriodSeconds = &grace
+				live.Spec.SecurityContext = &corev1.PodSecurityContext{}
+				live.Spec.DNSPolicy = corev1.DNSClusterFirst
+				live.Spec.Containers[0].TerminationMessagePath = "/dev/termination-log"
+				live.Spec.Containers[0].Ports[0].Protocol = corev1.ProtocolTCP
+			},
+			want: true,
+		},
+		{
+			name: "quantity written differently",
+			live: func(live *corev1.PodTemplateSpec) {
+				live.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory] = resource.MustParse("1024Mi")
+			},
+			want: true,
+		},
+		{
+			name: "request removed",
+			live: func(live *corev1.PodTemplateSpec) {
+				live.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+					corev1.ResourceMemory: resource.MustParse("1Gi"),
+				}
+			},
+			want: false,
+		},
+		{
+			name: "image changed",
+			desired: func(desired *corev1.PodTemplateSpec) {
+				desired.Spec.Containers[0].Image = "gitea/gitea:1.12.0"
+			},
+			want: false,
+		},
+		{
+			name: "env var removed",
+			desired: func(desired *corev1.PodTemplateSpec) {
+				desired.Spec.Containers[0].Env = desired.Spec.Containers[0].Env[:1]
+			},
+			want: false,
+		},
+		{
+			name: "port removed",
+			desired: func(desired *corev1.PodTemplateSpec) {
+				desired.Spec.Containers[0].Ports = desired.Spec.Containers[0].Ports[:1]
+			},
+			want: false,
+		},
+		{
+			name: "container removed",
+			desired: func(desired *corev1.PodTemplateSpec) {
+				desired.Spec.Containers = desired.Spec.Containers[:1]
+			},
+			want: false,
+		},
+		{
+			name: "annotation removed",
+			live: func(live *corev1.PodTemplateSpec) {
+				live.Annotations = withAnnotation.Annotations
+			},
+			want: false,
+		},
+		{
+			name: "annotation added",
+			desired: func(desired *corev1.PodTemplateSpec) {
+				desired.Annotations = withAnnotation.Annotations
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desired, live := template(), template()
+			if tt.desired != nil {
+				tt.desired(&desired)
+			}
+			if tt.live != nil {
+				tt.live(&live)
+			}
+			if got := specMatches(desired, live); got != tt.want {
+				t.Errorf("specMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcilePDB(t *testing.T) {
+	tests := []struct {
+		name string
+		live *intstr.IntOrString
+	}{
+		{name: "missing"},
+		{name: "unchanged", live: func() *intstr.IntOrString { v := intstr.FromInt(1); return &v }()},
+		{name: "drifted", live: func() *intstr.IntOrString { v := intstr.FromInt(2); return &v }()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			objs := []runtime.Object{}
+			if tt.live != nil {
+				live := newKeyDBPDBCr("gitea", cr)
+				live.Spec.MaxUnavailable = tt.live
+				objs = append(objs, live)
+			}
+			r := testReconciler(objs...)
+
+			if err := reconcilePDB(cr, r, newKeyDBPDBCr("gitea", cr)); err != nil {
+				t.Fatal(err)
+			}
+			want := newKeyDBPDBCr("gitea", cr)
+			found := &policyv1beta1.PodDisruptionBudget{}
+			if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: want.Name, Namespace: want.Namespace}, found); err != nil {
+				t.Fatal(err)
+			}
+			if *found.Spec.MaxUnavailable != *want.Spec.MaxUnavailable {
+				t.Errorf("maxUnavailable = %s, want %s", found.Spec.MaxUnavailable.String(), want.Spec.MaxUnavailable.String())
+			}
+		})
+	}
+}
+
+func TestReconcileObjectMetadata(t *testing.T) {
+	tests := []struct {
+		name            string
+		untracked       bool
+		annotations     map[string]string
+		labels          map[string]string
+		wantAnnotations map[string]string
+		wantLabels      map[string]string
+	}{
+		{
+			name:            "unchanged",
+			annotations:     map[string]string{"a": "1", "b": "2"},
+			labels:          map[string]string{"app": "gitea", "tier": "web"},
+			wantAnnotations: map[string]string{"a": "1", "b": "2", "other": "kept"},
+			wantLabels:      map[string]string{"app": "gitea", "tier": "web", "other": "kept"},
+		},
+		{
+			name:            "changed",
+			annotations:     map[string]string{"a": "3", "b": "2"},
+			labels:          map[string]string{"app": "gitea", "tier": "db"},
+			wantAnnotations: map[string]string{"a": "3", "b": "2", "other": "kept"},
+			wantLabels:      map[string]string{"app": "gitea", "tier": "db", "other": "kept"},
+		},
+		{
+			name:            "removed",
+			annotations:     map[string]string{"a": "1"},
+			labels:          map[string]string{"app": "gitea"},
+			wantAnnotations: map[string]string{"a": "1", "other": "kept"},
+			wantLabels:      map[string]string{"app": "gitea", "other": "kept"},
+		},
+		{
+			name:            "all removed",
+			wantAnnotations: map[string]string{"other": "kept"},
+			wantLabels:      map[string]string{"other": "kept"},
+		},
+		{
+			name:            "created before the keys were tracked",
+			untracked:       true,
+			annotations:     map[string]string{"a": "1"},
+			labels:          map[string]string{"app": "gitea"},
+			wantAnnotations: map[string]string{"a": "1", "b": "2", "other": "kept"},
+			wantLabels:      map[string]string{"app": "gitea", "tier": "web", "other": "kept"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			live := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+				Name:        "config",
+				Namespace:   cr.Namespace,
+				Annotations: map[string]string{"a": "1", "b": "2", "other": "kept"},
+				Labels:      map[string]string{"app": "gitea", "tier": "web", "other": "kept"},
+			}}
+			if !tt.untracked {
+				live.Annotations[managedAnnotationsAnnotation] = "a,b"
+				live.Annotations[managedLabelsAnnotation] = "app,tier"
+			}
+			r := testReconciler(live)
+
+			desired := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+				Name:        "config",
+				Namespace:   cr.Namespace,
+				Annotations: tt.annotations,
+				Labels:      tt.labels,
+			}}
+			if err := reconcileObject("ConfigMap", cr, r, desired, func() {}); err != nil {
+				t.Fatal(err)
+			}
+
+			found := &corev1.ConfigMap{}
+			if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: "config", Namespace: cr.Namespace}, found); err != nil {
+				t.Fatal(err)
+			}
+			delete(found.Annotations, managedAnnotationsAnnotation)
+			delete(found.Annotations, managedLabelsAnnotation)
+			if !reflect.DeepEqual(found.Annotations, tt.wantAnnotations) {
+				t.Errorf("annotations = %v, want %v", found.Annotations, tt.wantAnnotations)
+			}
+			if !reflect.DeepEqual(found.Labels, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", found.Labels, tt.wantLabels)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package controllers
 
 import (
 	"bytes"
-	"context"
 	"strings"
 	"text/template"
 
@@ -13,10 +12,6 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 func clairLabelNames(cr *gitifold.VCS) (string, map[string]string) {
@@ -33,73 +28,49 @@ func clairLabelNames(cr *gitifold.VCS) (string, map[string]string) {
 }
 
 func createClairService(dbConfig *DBSecret, cr *gitifold.VCS, r *VCSReconciler) error {
-	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
-
-	clairService := newClairServiceCr(cr)
-	if err := controllerutil.SetControllerReference(cr, clairService, r.Scheme); err != nil {
+	if err := reconcileService(cr, r, newClairServiceCr(cr)); err != nil {
 		return err
 	}
-	foundService := &corev1.Service{}
-	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: clairService.Name, Namespace: clairService.Namespace}, foundService)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Clair Service")
-		err = r.Client.Create(context.TODO(), clairService)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Clair Service already exists")
+	if err := reconcileIngress(cr, r, newClairIngressCr(cr)); err != nil {
+		return err
 	}
 
-	clairIngress := newClairIngressCr(cr)
-	if err = controllerutil.SetControllerReference(cr, clairIngress, r.Scheme); err != nil {
+	name, _ := clairLabelNames(cr)
+	found, err := lookupSecret(name, cr, r)
+	if err != nil {
 		return err
 	}
-	foundIngress := &netv1.Ingress{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: clairIngress.Name, Namespace: clairIngress.Namespace}, foundIngress)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Clair Ingress")
-		err = r.Client.Create(context.TODO(), clairIngress)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Clair Ingress already exists")
-	}
-
-	clairSecret, err := newClairSecretCr(dbConfig, cr)
-	if err = controllerutil.SetControllerReference(cr, clairSecret, r.Scheme); err != nil {
+	clairSecret, err := newClairSecretCr(dbConfig, cr, found)
+	if err != nil {
 		return err
 	}
-	foundSecret := &corev1.Secret{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: clairSecret.Name, Namespace: clairSecret.Namespace}, foundSecret)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Clair Secret")
-		err = r.Client.Create(context.TODO(), clairSecret)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Clair Secret already exists")
+	if err = reconcileSecret(cr, r, clairSecret); err != nil {
+		return err
 	}
 
 	clairDeployment := newClairDeploymentCr(cr)
-	if err = controllerutil.SetControllerReference(cr, clairDeployment, r.Scheme); err != nil {
-		return err
+	clairDeployment.Spec.Template.Annotations = map[string]string{
+		configHashAnnotation: hashData(clairSecret.Data),
 	}
-	foundDeployment := &appsv1.Deployment{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: clairDeployment.Name, Namespace: clairDeployment.Namespace}, foundDeployment)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Clair Deployment")
-		err = r.Client.Create(context.TODO(), clairDeployment)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Clair Deployment already exists")
+	mountDatabaseCA(dbConfig, &clairDeployment.Spec.Template.Spec)
+	return reconcileDeployment(cr, r, clairDeployment)
+}
+
+// removeClairService deletes clair after it has been disabled, its
+// database follows the retention policy.
+func removeClairService(cr *gitifold.VCS, r *VCSReconciler) error {
+	name, _ := clairLabelNames(cr)
+	err := deleteObjects([]managedObject{
+		&netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name}},
+	}, cr, r)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return removePgService("clair", cr, r)
 }
 
 func newClairServiceCr(cr *gitifold.VCS) *corev1.Service {
@@ -187,10 +158,12 @@ type ClairData struct {
 	DB      *DBSecret
 }
 
-func newClairSecretCr(dbSecret *DBSecret, cr *gitifold.VCS) (*corev1.Secret, error) {
+func newClairSecretCr(dbSecret *DBSecret, cr *gitifold.VCS, found *corev1.Secret) (*corev1.Secret, error) {
 	name, labels := clairLabelNames(cr)
 
-	secret, err := GenerateRandomBase64String(32)
+	secret, err := secretValue(found, "paginationkey", func() (string, error) {
+		return GenerateRandomBase64String(32)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -209,7 +182,7 @@ func newClairSecretCr(dbSecret *DBSecret, cr *gitifold.VCS) (*corev1.Secret, err
       # PostgreSQL Connection string
       # https://www.postgresql.org/docs/current/static/libpq-connect.html#LIBPQ-CONNSTRING
       # This should be done using secrets or Vault, but for now this will also work
-      source: "postgres://{{ .DB.User -}}:{{ .DB.Pass -}}@{{ .DB.Host -}}:5432/{{ .DB.Name -}}?sslmode=disable"
+      source: "postgres://{{ .DB.User -}}:{{ .DB.Pass -}}@{{ .DB.Host -}}:{{ .DB.Port -}}/{{ .DB.Name -}}?sslmode={{ .DB.SSLMode -}}"
 
       # Number of elements kept in the cache
       # Values unlikely to change (e.g. namespaces) are cached in order to save prevent needless roundtrips to the database.
@@ -306,19 +279,21 @@ func newClairSecretCr(dbSecret *DBSecret, cr *gitifold.VCS) (*corev1.Secret, err
 			Labels:      labels,
 		},
 		Data: map[string][]byte{
-			"config.yaml": str.Bytes(),
+			"config.yaml":   str.Bytes(),
+			"paginationkey": []byte(secret),
 		},
 	}, nil
 }
 
 func newClairDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 	name, labels := clairLabelNames(cr)
+	image, pullPolicy := containerImage("clair", cr.Spec.Clair.Image, cr)
 	// pgName := strings.Join([]string{cr.Name, "clair", "gitifold", "postgres"}, "-")
 
 	rc := int32(1)
 	fal := false
 
-	return &appsv1.Deployment{
+	dep := &appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Deployment",
 			APIVersion: "apps/v1",
@@ -338,6 +313,7 @@ func newClairDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
 					AutomountServiceAccountToken: &fal,
 					Volumes: []corev1.Volume{
 						{
@@ -345,14 +321,21 @@ func newClairDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 							VolumeSource: corev1.VolumeSource{
 								Secret: &corev1.SecretVolumeSource{
 									SecretName: name,
+									Items: []corev1.KeyToPath{
+										{
+											Key:  "config.yaml",
+											Path: "config.yaml",
+										},
+									},
 								},
 							},
 						},
 					},
 					Containers: []corev1.Container{
 						{
-							Name:  "server",
-							Image: "coreos/clair:v2.12",
+							Name:            "server",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
 							Ports: []corev1.ContainerPort{
 								{
 									ContainerPort: 6060,
@@ -387,10 +370,13 @@ func newClairDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 									MountPath: "/etc/clair",
 								},
 							},
+							Resources: workloadResources(cr.Spec.Clair.WorkloadSpec, corev1.ResourceRequirements{}),
 						},
 					},
 				},
 			},
 		},
 	}
+	schedulePod(cr.Spec.Clair.WorkloadSpec, &dep.Spec.Template.Spec)
+	return dep
 }
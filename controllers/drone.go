@@ -1,7 +1,7 @@
 package controllers
 
 import (
-	"context"
+	"strconv"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -14,10 +14,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"code.gitea.io/sdk/gitea"
-
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 func droneLabelNames(component string, cr *gitifold.VCS) (string, map[string]string) {
@@ -33,154 +29,100 @@ func droneLabelNames(component string, cr *gitifold.VCS) (string, map[string]str
 	return name, labels
 }
 
-func createDroneService(oauthApp *gitea.Oauth2, cr *gitifold.VCS, r *VCSReconciler) error {
-	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+const droneOAuthName = "Drone"
 
-	droneService := newDroneServiceCr(cr)
-	if err := controllerutil.SetControllerReference(cr, droneService, r.Scheme); err != nil {
-		return err
-	}
-	foundService := &corev1.Service{}
-	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: droneService.Name, Namespace: droneService.Namespace}, foundService)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Service")
-		err = r.Client.Create(context.TODO(), droneService)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Service already exists")
+func droneOAuthClient(cr *gitifold.VCS) oauthClient {
+	name, _ := droneLabelNames("app", cr)
+	return oauthClient{
+		name:         droneOAuthName,
+		secret:       name,
+		clientIDKey:  "DRONE_GITEA_CLIENT_ID",
+		secretKey:    "DRONE_GITEA_CLIENT_SECRET",
+		redirectURIs: []string{strings.Join([]string{"https://", cr.Spec.CI.Hostname, "/login"}, "")},
 	}
+}
 
-	droneIngress := newDroneIngressCr(cr)
-	if err = controllerutil.SetControllerReference(cr, droneIngress, r.Scheme); err != nil {
+func createDroneService(oauthApp *gitea.Oauth2, dbSecret *DBSecret, cr *gitifold.VCS, r *VCSReconciler) error {
+	if err := reconcileService(cr, r, newDroneServiceCr(cr)); err != nil {
 		return err
 	}
-	foundIngress := &netv1.Ingress{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: droneIngress.Name, Namespace: droneIngress.Namespace}, foundIngress)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Ingress")
-		err = r.Client.Create(context.TODO(), droneIngress)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Ingress already exists")
-	}
-
-	droneSecret := newDroneSecretCr(oauthApp, cr)
-	if err = controllerutil.SetControllerReference(cr, droneSecret, r.Scheme); err != nil {
+	if err := reconcileIngress(cr, r, newDroneIngressCr(cr)); err != nil {
 		return err
 	}
-	foundSecret := &corev1.Secret{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: droneSecret.Name, Namespace: droneSecret.Namespace}, foundSecret)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Secret")
-		err = r.Client.Create(context.TODO(), droneSecret)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Secret already exists")
-	}
 
-	droneDeployment := newDroneDeploymentCr(cr)
-	if err = controllerutil.SetControllerReference(cr, droneDeployment, r.Scheme); err != nil {
+	name, _ := droneLabelNames("app", cr)
+	found, err := lookupSecret(name, cr, r)
+	if err != nil {
 		return err
 	}
-	foundDeployment := &appsv1.Deployment{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: droneDeployment.Name, Namespace: droneDeployment.Namespace}, foundDeployment)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Deployment")
-		err = r.Client.Create(context.TODO(), droneDeployment)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Deployment already exists")
+	droneSecret, err := newDroneSecretCr(oauthApp, cr, found)
+	if err != nil {
+		return err
 	}
-
-	droneRunnerService := newDroneRunnerServiceCr(cr)
-	if err = controllerutil.SetControllerReference(cr, droneRunnerService, r.Scheme); err != nil {
+	if err = reconcileSecret(cr, r, droneSecret); err != nil {
 		return err
 	}
-	foundRunnerService := &corev1.Service{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: droneRunnerService.Name, Namespace: droneRunnerService.Namespace}, foundRunnerService)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Runner Service")
-		err = r.Client.Create(context.TODO(), droneRunnerService)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Runner Service already exists")
+	configHash := hashData(droneSecret.Data)
+
+	// the database settings are read from the postgres secret, a change of
+	// database has to roll drone too
+	droneDeployment := newDroneDeploymentCr(dbSecret, cr)
+	droneDeployment.Spec.Template.Annotations = map[string]string{
+		configHashAnnotation: hashData(map[string][]byte{
+			"drone":    []byte(configHash),
+			"database": []byte(strings.Join([]string{dbSecret.Host, dbSecret.Port, dbSecret.Name, dbSecret.User, dbSecret.Pass, dbSecret.SSLMode}, "\n")),
+		}),
 	}
-
-	droneRunnerServiceAccount := newDroneRunnerServiceAccountCr(cr)
-	if err = controllerutil.SetControllerReference(cr, droneRunnerServiceAccount, r.Scheme); err != nil {
+	mountDatabaseCA(dbSecret, &droneDeployment.Spec.Template.Spec)
+	if err = reconcileDeployment(cr, r, droneDeployment); err != nil {
 		return err
 	}
-	foundRunnerServiceAccount := &corev1.ServiceAccount{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: droneRunnerServiceAccount.Name, Namespace: droneRunnerServiceAccount.Namespace}, foundRunnerServiceAccount)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Runner Service Account")
-		err = r.Client.Create(context.TODO(), droneRunnerServiceAccount)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Runner Service Account already exists")
-	}
 
-	droneRunnerRole := newDroneRunnerRoleCr(cr)
-	if err = controllerutil.SetControllerReference(cr, droneRunnerRole, r.Scheme); err != nil {
+	if err = reconcileService(cr, r, newDroneRunnerServiceCr(cr)); err != nil {
 		return err
 	}
-	foundRunnerRole := &rbacv1.Role{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: droneRunnerRole.Name, Namespace: droneRunnerRole.Namespace}, foundRunnerRole)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Runner Role")
-		err = r.Client.Create(context.TODO(), droneRunnerRole)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Runner Role already exists")
+	if err = reconcileServiceAccount(cr, r, newDroneRunnerServiceAccountCr(cr)); err != nil {
+		return err
 	}
-
-	droneRunnerRoleBinding := newDroneRunnerRoleBindingCr(cr)
-	if err = controllerutil.SetControllerReference(cr, droneRunnerRoleBinding, r.Scheme); err != nil {
+	if err = reconcileRole(cr, r, newDroneRunnerRoleCr(cr)); err != nil {
 		return err
 	}
-	foundRunnerRoleBinding := &rbacv1.RoleBinding{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: droneRunnerRoleBinding.Name, Namespace: droneRunnerRoleBinding.Namespace}, foundRunnerRoleBinding)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Runner Role Binding")
-		err = r.Client.Create(context.TODO(), droneRunnerRoleBinding)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Runner Role Binding already exists")
+	if err = reconcileRoleBinding(cr, r, newDroneRunnerRoleBindingCr(cr)); err != nil {
+		return err
 	}
 
 	droneRunnerDeployment := newDroneRunnerDeploymentCr(cr)
-	if err = controllerutil.SetControllerReference(cr, droneRunnerDeployment, r.Scheme); err != nil {
+	droneRunnerDeployment.Spec.Template.Annotations = map[string]string{
+		configHashAnnotation: configHash,
+	}
+	return reconcileDeployment(cr, r, droneRunnerDeployment)
+}
+
+// removeDroneService tears drone down after switching to another CI system,
+// its database follows the retention policy.
+func removeDroneService(gitClient *gitea.Client, cr *gitifold.VCS, r *VCSReconciler) error {
+	if err := deleteOAuthApp(gitClient, droneOAuthClient(cr), cr, r); err != nil {
 		return err
 	}
-	foundRunnerDeployment := &appsv1.Deployment{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: droneRunnerDeployment.Name, Namespace: droneRunnerDeployment.Namespace}, foundRunnerDeployment)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Drone Runner Deployment")
-		err = r.Client.Create(context.TODO(), droneRunnerDeployment)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Drone Runner Deployment already exists")
+
+	name, _ := droneLabelNames("app", cr)
+	runnerName, _ := droneLabelNames("runner", cr)
+	err := deleteObjects([]managedObject{
+		&netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: runnerName}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: runnerName}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: runnerName}},
+		&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: runnerName}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: runnerName}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name}},
+	}, cr, r)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return removePgService("drone", cr, r)
 }
 
 func newDroneServiceCr(cr *gitifold.VCS) *corev1.Service {
@@ -261,19 +203,26 @@ func newDroneIngressCr(cr *gitifold.VCS) *netv1.Ingress {
 	}
 }
 
-func newDroneSecretCr(oauthApp *gitea.Oauth2, cr *gitifold.VCS) *corev1.Secret {
+func newDroneSecretCr(oauthApp *gitea.Oauth2, cr *gitifold.VCS, found *corev1.Secret) (*corev1.Secret, error) {
 	name, labels := droneLabelNames("app", cr)
-	secret, _ := GenerateRandomASCIIString(16)
+	secret, err := secretValue(found, "DRONE_RPC_SECRET", func() (string, error) {
+		return GenerateRandomASCIIString(16)
+	})
+	if err != nil {
+		return nil, err
+	}
 	return &corev1.Secret{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Secret",
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        name,
-			Namespace:   cr.Namespace,
-			Annotations: make(map[string]string),
-			Labels:      labels,
+			Name:      name,
+			Namespace: cr.Namespace,
+			Annotations: map[string]string{
+				oauthAppAnnotation: strconv.FormatInt(oauthApp.ID, 10),
+			},
+			Labels: labels,
 		},
 		Data: map[string][]byte{
 			"DRONE_DATABASE_DRIVER":     []byte("postgres"),
@@ -287,17 +236,20 @@ func newDroneSecretCr(oauthApp *gitea.Oauth2, cr *gitifold.VCS) *corev1.Secret {
 			"DRONE_RPC_HOST":            []byte(strings.Join([]string{name, ":80"}, "")),
 			"DRONE_LOGS_DEBUG":          []byte("true"),
 		},
-	}
+	}, nil
 }
 
-func newDroneDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
+// newDroneDeploymentCr reaches the database at the host of dbSecret, which
+// is the pooler when there is one.
+func newDroneDeploymentCr(dbSecret *DBSecret, cr *gitifold.VCS) *appsv1.Deployment {
 	name, labels := droneLabelNames("app", cr)
+	image, pullPolicy := containerImage("drone", cr.Spec.CI.Image, cr)
 	pgName := strings.Join([]string{cr.Name, "drone", "gitifold", "postgres"}, "-")
 
 	rc := int32(1)
 	fal := false
 
-	return &appsv1.Deployment{
+	dep := &appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Deployment",
 			APIVersion: "apps/v1",
@@ -317,6 +269,7 @@ func newDroneDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
 					AutomountServiceAccountToken: &fal,
 					Volumes: []corev1.Volume{
 						{
@@ -328,8 +281,9 @@ func newDroneDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 					},
 					Containers: []corev1.Container{
 						{
-							Name:  "server",
-							Image: "drone/drone:1.6.5",
+							Name:            "server",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
 							Ports: []corev1.ContainerPort{
 								{
 									ContainerPort: 80,
@@ -392,11 +346,26 @@ func newDroneDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 								},
 								{
 									Name:  "POSTGRES_HOST",
-									Value: pgName,
+									Value: dbSecret.Host,
+								},
+								{
+									Name:  "POSTGRES_PORT",
+									Value: dbSecret.Port,
+								},
+								{
+									Name: "POSTGRES_SSLMODE",
+									ValueFrom: &corev1.EnvVarSource{
+										SecretKeyRef: &corev1.SecretKeySelector{
+											LocalObjectReference: corev1.LocalObjectReference{
+												Name: pgName,
+											},
+											Key: "db_sslmode",
+										},
+									},
 								},
 								{
 									Name:  "DRONE_DATABASE_DATASOURCE",
-									Value: "postgres://$(POSTGRES_USER):$(POSTGRES_PASSWORD)@$(POSTGRES_HOST):5432/$(POSTGRES_DB)?sslmode=disable",
+									Value: "postgres://$(POSTGRES_USER):$(POSTGRES_PASSWORD)@$(POSTGRES_HOST):$(POSTGRES_PORT)/$(POSTGRES_DB)?sslmode=$(POSTGRES_SSLMODE)",
 								},
 							},
 							EnvFrom: []corev1.EnvFromSource{
@@ -408,12 +377,15 @@ func newDroneDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 									},
 								},
 							},
+							Resources: workloadResources(cr.Spec.CI.WorkloadSpec, corev1.ResourceRequirements{}),
 						},
 					},
 				},
 			},
 		},
 	}
+	schedulePod(cr.Spec.CI.WorkloadSpec, &dep.Spec.Template.Spec)
+	return dep
 }
 
 func newDroneRunnerServiceAccountCr(cr *gitifold.VCS) *corev1.ServiceAccount {
@@ -539,11 +511,12 @@ func newDroneRunnerServiceCr(cr *gitifold.VCS) *corev1.Service {
 
 func newDroneRunnerDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 	name, labels := droneLabelNames("runner", cr)
+	image, pullPolicy := containerImage("drone-runner", cr.Spec.CI.RunnerImage, cr)
 	appName, labels := droneLabelNames("app", cr)
 
 	rc := int32(1)
 
-	return &appsv1.Deployment{
+	dep := &appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Deployment",
 			APIVersion: "apps/v1",
@@ -563,11 +536,13 @@ func newDroneRunnerDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
+					ImagePullSecrets:   cr.Spec.ImagePullSecrets,
 					ServiceAccountName: name,
 					Containers: []corev1.Container{
 						{
-							Name:  "server",
-							Image: "drone/drone-runner-kube:1.0.0-beta.1",
+							Name:            "server",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
 							Ports: []corev1.ContainerPort{
 								{
 									ContainerPort: 3000,
@@ -584,10 +559,13 @@ func newDroneRunnerDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 									},
 								},
 							},
+							Resources: workloadResources(cr.Spec.CI.WorkloadSpec, corev1.ResourceRequirements{}),
 						},
 					},
 				},
 			},
 		},
 	}
+	schedulePod(cr.Spec.CI.WorkloadSpec, &dep.Spec.Template.Spec)
+	return dep
 }
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	erro "errors"
 
 	"bytes"
 	"crypto/rand"
@@ -12,8 +13,7 @@ import (
 	"text/template"
 	"time"
 
-	erro "errors"
-
+	"code.gitea.io/sdk/gitea"
 	"github.com/dgrijalva/jwt-go"
 
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -28,9 +28,9 @@ import (
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
-func giteaLabels(cr *gitifold.VCS) (string, map[string]string {
+
+func giteaLabels(cr *gitifold.VCS) (string, map[string]string) {
 	labels := map[string]string{
 		"app":        "gitea",
 		"component":  "vcs",
@@ -50,7 +50,7 @@ func fetchGiteaToken(cr *gitifold.VCS, r *VCSReconciler) (string, error) {
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      strings.Join([]string{cr.Name, "gitifold", "gitea", "admin"}, "-"),
+			Name:      giteaAdminSecretName(cr),
 			Namespace: cr.Namespace,
 		},
 	}
@@ -58,157 +58,85 @@ func fetchGiteaToken(cr *gitifold.VCS, r *VCSReconciler) (string, error) {
 
 	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: giteaSecret.Name, Namespace: giteaSecret.Namespace}, found)
 	if err != nil {
-		logger.Info("error fetching gitea token ", err)
+		if errors.IsNotFound(err) {
+			return "", &requeueError{reason: "gitea admin secret not created yet", after: 15 * time.Second}
+		}
+		logger.Error(err, "error fetching gitea token")
 		return "", err
 	}
 
-	if _, ok := found.Data["token"]; !ok {
-		logger.Info("gitea secret missing token key")
-		return "", erro.New("token missing: secret token missing from secret map")
+	if len(found.Data["token"]) == 0 {
+		return "", &requeueError{reason: "gitea admin token not bootstrapped yet", after: 15 * time.Second}
 	}
 
-	token, err := base64.URLEncoding.DecodeString(string(found.Data["token"]))
+	return string(found.Data["token"]), nil
+}
+
+// newGiteaClient returns an API client authenticated as the gitifold admin,
+// talking to Gitea through its in-cluster Service.
+func newGiteaClient(cr *gitifold.VCS, r *VCSReconciler) (*gitea.Client, error) {
+	token, err := fetchGiteaToken(cr, r)
 	if err != nil {
-		logger.Info("failed to decode token ", err)
-		return "", err
+		return nil, err
 	}
-	return string(token), nil
+	name, _ := giteaLabels(cr)
+	url := strings.Join([]string{"http://", name, ".", cr.Namespace, ".svc"}, "")
+
+	return gitea.NewClient(url, token), nil
 }
 
-func createGiteaService(dbSecret *DBSecret, cr *gitifold.VCS, r *VCSReconciler) error {
-	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
-	cm, err := newGiteaSecret(dbSecret, cr)
+func createGiteaService(dbSecret *DBSecret, keydb *KeyDBSecret, cr *gitifold.VCS, r *VCSReconciler) error {
+	name, _ := giteaLabels(cr)
+	found, err := lookupSecret(name, cr, r)
 	if err != nil {
 		return err
 	}
-	if err = controllerutil.SetControllerReference(cr, cm, r.Scheme); err != nil {
+	cm, err := newGiteaSecret(dbSecret, keydb, cr, found)
+	if err != nil {
 		return err
 	}
-	foundCM := &corev1.Secret{}
-
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: cm.Name, Namespace: cm.Namespace}, foundCM)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Gitea Secret")
-		err = r.Client.Create(context.TODO(), cm)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Gitea Secret already exists")
-	}
-
-	svc := newGiteaServiceCr(cr)
-	if err := controllerutil.SetControllerReference(cr, svc, r.Scheme); err != nil {
+	if err = reconcileSecret(cr, r, cm); err != nil {
 		return err
 	}
-	found := &corev1.Service{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, found)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Gitea Service")
-		err = r.Client.Create(context.TODO(), svc)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Gitea service already exists")
-	}
 
-	pvc := newGiteaPVCCr(cr)
-	if err := controllerutil.SetControllerReference(cr, pvc, r.Scheme); err != nil {
+	if err = reconcileService(cr, r, newGiteaServiceCr(cr)); err != nil {
 		return err
 	}
-	foundPVC := &corev1.PersistentVolumeClaim{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}, foundPVC)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Gitea PVC")
-		err = r.Client.Create(context.TODO(), pvc)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Gitea PVC already exists")
-	}
-
-	ing := newGiteaIngressCr(cr)
-	if err := controllerutil.SetControllerReference(cr, ing, r.Scheme); err != nil {
+	if err = reconcilePVC(cr, r, newGiteaPVCCr(cr)); err != nil {
 		return err
 	}
-	foundIng := &netv1.Ingress{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: ing.Name, Namespace: ing.Namespace}, foundIng)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Gitea Ingress")
-		err = r.Client.Create(context.TODO(), ing)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Gitea Ingress already exists")
-	}
-
-	sa := newGiteaServiceAccountCr(cr)
-	if err := controllerutil.SetControllerReference(cr, sa, r.Scheme); err != nil {
+	if err = reconcileIngress(cr, r, newGiteaIngressCr(cr)); err != nil {
 		return err
 	}
-	foundSA := &corev1.ServiceAccount{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: sa.Name, Namespace: sa.Namespace}, foundSA)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Gitea ServiceAccount")
-		err = r.Client.Create(context.TODO(), sa)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Gitea ServiceAccount already exists")
-	}
-
-	role := newGiteaRoleCr(cr)
-	if err := controllerutil.SetControllerReference(cr, role, r.Scheme); err != nil {
+	if err = reconcileServiceAccount(cr, r, newGiteaServiceAccountCr(cr)); err != nil {
 		return err
 	}
-	foundRole := &rbacv1.Role{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: role.Name, Namespace: role.Namespace}, foundRole)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Gitea Role")
-		err = r.Client.Create(context.TODO(), role)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Gitea Role already exists")
+	// Gitea itself no longer talks to the Kubernetes API, the admin token
+	// is written by the bootstrap Job.
+	if err = deleteObject("RoleBinding", cr, r, &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cr.Namespace}}); err != nil {
+		return err
 	}
-
-	roleBinding := newGiteaRoleBindingCr(cr)
-	if err := controllerutil.SetControllerReference(cr, roleBinding, r.Scheme); err != nil {
+	if err = deleteObject("Role", cr, r, &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cr.Namespace}}); err != nil {
 		return err
 	}
-	foundRB := &rbacv1.RoleBinding{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: roleBinding.Name, Namespace: roleBinding.Namespace}, foundRB)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Gitea Rolebinding")
-		err = r.Client.Create(context.TODO(), roleBinding)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Gitea RoleBinding already exists")
+
+	// An upgrade in flight decides the version and holds Gitea down while
+	// its Jobs use the volume.
+	version, scaledDown, upgradeErr := reconcileGiteaUpgrade(dbSecret, cr, r)
+	var wait *requeueError
+	if upgradeErr != nil && !erro.As(upgradeErr, &wait) {
+		return upgradeErr
 	}
 
-	dep := newGiteaDeploymentCr(cr)
-	if err := controllerutil.SetControllerReference(cr, dep, r.Scheme); err != nil {
-		return err
+	dep := newGiteaDeploymentCr(version, scaledDown, cr)
+	dep.Spec.Template.Annotations = map[string]string{
+		configHashAnnotation: hashData(cm.Data),
 	}
-	foundDep := &appsv1.Deployment{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: dep.Name, Namespace: dep.Namespace}, foundDep)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Gitea Deployment")
-		err = r.Client.Create(context.TODO(), dep)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Gitea Deployment already exists")
+	mountDatabaseCA(dbSecret, &dep.Spec.Template.Spec)
+	if err = reconcileDeployment(cr, r, dep); err != nil {
+		return err
 	}
-	return nil
+	return upgradeErr
 }
 
 type GitConfig struct {
@@ -219,6 +147,7 @@ type GitConfig struct {
 	SecretKey    string
 	Token        string
 	DBConf       *DBSecret
+	KeyDB        *KeyDBSecret
 	LFSSecret    string
 	OauthSecret  string
 	OathSecret   string
@@ -262,24 +191,45 @@ func genJWTSecret() string {
 	return JWTSecretBase64
 }
 
-func newGiteaSecret(dbSecret *DBSecret, cr *gitifold.VCS) (*corev1.Secret, error) {
-	name, labels := giteaLabels(cr)
-	config := template.New("config")
-
+func newGiteaInternalToken() (string, error) {
 	secretBytes := make([]byte, 32)
 	_, err := io.ReadFull(rand.Reader, secretBytes)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	secretKey := base64.RawURLEncoding.EncodeToString(secretBytes)
 	now := time.Now()
-	var internalToken string
-	internalToken, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"nbf": now.Unix(),
 	}).SignedString([]byte(secretKey))
+}
+
+func newGiteaSecret(dbSecret *DBSecret, keydb *KeyDBSecret, cr *gitifold.VCS, found *corev1.Secret) (*corev1.Secret, error) {
+	name, labels := giteaLabels(cr)
+	config := template.New("config")
 
-	secret, err := getRandomString(64)
+	// The keys are generated once and kept in the secret, re-rendering
+	// app.ini must not invalidate sessions, tokens or LFS pointers.
+	internalToken, err := secretValue(found, "internal_token", newGiteaInternalToken)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := secretValue(found, "secret_key", func() (string, error) {
+		return getRandomString(64)
+	})
+	if err != nil {
+		return nil, err
+	}
+	lfsSecret, err := secretValue(found, "lfs_jwt_secret", func() (string, error) {
+		return genJWTSecret(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	oauthSecret, err := secretValue(found, "oauth2_jwt_secret", func() (string, error) {
+		return genJWTSecret(), nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -287,12 +237,13 @@ func newGiteaSecret(dbSecret *DBSecret, cr *gitifold.VCS) (*corev1.Secret, error
 	data := GitConfig{
 		Name:         cr.Name,
 		Domain:       cr.Spec.Git.Hostname,
-		LFSSecret:    genJWTSecret(),
-		OauthSecret:  genJWTSecret(),
+		LFSSecret:    lfsSecret,
+		OauthSecret:  oauthSecret,
 		Token:        internalToken,
 		SecretKey:    secret,
 		NoReplyEmail: cr.Spec.Git.Hostname,
 		DBConf:       dbSecret,
+		KeyDB:        keydb,
 		Namespace:    cr.Namespace,
 	}
 	config, err = config.Parse(`APP_NAME = {{ .Name -}} Git
@@ -323,22 +274,22 @@ OFFLINE_MODE     = true
 
 [database]
 DB_TYPE  = postgres
-HOST     = {{ .DBConf.Host -}}.{{ .Namespace -}}.svc:5432
+HOST     = {{ .DBConf.Host -}}:{{ .DBConf.Port }}
 NAME     = {{ .DBConf.Name }}
 USER     = {{ .DBConf.User }}
 PASSWD   = {{ .DBConf.Pass }}
-SSL_MODE = disable
+SSL_MODE = {{ .DBConf.SSLMode }}
 
 [indexer]
 ISSUE_INDEXER_PATH = /data/gitea/indexers/issues.bleve
 
 [session]
-PROVIDER_CONFIG = network=tcp,addr={{ .Name -}}-gitea-gitifold-keydb.{{ .Namespace -}}.svc:6379,db=0,pool_size=100,idle_timeout=180
+PROVIDER_CONFIG = network=tcp,addr={{ .KeyDB.Host -}}:{{ .KeyDB.Port -}},password={{ .KeyDB.Pass -}},db=0,pool_size=100,idle_timeout=180
 PROVIDER        = redis
 
 [cache]
 ADAPTER = redis
-HOST = network=tcp,addr={{ .Name -}}-gitea-gitifold-keydb.{{ .Namespace -}}.svc:6379,db=1,pool_size=100,idle_timeout=180
+HOST = network=tcp,addr={{ .KeyDB.Host -}}:{{ .KeyDB.Port -}},password={{ .KeyDB.Pass -}},db=1,pool_size=100,idle_timeout=180
 
 [picture]
 AVATAR_UPLOAD_PATH      = /data/gitea/avatars
@@ -384,18 +335,6 @@ ENABLED = true
 ENABLE_OPENID_SIGNIN = true
 ENABLE_OPENID_SIGNUP = true`)
 
-	cmd := `#!/bin/sh
-
-name=$1
-
-curl -f -H "Authorization: Bearer $(cat /run/secrets/kubernetes.io/serviceaccount/token)" --cacert /run/secrets/kubernetes.io/serviceaccount/ca.crt https://kubernetes.default.svc.cluster.local/api/v1/namespaces/$(cat /run/secrets/kubernetes.io/serviceaccount/namespace)secrets/$name
-if [ "$?" -ne "0" ] ; then
-	TOKEN=$(su git -c 'gitea admin create-user --email gitea@hyperspike.io --username gitifold --admin --random-password --access-token' | awk '$0 ~ /Access token/ { print $NF }')
-	curl -f -H "Authorization: Bearer $(cat /run/secrets/kubernetes.io/serviceaccount/token)" --cacert /run/secrets/kubernetes.io/serviceaccount/ca.crt https://kubernetes.default.svc.cluster.local/api/v1/namespaces/$(cat /run/secrets/kubernetes.io/serviceaccount/namespace)secrets/$name \
-	-d "{\"kind\": \"Secret\", \"apiVersion\": \"v1\", \"metadata\": { \"name\": \"${name }\"}, \"data\": { \"token\": \"$(echo ${TOKEN} | base64 -w 0 )\" },  \"type\": \"Opaque\" }"
-fi
-`
-
 	if err != nil {
 		return nil, err
 	}
@@ -414,8 +353,11 @@ fi
 			Labels:    labels,
 		},
 		Data: map[string][]byte{
-			"app.ini": str.Bytes(),
-			"cmd":     []byte(cmd),
+			"app.ini":           str.Bytes(),
+			"internal_token":    []byte(internalToken),
+			"secret_key":        []byte(secret),
+			"lfs_jwt_secret":    []byte(lfsSecret),
+			"oauth2_jwt_secret": []byte(oauthSecret),
 		},
 	}, nil
 }
@@ -508,12 +450,7 @@ func newGiteaIngressCr(cr *gitifold.VCS) *netv1.Ingress {
 func newGiteaPVCCr(cr *gitifold.VCS) *corev1.PersistentVolumeClaim {
 	name, labels := giteaLabels(cr)
 
-	size, _ := resource.ParseQuantity("5Gi")
-	/*if cr.Spec.Git.Storage.StorageSize != "" {
-		size, _ = resource.ParseQuantity(cr.Spec.Git.Storage.StorageSize)
-	}
-	*/
-	ret := &corev1.PersistentVolumeClaim{
+	return &corev1.PersistentVolumeClaim{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "PersistentVolumeClaim",
 			APIVersion: "v1",
@@ -523,23 +460,8 @@ func newGiteaPVCCr(cr *gitifold.VCS) *corev1.PersistentVolumeClaim {
 			Namespace: cr.Namespace,
 			Labels:    labels,
 		},
-		Spec: corev1.PersistentVolumeClaimSpec{
-			Resources: corev1.ResourceRequirements{
-				Requests: corev1.ResourceList{
-					"storage": size,
-				},
-			},
-			AccessModes: []corev1.PersistentVolumeAccessMode{
-				corev1.ReadWriteOnce,
-			},
-		},
+		Spec: claimSpec(cr.Spec.Git.Storage, "5Gi"),
 	}
-	/*
-		if cr.Spec.Git.Storage.StorageClass != "" {
-			ret.Spec.StorageClassName = &cr.Spec.Git.Storage.StorageClass
-		}
-	*/
-	return ret
 }
 
 func newGiteaServiceAccountCr(cr *gitifold.VCS) *corev1.ServiceAccount {
@@ -559,79 +481,22 @@ func newGiteaServiceAccountCr(cr *gitifold.VCS) *corev1.ServiceAccount {
 	}
 }
 
-func newGiteaRoleCr(cr *gitifold.VCS) *rbacv1.Role {
-	name, labels := giteaLabels(cr)
-
-	return &rbacv1.Role{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Role",
-			APIVersion: "rbac.authorization.k8s.io/v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:        name,
-			Namespace:   cr.Namespace,
-			Annotations: make(map[string]string),
-			Labels:      labels,
-		},
-		Rules: []rbacv1.PolicyRule{
-			{
-				APIGroups: []string{
-					"",
-				},
-				Resources: []string{
-					"secrets",
-				},
-				Verbs: []string{
-					"create",
-					"delete",
-					"update",
-					"get",
-				},
-			},
-		},
-	}
-}
-
-func newGiteaRoleBindingCr(cr *gitifold.VCS) *rbacv1.RoleBinding {
-	name, labels := giteaLabels(cr)
-
-	return &rbacv1.RoleBinding{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "RoleBinding",
-			APIVersion: "rbac.authorization.k8s.io/v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:        name,
-			Namespace:   cr.Namespace,
-			Annotations: make(map[string]string),
-			Labels:      labels,
-		},
-		RoleRef: rbacv1.RoleRef{
-			APIGroup: "rbac.authorization.k8s.io",
-			Kind:     "Role",
-			Name:     name,
-		},
-		Subjects: []rbacv1.Subject{
-			{
-				Kind:      "ServiceAccount",
-				Name:      name,
-				Namespace: cr.Namespace,
-			},
-		},
-	}
-}
-
-func newGiteaDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
+func newGiteaDeploymentCr(version string, scaledDown bool, cr *gitifold.VCS) *appsv1.Deployment {
 	name, labels := giteaLabels(cr)
+	image, pullPolicy := giteaImage(version, cr)
 
 	limitCpu, _ := resource.ParseQuantity("250m")
-	limitMemory, _ := resource.ParseQuantity("250Mi")
+	limitMemory, _ := resource.ParseQuantity("1024Mi")
 	requestCpu, _ := resource.ParseQuantity("10m")
 	requestMemory, _ := resource.ParseQuantity("50Mi")
 
 	rc := int32(1)
+	if scaledDown {
+		rc = 0
+	}
+	fal := false
 
-	return &appsv1.Deployment{
+	dep := &appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Deployment",
 			APIVersion: "apps/v1",
@@ -651,7 +516,9 @@ func newGiteaDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
-					ServiceAccountName: name,
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+					ServiceAccountName:           name,
+					AutomountServiceAccountToken: &fal,
 					Volumes: []corev1.Volume{
 						{
 							Name: "git",
@@ -671,10 +538,6 @@ func newGiteaDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 											Key:  "app.ini",
 											Path: "app.ini",
 										},
-										{
-											Key:  "cmd",
-											Path: "cmd",
-										},
 									},
 								},
 							},
@@ -682,8 +545,9 @@ func newGiteaDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 					},
 					Containers: []corev1.Container{
 						{
-							Name:  "gitea",
-							Image: "gitea/gitea:1.11.4",
+							Name:            "gitea",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
 							VolumeMounts: []corev1.VolumeMount{
 								{
 									Name:      "git",
@@ -694,11 +558,6 @@ func newGiteaDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 									MountPath: "/data/gitea/conf/app.ini",
 									SubPath:   "app.ini",
 								},
-								{
-									Name:      "config",
-									MountPath: "/usr/local/bin/admin-add",
-									SubPath:   "cmd",
-								},
 							},
 							Ports: []corev1.ContainerPort{
 								{
@@ -712,19 +571,6 @@ func newGiteaDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 									Protocol:      "TCP",
 								},
 							},
-							Lifecycle: &corev1.Lifecycle{
-								PostStart: &corev1.Handler{
-									Exec: &corev1.ExecAction{
-										Command: []string{
-											"/bin/sh",
-											"-c",
-											"cp /tmp/admin-add /usr/local/bin/admin-add",
-											"chmod +x /usr/local/bin/admin-add",
-											strings.Join([]string{"/usr/local/bin/admin-add ", cr.Name, "-gitifold-gitea-admin"}, ""),
-										},
-									},
-								},
-							},
 							LivenessProbe: &corev1.Probe{
 								Handler: corev1.Handler{
 									HTTPGet: &corev1.HTTPGetAction{
@@ -745,7 +591,7 @@ func newGiteaDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 								InitialDelaySeconds: int32(10),
 								PeriodSeconds:       int32(6),
 							},
-							Resources: corev1.ResourceRequirements{
+							Resources: workloadResources(cr.Spec.Git.WorkloadSpec, corev1.ResourceRequirements{
 								Limits: corev1.ResourceList{
 									"cpu":    limitCpu,
 									"memory": limitMemory,
@@ -754,11 +600,13 @@ func newGiteaDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 									"cpu":    requestCpu,
 									"memory": requestMemory,
 								},
-							},
+							}),
 						},
 					},
 				},
 			},
 		},
 	}
+	schedulePod(cr.Spec.Git.WorkloadSpec, &dep.Spec.Template.Spec)
+	return dep
 }
@@ -0,0 +1,299 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// giteaBootstrapScript creates the gitifold admin and stores its access
+// token in the admin secret. When the admin already exists, because the
+// token was lost, the password is reset and a fresh token is minted through
+// the API instead.
+const giteaBootstrapScript = `set -e
+
+CONFIG=/data/gitea/conf/app.ini
+PASSWORD=$(head -c 48 /dev/urandom | base64 | tr -dc 'a-zA-Z0-9' | head -c 32)
+
+TOKEN=$(su git -c "gitea admin create-user --config ${CONFIG} --email gitea@hyperspike.io --username gitifold --admin --password ${PASSWORD} --access-token" | awk '$0 ~ /Access token/ { print $NF }') || true
+if [ -z "${TOKEN}" ] ; then
+	su git -c "gitea admin change-password --config ${CONFIG} --username gitifold --password ${PASSWORD}"
+	TOKEN=$(curl -sf -u "gitifold:${PASSWORD}" -H 'Content-Type: application/json' \
+		-d "{\"name\": \"gitifold-$(date +%s)\"}" \
+		"${GITEA_URL}/api/v1/users/gitifold/tokens" | sed -n 's/.*"sha1":"\([^"]*\)".*/\1/p')
+fi
+[ -n "${TOKEN}" ]
+
+SA=/run/secrets/kubernetes.io/serviceaccount
+curl -sf -X PATCH \
+	-H "Authorization: Bearer $(cat ${SA}/token)" \
+	-H 'Content-Type: application/merge-patch+json' \
+	--cacert ${SA}/ca.crt \
+	-d "{\"data\": {\"token\": \"$(printf %s "${TOKEN}" | base64 | tr -d '\n')\"}}" \
+	"https://kubernetes.default.svc/api/v1/namespaces/$(cat ${SA}/namespace)/secrets/${ADMIN_SECRET}" > /dev/null
+`
+
+func giteaAdminSecretName(cr *gitifold.VCS) string {
+	return strings.Join([]string{cr.Name, "gitifold", "gitea", "admin"}, "-")
+}
+
+func giteaBootstrapLabels(cr *gitifold.VCS) (string, map[string]string) {
+	name, labels := giteaLabels(cr)
+	bootstrapLabels := make(map[string]string, len(labels))
+	for key, value := range labels {
+		bootstrapLabels[key] = value
+	}
+	// must not match the Gitea Service selector
+	bootstrapLabels["app"] = "gitea-bootstrap"
+
+	return strings.Join([]string{name, "bootstrap"}, "-"), bootstrapLabels
+}
+
+// reconcileGiteaBootstrap runs the Job that creates the Gitea admin, it
+// reruns the Job if a finished run left no token behind, or once Gitea is
+// available after the Job gave up.
+func reconcileGiteaBootstrap(dbSecret *DBSecret, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	// Created empty, the bootstrap Job may only patch this one secret
+	adminSecret := newGiteaAdminSecretCr(cr)
+	if err := reconcileObject("Secret", cr, r, adminSecret, func() {}); err != nil {
+		return err
+	}
+	if err := reconcileServiceAccount(cr, r, newGiteaBootstrapServiceAccountCr(cr)); err != nil {
+		return err
+	}
+	if err := reconcileRole(cr, r, newGiteaBootstrapRoleCr(cr)); err != nil {
+		return err
+	}
+	if err := reconcileRoleBinding(cr, r, newGiteaBootstrapRoleBindingCr(cr)); err != nil {
+		return err
+	}
+
+	job := newGiteaBootstrapJobCr(cr)
+	mountDatabaseCA(dbSecret, &job.Spec.Template.Spec)
+	found := &batchv1.Job{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if failed := jobFailure(found); failed != nil {
+			// Most likely Gitea took too long to come up the first time
+			giteaName, _ := giteaLabels(cr)
+			conditions, err := deploymentConditions(giteaName, cr, r)
+			if err != nil {
+				return err
+			}
+			if !isTrue(conditions, gitifold.ConditionReady) {
+				failed.message += ", it runs again once Gitea is available"
+				return failed
+			}
+			logger.Info("Gitea bootstrap failed, running it again")
+			if err = deleteObject("Job", cr, r, found); err != nil {
+				return err
+			}
+			return &requeueError{reason: "running the gitea bootstrap again", after: 5 * time.Second}
+		}
+		if found.Status.Succeeded == 0 || len(adminSecret.Data["token"]) > 0 {
+			return nil
+		}
+		logger.Info("Gitea bootstrap finished without a token, running it again")
+		return deleteObject("Job", cr, r, found)
+	}
+
+	// A Job's pod template is immutable, so it is only ever created
+	return reconcileObject("Job", cr, r, job, func() {})
+}
+
+func newGiteaAdminSecretCr(cr *gitifold.VCS) *corev1.Secret {
+	_, labels := giteaLabels(cr)
+
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      giteaAdminSecretName(cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Type: corev1.SecretTypeOpaque,
+	}
+}
+
+func newGiteaBootstrapServiceAccountCr(cr *gitifold.VCS) *corev1.ServiceAccount {
+	name, labels := giteaBootstrapLabels(cr)
+
+	return &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ServiceAccount",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+	}
+}
+
+func newGiteaBootstrapRoleCr(cr *gitifold.VCS) *rbacv1.Role {
+	name, labels := giteaBootstrapLabels(cr)
+
+	return &rbacv1.Role{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Role",
+			APIVersion: "rbac.authorization.k8s.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{
+					"",
+				},
+				Resources: []string{
+					"secrets",
+				},
+				ResourceNames: []string{
+					giteaAdminSecretName(cr),
+				},
+				Verbs: []string{
+					"get",
+					"patch",
+				},
+			},
+		},
+	}
+}
+
+func newGiteaBootstrapRoleBindingCr(cr *gitifold.VCS) *rbacv1.RoleBinding {
+	name, labels := giteaBootstrapLabels(cr)
+
+	return &rbacv1.RoleBinding{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "RoleBinding",
+			APIVersion: "rbac.authorization.k8s.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "Role",
+			Name:     name,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      "ServiceAccount",
+				Name:      name,
+				Namespace: cr.Namespace,
+			},
+		},
+	}
+}
+
+func newGiteaBootstrapJobCr(cr *gitifold.VCS) *batchv1.Job {
+	name, labels := giteaBootstrapLabels(cr)
+	image, pullPolicy := giteaImage(cr.Status.Git.Version, cr)
+	giteaName, _ := giteaLabels(cr)
+
+	backoffLimit := int32(6)
+
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:   cr.Spec.ImagePullSecrets,
+					ServiceAccountName: name,
+					RestartPolicy:      corev1.RestartPolicyNever,
+					Volumes: []corev1.Volume{
+						{
+							Name: "data",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: giteaName,
+									Items: []corev1.KeyToPath{
+										{
+											Key:  "app.ini",
+											Path: "app.ini",
+										},
+									},
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:            "bootstrap",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Command:         []string{"/bin/sh", "-c", giteaBootstrapScript},
+							Env: []corev1.EnvVar{
+								{
+									Name:  "ADMIN_SECRET",
+									Value: giteaAdminSecretName(cr),
+								},
+								{
+									Name:  "GITEA_URL",
+									Value: strings.Join([]string{"http://", giteaName, ".", cr.Namespace, ".svc"}, ""),
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "data",
+									MountPath: "/data",
+								},
+								{
+									Name:      "config",
+									MountPath: "/data/gitea/conf/app.ini",
+									SubPath:   "app.ini",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	schedulePod(cr.Spec.Git.WorkloadSpec, &job.Spec.Template.Spec)
+	return job
+}
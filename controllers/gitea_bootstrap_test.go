@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestReconcileGiteaBootstrapFailed(t *testing.T) {
+	tests := []struct {
+		name       string
+		giteaReady bool
+		wantJob    bool
+	}{
+		{name: "gitea unavailable", giteaReady: false, wantJob: true},
+		{name: "gitea available", giteaReady: true, wantJob: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			jobName, _ := giteaBootstrapLabels(cr)
+			giteaName, _ := giteaLabels(cr)
+
+			job := &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Name: jobName, Namespace: cr.Namespace},
+				Status: batchv1.JobStatus{
+					Failed: 7,
+					Conditions: []batchv1.JobCondition{
+						{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"},
+					},
+				},
+			}
+			gitea := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: giteaName, Namespace: cr.Namespace}}
+			if tt.giteaReady {
+				gitea.Status.AvailableReplicas = 1
+			}
+			r := testReconciler([]runtime.Object{job, gitea}...)
+
+			err := reconcileGiteaBootstrap(&DBSecret{}, cr, r)
+			if tt.giteaReady {
+				if _, ok := err.(*requeueError); !ok {
+					t.Errorf("reconcileGiteaBootstrap() = %v, want a requeueError", err)
+				}
+			} else if _, ok := err.(*jobFailedError); !ok {
+				t.Errorf("reconcileGiteaBootstrap() = %v, want a jobFailedError", err)
+			}
+
+			found := &batchv1.Job{}
+			getErr := r.Client.Get(context.TODO(), types.NamespacedName{Name: jobName, Namespace: cr.Namespace}, found)
+			if exists := getErr == nil; exists != tt.wantJob {
+				t.Errorf("job exists = %v, want %v", exists, tt.wantJob)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"net/url"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+// listRepos pages through every repository the signed in admin can see.
+func listRepos(gitClient *gitea.Client) ([]*gitea.Repository, error) {
+	const pageSize = 50
+
+	var repos []*gitea.Repository
+	seen := map[int64]bool{}
+	for page := 1; ; page++ {
+		batch, err := gitClient.SearchRepos(gitea.SearchRepoOptions{
+			ListOptions: gitea.ListOptions{Page: page, PageSize: pageSize},
+			Private:     true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		added := 0
+		for _, repo := range batch {
+			if !seen[repo.ID] {
+				seen[repo.ID] = true
+				repos = append(repos, repo)
+				added++
+			}
+		}
+		if added == 0 || len(batch) < pageSize {
+			return repos, nil
+		}
+	}
+}
+
+// deleteCIHooks removes the webhooks Drone adds to the repositories it
+// activates, and those Agola adds to its projects. Both point at the CI
+// hostname, the webhooks of anything else are kept.
+func deleteCIHooks(gitClient *gitea.Client, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+	if cr.Spec.CI.Hostname == "" {
+		return nil
+	}
+
+	repos, err := listRepos(gitClient)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if repo.Owner == nil {
+			continue
+		}
+		hooks, err := gitClient.ListRepoHooks(repo.Owner.UserName, repo.Name, gitea.ListHooksOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: 50}})
+		if err != nil {
+			return err
+		}
+		for _, hook := range hooks {
+			target, err := url.Parse(hook.Config["url"])
+			if err != nil || target.Hostname() != cr.Spec.CI.Hostname {
+				continue
+			}
+			logger.Info("Deleting CI webhook", "Repository", repo.FullName, "ID", hook.ID)
+			if err = gitClient.DeleteRepoHook(repo.Owner.UserName, repo.Name, hook.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+func TestDeleteCIHooks(t *testing.T) {
+	hooks := map[string][]*gitea.Hook{
+		"dev/app": {
+			{ID: 1, Config: map[string]string{"url": "https://ci.example.com/hook?secret=abc"}},
+			{ID: 2, Config: map[string]string{"url": "https://chat.example.com/gitea"}},
+		},
+		"ops/infra": {
+			{ID: 3, Config: map[string]string{"url": "https://ci.example.com/webhooks?projectid=1"}},
+		},
+		"dev/docs": {},
+	}
+	var mu sync.Mutex
+	deleted := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := strings.TrimPrefix(req.URL.Path, "/api/v1")
+		switch {
+		case path == "/version":
+			_ = json.NewEncoder(w).Encode(map[string]string{"version": "1.11.4"})
+		case path == "/repos/search":
+			if req.URL.Query().Get("private") != "true" {
+				t.Errorf("private repositories are left out")
+			}
+			repos := []*gitea.Repository{}
+			if req.URL.Query().Get("page") == "1" {
+				for _, name := range []string{"dev/app", "ops/infra", "dev/docs"} {
+					parts := strings.Split(name, "/")
+					repos = append(repos, &gitea.Repository{ID: int64(len(repos) + 1), Owner: &gitea.User{UserName: parts[0]}, Name: parts[1], FullName: name})
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": repos, "ok": true})
+		case strings.HasSuffix(path, "/hooks"):
+			_ = json.NewEncoder(w).Encode(hooks[strings.TrimSuffix(strings.TrimPrefix(path, "/repos/"), "/hooks")])
+		case req.Method == http.MethodDelete:
+			mu.Lock()
+			deleted = append(deleted, path)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	cr := testVCS()
+	cr.Spec.CI.Hostname = "ci.example.com"
+	if err := deleteCIHooks(gitea.NewClient(server.URL, ""), cr, testReconciler()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(deleted)
+	if want := []string{"/repos/dev/app/hooks/1", "/repos/ops/infra/hooks/3"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+}
@@ -0,0 +1,483 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// giteaBackupScript dumps Gitea next to the database dump taken by the
+// init container, and prunes all but the three most recent backups.
+const giteaBackupScript = `set -e
+
+DIR=/backup/${BACKUP}
+chown git:git ${DIR}
+su git -c "gitea dump --config /data/gitea/conf/app.ini --file ${DIR}/gitea-dump.zip"
+
+ls -1dt /backup/2*/ | tail -n +4 | xargs -r rm -rf
+`
+
+// giteaRestoreScript puts the repositories and the data directory of a
+// gitea dump back in place, the database is restored by the init container.
+// LFS objects are content addressed and left alone.
+const giteaRestoreScript = `set -e
+
+WORK=$(mktemp -d)
+cd ${WORK}
+unzip -q /backup/${BACKUP}/gitea-dump.zip
+
+rm -rf /data/git/repositories
+mkdir -p /data/git/repositories
+unzip -q gitea-repo.zip -d /data/git/repositories
+
+# conf/app.ini is mounted from the Gitea secret
+find /data/gitea -mindepth 1 -maxdepth 1 ! -name conf -exec rm -rf {} +
+cp -a data/. /data/gitea/
+chown -R git:git /data/git /data/gitea
+`
+
+const pgDumpScript = `mkdir -p /backup/${BACKUP} && pg_dump -Fc -f /backup/${BACKUP}/gitea.pgdump`
+
+const pgRestoreScript = `set -e
+psql -v ON_ERROR_STOP=1 -c 'DROP SCHEMA public CASCADE; CREATE SCHEMA public;'
+pg_restore --no-owner --exit-on-error -d ${PGDATABASE} /backup/${BACKUP}/gitea.pgdump
+`
+
+// giteaVersion is the Gitea version asked for, spec.git.version wins over
+// the image tag.
+func giteaVersion(cr *gitifold.VCS) string {
+	if cr.Spec.Git.Version != "" {
+		return cr.Spec.Git.Version
+	}
+	if cr.Spec.Git.Image.Tag != "" {
+		return cr.Spec.Git.Image.Tag
+	}
+	return defaultImages["gitea"].Tag
+}
+
+func giteaImage(version string, cr *gitifold.VCS) (string, corev1.PullPolicy) {
+	image := cr.Spec.Git.Image
+	image.Tag = version
+	return containerImage("gitea", image, cr)
+}
+
+func giteaBackupClaimName(cr *gitifold.VCS) string {
+	name, _ := giteaLabels(cr)
+	return strings.Join([]string{name, "backup"}, "-")
+}
+
+func giteaUpgradeLabels(step string, upgrade *gitifold.UpgradeStatus, cr *gitifold.VCS) (string, map[string]string) {
+	name, labels := giteaLabels(cr)
+	upgradeLabels := make(map[string]string, len(labels))
+	for key, value := range labels {
+		upgradeLabels[key] = value
+	}
+	// must not match the Gitea Service selector
+	upgradeLabels["app"] = "gitea-upgrade"
+
+	return strings.Join([]string{name, step, upgrade.Backup}, "-"), upgradeLabels
+}
+
+// reconcileGiteaUpgrade moves a Gitea upgrade along one step at a time, the
+// phase is saved before acting on it. It returns the version Gitea should
+// run, and whether it has to be scaled down meanwhile.
+func reconcileGiteaUpgrade(dbSecret *DBSecret, cr *gitifold.VCS, r *VCSReconciler) (string, bool, error) {
+	desired := giteaVersion(cr)
+	git := &cr.Status.Git
+
+	if git.Version == "" {
+		version, err := deployedGiteaVersion(cr, r)
+		if err != nil {
+			return "", false, err
+		}
+		if version == "" {
+			// fresh install, there is nothing to upgrade
+			version = desired
+		}
+		git.Version = version
+		if err = r.Client.Status().Update(context.TODO(), cr); err != nil {
+			return "", false, err
+		}
+	}
+
+	upgrade := git.Upgrade
+	if upgrade == nil || upgrade.Phase == gitifold.UpgradeSucceeded || upgrade.Phase == gitifold.UpgradeFailed {
+		if desired == git.Version || (upgrade != nil && upgrade.Phase == gitifold.UpgradeFailed && upgrade.ToVersion == desired) {
+			return git.Version, false, nil
+		}
+		return git.Version, true, startGiteaUpgrade(desired, cr, r)
+	}
+
+	if err := reconcilePVC(cr, r, newGiteaBackupPVCCr(cr)); err != nil {
+		return "", false, err
+	}
+
+	switch upgrade.Phase {
+	case gitifold.UpgradeBackingUp:
+		if err := waitGiteaScaledDown(cr, r); err != nil {
+			return upgrade.FromVersion, true, err
+		}
+		err := runJob(newGiteaBackupJobCr(upgrade, dbSecret, cr), cr, r)
+		if failed, ok := err.(*jobFailedError); ok {
+			// nothing was changed yet, Gitea comes back on the old version
+			return upgrade.FromVersion, false, setUpgradePhase(gitifold.UpgradeFailed, "backup failed: "+failed.message, cr, r)
+		}
+		if err != nil {
+			return upgrade.FromVersion, true, err
+		}
+		return upgrade.FromVersion, true, setUpgradePhase(gitifold.UpgradeMigrating, "backup "+upgrade.Backup+" taken", cr, r)
+
+	case gitifold.UpgradeMigrating:
+		err := runJob(newGiteaMigrateJobCr(upgrade, dbSecret, cr), cr, r)
+		if failed, ok := err.(*jobFailedError); ok {
+			return upgrade.FromVersion, true, setUpgradePhase(gitifold.UpgradeRollingBack, "migration failed: "+failed.message, cr, r)
+		}
+		if err != nil {
+			return upgrade.FromVersion, true, err
+		}
+		return upgrade.ToVersion, false, setUpgradePhase(gitifold.UpgradeRollingOut, "migrations applied", cr, r)
+
+	case gitifold.UpgradeRollingOut:
+		healthy, message, err := giteaRolledOut(upgrade.ToVersion, cr, r)
+		if err != nil {
+			return upgrade.ToVersion, false, err
+		}
+		if message != "" {
+			return upgrade.FromVersion, true, setUpgradePhase(gitifold.UpgradeRollingBack, "health check failed: "+message, cr, r)
+		}
+		if !healthy {
+			return upgrade.ToVersion, false, &requeueError{reason: "waiting for gitea " + upgrade.ToVersion + " to become healthy", after: 15 * time.Second}
+		}
+		git.Version = upgrade.ToVersion
+		return upgrade.ToVersion, false, setUpgradePhase(gitifold.UpgradeSucceeded, "", cr, r)
+
+	case gitifold.UpgradeRollingBack:
+		if err := waitGiteaScaledDown(cr, r); err != nil {
+			return upgrade.FromVersion, true, err
+		}
+		err := runJob(newGiteaRestoreJobCr(upgrade, dbSecret, cr), cr, r)
+		if failed, ok := err.(*jobFailedError); ok {
+			message := fmt.Sprintf("restoring backup %s failed: %s, restore it by hand and set the version back to %s", upgrade.Backup, failed.message, upgrade.FromVersion)
+			return upgrade.FromVersion, true, setUpgradePhase(gitifold.UpgradeRollbackFailed, message, cr, r)
+		}
+		if err != nil {
+			return upgrade.FromVersion, true, err
+		}
+		return upgrade.FromVersion, false, setUpgradePhase(gitifold.UpgradeFailed, "rolled back, "+upgrade.Message, cr, r)
+
+	case gitifold.UpgradeRollbackFailed:
+		if desired != upgrade.FromVersion {
+			return upgrade.FromVersion, true, nil
+		}
+		return upgrade.FromVersion, false, setUpgradePhase(gitifold.UpgradeFailed, "restored by hand", cr, r)
+	}
+
+	return git.Version, false, nil
+}
+
+// startGiteaUpgrade records a new upgrade to version, and removes the Jobs
+// left behind by the previous one.
+func startGiteaUpgrade(version string, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	if previous := cr.Status.Git.Upgrade; previous != nil {
+		for _, step := range []string{"backup", "migrate", "restore"} {
+			name, _ := giteaUpgradeLabels(step, previous, cr)
+			if err := deleteObject("Job", cr, r, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cr.Namespace}}); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := metav1.Now()
+	cr.Status.Git.Upgrade = &gitifold.UpgradeStatus{
+		Phase:       gitifold.UpgradeBackingUp,
+		FromVersion: cr.Status.Git.Version,
+		ToVersion:   version,
+		Backup:      now.UTC().Format("20060102-150405"),
+		Message:     "scaling gitea down",
+		StartTime:   &now,
+	}
+	if err := r.Client.Status().Update(context.TODO(), cr); err != nil {
+		return err
+	}
+	logger.Info("Upgrading Gitea", "From", cr.Status.Git.Upgrade.FromVersion, "To", version)
+	return &requeueError{reason: "gitea upgrade started", after: 5 * time.Second}
+}
+
+// setUpgradePhase saves the next phase of the upgrade, and asks for the
+// reconcile to be retried unless the upgrade is over.
+func setUpgradePhase(phase gitifold.UpgradePhase, message string, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	upgrade := cr.Status.Git.Upgrade
+	upgrade.Phase = phase
+	upgrade.Message = message
+	if phase == gitifold.UpgradeSucceeded || phase == gitifold.UpgradeFailed || phase == gitifold.UpgradeRollbackFailed {
+		now := metav1.Now()
+		upgrade.CompletionTime = &now
+	}
+	if err := r.Client.Status().Update(context.TODO(), cr); err != nil {
+		return err
+	}
+	logger.Info("Gitea upgrade "+string(phase), "From", upgrade.FromVersion, "To", upgrade.ToVersion, "Message", message)
+
+	if phase == gitifold.UpgradeSucceeded || phase == gitifold.UpgradeFailed {
+		return nil
+	}
+	return &requeueError{reason: "gitea upgrade " + string(phase), after: 5 * time.Second}
+}
+
+// upgradeInProgress is true while the steps of an upgrade are running.
+func upgradeInProgress(cr *gitifold.VCS) bool {
+	upgrade := cr.Status.Git.Upgrade
+	if upgrade == nil {
+		return false
+	}
+	switch upgrade.Phase {
+	case gitifold.UpgradeSucceeded, gitifold.UpgradeFailed, gitifold.UpgradeRollbackFailed:
+		return false
+	}
+	return true
+}
+
+// deployedGiteaVersion reads the version off a Gitea Deployment created
+// before versions were recorded in the status.
+func deployedGiteaVersion(cr *gitifold.VCS, r *VCSReconciler) (string, error) {
+	name, _ := giteaLabels(cr)
+	dep := &appsv1.Deployment{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, dep)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, container := range dep.Spec.Template.Spec.Containers {
+		if container.Name == "gitea" {
+			return container.Image[strings.LastIndex(container.Image, ":")+1:], nil
+		}
+	}
+	return "", nil
+}
+
+func waitGiteaScaledDown(cr *gitifold.VCS, r *VCSReconciler) error {
+	name, _ := giteaLabels(cr)
+	dep := &appsv1.Deployment{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, dep)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if dep.Spec.Replicas != nil && *dep.Spec.Replicas == 0 && dep.Status.ObservedGeneration >= dep.Generation && dep.Status.Replicas == 0 {
+		return nil
+	}
+	return &requeueError{reason: "waiting for gitea to scale down", after: 5 * time.Second}
+}
+
+// giteaRolledOut reports whether version is up and available, or why the
+// rollout failed.
+func giteaRolledOut(version string, cr *gitifold.VCS, r *VCSReconciler) (bool, string, error) {
+	name, _ := giteaLabels(cr)
+	image, _ := giteaImage(version, cr)
+
+	dep := &appsv1.Deployment{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, dep)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	if dep.Status.ObservedGeneration < dep.Generation || len(dep.Spec.Template.Spec.Containers) == 0 ||
+		dep.Spec.Template.Spec.Containers[0].Image != image {
+		return false, "", nil
+	}
+	for _, c := range dep.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Status == corev1.ConditionFalse {
+			return false, c.Message, nil
+		}
+	}
+	return dep.Status.UpdatedReplicas > 0 && dep.Status.AvailableReplicas > 0 && dep.Status.Replicas == dep.Status.UpdatedReplicas, "", nil
+}
+
+func newGiteaBackupPVCCr(cr *gitifold.VCS) *corev1.PersistentVolumeClaim {
+	_, labels := giteaLabels(cr)
+
+	return &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      giteaBackupClaimName(cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: claimSpec(cr.Spec.Git.BackupStorage, "5Gi"),
+	}
+}
+
+func newGiteaBackupJobCr(upgrade *gitifold.UpgradeStatus, dbSecret *DBSecret, cr *gitifold.VCS) *batchv1.Job {
+	pgImage, pgPullPolicy := pgContainerImage(pgInstance("gitea", cr), cr)
+	job := newGiteaUpgradeJobCr("backup", upgrade, upgrade.FromVersion, giteaBackupScript, cr)
+	job.Spec.Template.Spec.InitContainers = []corev1.Container{
+		newGiteaUpgradePgContainer("pg-dump", pgImage, pgPullPolicy, pgDumpScript, upgrade, cr),
+	}
+	mountDatabaseCA(dbSecret, &job.Spec.Template.Spec)
+	return job
+}
+
+func newGiteaMigrateJobCr(upgrade *gitifold.UpgradeStatus, dbSecret *DBSecret, cr *gitifold.VCS) *batchv1.Job {
+	script := `su git -c "gitea migrate --config /data/gitea/conf/app.ini"`
+	job := newGiteaUpgradeJobCr("migrate", upgrade, upgrade.ToVersion, script, cr)
+	mountDatabaseCA(dbSecret, &job.Spec.Template.Spec)
+	return job
+}
+
+func newGiteaRestoreJobCr(upgrade *gitifold.UpgradeStatus, dbSecret *DBSecret, cr *gitifold.VCS) *batchv1.Job {
+	pgImage, pgPullPolicy := pgContainerImage(pgInstance("gitea", cr), cr)
+	job := newGiteaUpgradeJobCr("restore", upgrade, upgrade.FromVersion, giteaRestoreScript, cr)
+	job.Spec.Template.Spec.InitContainers = []corev1.Container{
+		newGiteaUpgradePgContainer("pg-restore", pgImage, pgPullPolicy, pgRestoreScript, upgrade, cr),
+	}
+	mountDatabaseCA(dbSecret, &job.Spec.Template.Spec)
+	return job
+}
+
+// newGiteaUpgradePgContainer runs script against the Gitea database with
+// the libpq environment set up.
+func newGiteaUpgradePgContainer(name, image string, pullPolicy corev1.PullPolicy, script string, upgrade *gitifold.UpgradeStatus, cr *gitifold.VCS) corev1.Container {
+	pgName, _ := pgLabelNames("gitea", cr)
+	env := append([]corev1.EnvVar{
+		{
+			Name:  "BACKUP",
+			Value: upgrade.Backup,
+		},
+	}, pgClientEnv(pgName)...)
+
+	return corev1.Container{
+		Name:            name,
+		Image:           image,
+		ImagePullPolicy: pullPolicy,
+		Command:         []string{"/bin/sh", "-c", script},
+		Env:             env,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "backup",
+				MountPath: "/backup",
+			},
+		},
+	}
+}
+
+// newGiteaUpgradeJobCr runs script in the given Gitea version, with the
+// Gitea volume, its configuration and the backup volume mounted.
+func newGiteaUpgradeJobCr(step string, upgrade *gitifold.UpgradeStatus, version, script string, cr *gitifold.VCS) *batchv1.Job {
+	name, labels := giteaUpgradeLabels(step, upgrade, cr)
+	giteaName, _ := giteaLabels(cr)
+	image, pullPolicy := giteaImage(version, cr)
+
+	backoffLimit := int32(2)
+	fal := false
+
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+					AutomountServiceAccountToken: &fal,
+					RestartPolicy:                corev1.RestartPolicyNever,
+					Volumes: []corev1.Volume{
+						{
+							Name: "git",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: giteaName,
+								},
+							},
+						},
+						{
+							Name: "backup",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: giteaBackupClaimName(cr),
+								},
+							},
+						},
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: giteaName,
+									Items: []corev1.KeyToPath{
+										{
+											Key:  "app.ini",
+											Path: "app.ini",
+										},
+									},
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:            step,
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Command:         []string{"/bin/sh", "-c", script},
+							Env: []corev1.EnvVar{
+								{
+									Name:  "BACKUP",
+									Value: upgrade.Backup,
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "git",
+									MountPath: "/data",
+								},
+								{
+									Name:      "config",
+									MountPath: "/data/gitea/conf/app.ini",
+									SubPath:   "app.ini",
+								},
+								{
+									Name:      "backup",
+									MountPath: "/backup",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	schedulePod(cr.Spec.Git.WorkloadSpec, &job.Spec.Template.Spec)
+	return job
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"strings"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultImages is the version manifest, the images deployed unless a VCS
+// overrides them.
+var defaultImages = map[string]gitifold.ImageSpec{
+	"gitea":             {Repository: "gitea/gitea", Tag: "1.11.4"},
+	"keydb":             {Repository: "eqalpha/keydb", Tag: "v5.3.3"},
+	"postgres":          {Repository: "postgres", Tag: "12.2-alpine"},
+	"postgres-exporter": {Repository: "wrouesnel/postgres_exporter", Tag: "v0.8.0"},
+	"pgbouncer":         {Repository: "edoburu/pgbouncer", Tag: "1.15.0"},
+	"drone":             {Repository: "drone/drone", Tag: "1.6.5"},
+	"drone-runner":      {Repository: "drone/drone-runner-kube", Tag: "1.0.0-beta.1"},
+	"agola":             {Repository: "sorintlab/agola", Tag: "v0.5.0"},
+	"etcd":              {Repository: "quay.io/coreos/etcd", Tag: "v3.4.7"},
+	"clair":             {Repository: "coreos/clair", Tag: "v2.12"},
+	"registry":          {Repository: "registry", Tag: "2.7.1"},
+	"mc":                {Repository: "minio/mc", Tag: "RELEASE.2020-04-25T00-43-23Z"},
+}
+
+// containerImage resolves the image reference and pull policy of one of the
+// manifest images, applying the overrides and the VCS image registry.
+func containerImage(name string, override gitifold.ImageSpec, cr *gitifold.VCS) (string, corev1.PullPolicy) {
+	image := defaultImages[name]
+	if override.Repository != "" {
+		image.Repository = override.Repository
+	}
+	if override.Tag != "" {
+		image.Tag = override.Tag
+	}
+	if override.PullPolicy != "" {
+		image.PullPolicy = override.PullPolicy
+	}
+
+	repository := image.Repository
+	if cr.Spec.ImageRegistry != "" {
+		repository = strings.Join([]string{strings.TrimSuffix(cr.Spec.ImageRegistry, "/"), imagePath(repository)}, "/")
+	}
+	return strings.Join([]string{repository, image.Tag}, ":"), image.PullPolicy
+}
+
+// imagePath strips the registry host off a repository, the way Docker
+// tells one apart from the first path segment.
+func imagePath(repository string) string {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[1]
+	}
+	return repository
+}
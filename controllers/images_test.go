@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestImagePath(t *testing.T) {
+	tests := []struct {
+		repository string
+		want       string
+	}{
+		{repository: "registry", want: "registry"},
+		{repository: "gitea/gitea", want: "gitea/gitea"},
+		{repository: "quay.io/coreos/etcd", want: "coreos/etcd"},
+		{repository: "localhost/gitea", want: "gitea"},
+		{repository: "mirror:5000/gitea/gitea", want: "gitea/gitea"},
+		{repository: "library/postgres", want: "library/postgres"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repository, func(t *testing.T) {
+			if got := imagePath(tt.repository); got != tt.want {
+				t.Errorf("imagePath(%q) = %q, want %q", tt.repository, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerImage(t *testing.T) {
+	tests := []struct {
+		name           string
+		image          string
+		override       gitifold.ImageSpec
+		registry       string
+		want           string
+		wantPullPolicy corev1.PullPolicy
+	}{
+		{name: "default", image: "gitea", want: "gitea/gitea:1.11.4"},
+		{name: "tag", image: "gitea", override: gitifold.ImageSpec{Tag: "1.12.0"}, want: "gitea/gitea:1.12.0"},
+		{name: "repository", image: "gitea", override: gitifold.ImageSpec{Repository: "example/gitea"}, want: "example/gitea:1.11.4"},
+		{name: "pull policy", image: "gitea", override: gitifold.ImageSpec{PullPolicy: corev1.PullAlways}, want: "gitea/gitea:1.11.4", wantPullPolicy: corev1.PullAlways},
+		{name: "registry", image: "gitea", registry: "mirror.example.com/", want: "mirror.example.com/gitea/gitea:1.11.4"},
+		{name: "registry over host", image: "etcd", registry: "mirror.example.com", want: "mirror.example.com/coreos/etcd:v3.4.7"},
+		{name: "registry and repository", image: "gitea", override: gitifold.ImageSpec{Repository: "ghcr.io/example/gitea"}, registry: "mirror.example.com", want: "mirror.example.com/example/gitea:1.11.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			cr.Spec.ImageRegistry = tt.registry
+			got, pullPolicy := containerImage(tt.image, tt.override, cr)
+			if got != tt.want {
+				t.Errorf("containerImage() image = %q, want %q", got, tt.want)
+			}
+			if pullPolicy != tt.wantPullPolicy {
+				t.Errorf("containerImage() pull policy = %q, want %q", pullPolicy, tt.wantPullPolicy)
+			}
+		})
+	}
+}
+
+func TestReconcileDeploymentImages(t *testing.T) {
+	secrets := func(names ...string) []corev1.LocalObjectReference {
+		refs := []corev1.LocalObjectReference{}
+		for _, name := range names {
+			refs = append(refs, corev1.LocalObjectReference{Name: name})
+		}
+		return refs
+	}
+	tests := []struct {
+		name            string
+		registry        string
+		pullSecrets     []corev1.LocalObjectReference
+		wantImage       string
+		wantPullSecrets []corev1.LocalObjectReference
+	}{
+		{name: "unchanged", wantImage: "registry:2.7.1", wantPullSecrets: secrets("hub")},
+		{name: "registry set", registry: "mirror.example.com", pullSecrets: secrets("hub"), wantImage: "mirror.example.com/registry:2.7.1", wantPullSecrets: secrets("hub")},
+		{name: "pull secret added", pullSecrets: secrets("hub", "mirror"), wantImage: "registry:2.7.1", wantPullSecrets: secrets("hub", "mirror")},
+		{name: "pull secret removed", pullSecrets: secrets(), wantImage: "registry:2.7.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			cr.Spec.ImagePullSecrets = secrets("hub")
+			r := testReconciler()
+			if err := reconcileDeployment(cr, r, newRegistryDeploymentCr(cr)); err != nil {
+				t.Fatal(err)
+			}
+
+			cr.Spec.ImageRegistry = tt.registry
+			if tt.pullSecrets != nil {
+				cr.Spec.ImagePullSecrets = tt.pullSecrets
+			}
+			desired := newRegistryDeploymentCr(cr)
+			if err := reconcileDeployment(cr, r, desired); err != nil {
+				t.Fatal(err)
+			}
+
+			dep := &appsv1.Deployment{}
+			if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: desired.Name, Namespace: cr.Namespace}, dep); err != nil {
+				t.Fatal(err)
+			}
+			if got := dep.Spec.Template.Spec.Containers[0].Image; got != tt.wantImage {
+				t.Errorf("image = %q, want %q", got, tt.wantImage)
+			}
+			if got := dep.Spec.Template.Spec.ImagePullSecrets; len(got) != len(tt.wantPullSecrets) || (len(got) > 0 && !reflect.DeepEqual(got, tt.wantPullSecrets)) {
+				t.Errorf("pull secrets = %v, want %v", got, tt.wantPullSecrets)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -12,9 +13,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func keydbLabelNames(component string, cr *gitifold.VCS) (string, map[string]string) {
@@ -30,41 +29,178 @@ func keydbLabelNames(component string, cr *gitifold.VCS) (string, map[string]str
 	return name, labels
 }
 
-func createKeyDBService(component string, cr *gitifold.VCS, r *VCSReconciler) error {
-	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
-	svc := newKeyDBServiceCr(component, cr)
-	if err := controllerutil.SetControllerReference(cr, svc, r.Scheme); err != nil {
+func keydbSpec(component string, cr *gitifold.VCS) gitifold.KeyDBSpec {
+	if component == "gitea" {
+		return cr.Spec.Git.KeyDB
+	}
+	return gitifold.KeyDBSpec{}
+}
+
+// KeyDBSecret is how a component reaches its KeyDB.
+type KeyDBSecret struct {
+	Host string
+	Port string
+	Pass string
+}
+
+// createKeyDBService deploys the KeyDB of a component behind a generated
+// password, on a volume when persistence is asked for.
+func createKeyDBService(component string, cr *gitifold.VCS, r *VCSReconciler) (*KeyDBSecret, error) {
+	name, _ := keydbLabelNames(component, cr)
+	found, err := lookupSecret(name, cr, r)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newKeyDBSecretCr(component, cr, found)
+	if err != nil {
+		return nil, err
+	}
+	if err = reconcileSecret(cr, r, secret); err != nil {
+		return nil, err
+	}
+	if err = reconcileService(cr, r, newKeyDBServiceCr(component, cr)); err != nil {
+		return nil, err
+	}
+	configHash := hashData(secret.Data)
+	if keydbSpec(component, cr).Replicas > 1 {
+		if err = reconcileKeyDBHA(component, configHash, cr, r); err != nil {
+			return nil, err
+		}
+	} else if err = createKeyDBDeployment(component, configHash, cr, r); err != nil {
+		return nil, err
+	}
+
+	return &KeyDBSecret{
+		Host: strings.Join([]string{name, cr.Namespace, "svc"}, "."),
+		Port: "6379",
+		Pass: string(secret.Data["password"]),
+	}, nil
+}
+
+// createKeyDBDeployment runs a single KeyDB pod, in place of the active
+// replicas.
+func createKeyDBDeployment(component, configHash string, cr *gitifold.VCS, r *VCSReconciler) error {
+	name, _ := keydbLabelNames(component, cr)
+	dep, err := newKeyDBDeploymentCr(component, cr)
+	if err != nil {
 		return err
 	}
-	foundSvc := &corev1.Service{}
-	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, foundSvc)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new KeyDB Service")
-		err = r.Client.Create(context.TODO(), svc)
-		if err != nil {
+	if keydbSpec(component, cr).Persistence != nil {
+		if err := reconcilePVC(cr, r, newKeyDBPVCCr(component, cr)); err != nil {
 			return err
 		}
 	}
-	logger.Info("Skip reconcile: KeyDB service already exists")
 
-	sts := newKeyDBDeploymentCr(component, cr)
-	if err := controllerutil.SetControllerReference(cr, sts, r.Scheme); err != nil {
+	dep.Spec.Template.Annotations = map[string]string{
+		configHashAnnotation: configHash,
+	}
+	if err := reconcileDeployment(cr, r, dep); err != nil {
+		return err
+	}
+	if err := deleteObjects(keydbHAObjects(component, cr), cr, r); err != nil {
+		return err
+	}
+	claims := []string{}
+	if keydbSpec(component, cr).Persistence != nil {
+		claims = append(claims, name)
+	}
+	return deleteKeyDBClaims(component, claims, cr, r)
+}
+
+// deleteKeyDBClaims deletes the KeyDB claims other than those in use, left
+// behind by turning persistence off, switching between a single pod and
+// active replicas, or scaling down. They outlive it under the Retain and
+// Snapshot policies, like the other volumes.
+func deleteKeyDBClaims(component string, inUse []string, cr *gitifold.VCS, r *VCSReconciler) error {
+	if retentionPolicy(cr) != gitifold.RetentionDelete {
+		return nil
+	}
+	_, labels := keydbLabelNames(component, cr)
+	claims := &corev1.PersistentVolumeClaimList{}
+	if err := r.Client.List(context.TODO(), claims, client.InNamespace(cr.Namespace), client.MatchingLabels(labels)); err != nil {
 		return err
 	}
-	found := &appsv1.Deployment{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: sts.Name, Namespace: sts.Namespace}, found)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Redis Deployment")
-		err = r.Client.Create(context.TODO(), sts)
-		if err != nil {
+	for i := range claims.Items {
+		if containsString(inUse, claims.Items[i].Name) {
+			continue
+		}
+		if err := deleteObject("PersistentVolumeClaim", cr, r, &claims.Items[i]); err != nil {
 			return err
 		}
 	}
-	logger.Info("Skip reconcile: KeyDB Deployment already exists")
-
 	return nil
 }
 
+func newKeyDBSecretCr(component string, cr *gitifold.VCS, found *corev1.Secret) (*corev1.Secret, error) {
+	name, labels := keydbLabelNames(component, cr)
+	pass, err := secretValue(found, "password", func() (string, error) {
+		return GenerateRandomASCIIString(32)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Data: map[string][]byte{
+			"password": []byte(pass),
+		},
+	}, nil
+}
+
+func newKeyDBPVCCr(component string, cr *gitifold.VCS) *corev1.PersistentVolumeClaim {
+	name, labels := keydbLabelNames(component, cr)
+
+	return &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: claimSpec(keydbSpec(component, cr).Persistence.Storage, "1Gi"),
+	}
+}
+
+// keydbArgs start KeyDB with the password from the environment, and the
+// persistence asked for. Active replicas sign in to each other with it.
+func keydbArgs(component string, cr *gitifold.VCS) ([]string, error) {
+	args := []string{"keydb-server", "/etc/keydb/keydb.conf", "--requirepass", "$(KEYDB_PASSWORD)"}
+	if keydbSpec(component, cr).Replicas > 1 {
+		args = append(args, "--masterauth", "$(KEYDB_PASSWORD)", "--active-replica", "yes", "--multi-master", "yes")
+	}
+	persistence := keydbSpec(component, cr).Persistence
+	if persistence == nil {
+		return append(args, "--save", "", "--appendonly", "no"), nil
+	}
+	args = append(args, "--dir", "/data")
+	snapshots := []string{"--save", "900", "1", "--save", "300", "10", "--save", "60", "10000"}
+	switch persistence.Mode {
+	case "", "rdb":
+		args = append(args, snapshots...)
+		return append(args, "--appendonly", "no"), nil
+	case "aof":
+		return append(args, "--save", "", "--appendonly", "yes"), nil
+	case "both":
+		args = append(args, snapshots...)
+		return append(args, "--appendonly", "yes"), nil
+	default:
+		return nil, fmt.Errorf("keydb persistence mode %s is not supported, use rdb, aof or both", persistence.Mode)
+	}
+}
+
 func newKeyDBServiceCr(component string, cr *gitifold.VCS) *corev1.Service {
 
 	name, labels := keydbLabelNames(component, cr)
@@ -95,9 +231,15 @@ func newKeyDBServiceCr(component string, cr *gitifold.VCS) *corev1.Service {
 	}
 }
 
-func newKeyDBDeploymentCr(component string, cr *gitifold.VCS) *appsv1.Deployment {
+func newKeyDBDeploymentCr(component string, cr *gitifold.VCS) (*appsv1.Deployment, error) {
 
 	name, labels := keydbLabelNames(component, cr)
+	image, pullPolicy := containerImage("keydb", keydbSpec(component, cr).Image, cr)
+
+	args, err := keydbArgs(component, cr)
+	if err != nil {
+		return nil, err
+	}
 
 	limitCpu, _ := resource.ParseQuantity("250m")
 	limitMemory, _ := resource.ParseQuantity("1024Mi")
@@ -106,7 +248,15 @@ func newKeyDBDeploymentCr(component string, cr *gitifold.VCS) *appsv1.Deployment
 
 	var rc int32
 	rc = 1
-	return &appsv1.Deployment{
+	passwordEnv := &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{
+				Name: name,
+			},
+			Key: "password",
+		},
+	}
+	dep := &appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Deployment",
 			APIVersion: "apps/v1",
@@ -126,11 +276,24 @@ func newKeyDBDeploymentCr(component string, cr *gitifold.VCS) *appsv1.Deployment
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
+					ImagePullSecrets: cr.Spec.ImagePullSecrets,
 					Containers: []corev1.Container{
 						{
 							Name:            "keydb",
-							Image:           "eqalpha/keydb:latest",
-							ImagePullPolicy: "Always",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Args:            args,
+							Env: []corev1.EnvVar{
+								{
+									Name:      "KEYDB_PASSWORD",
+									ValueFrom: passwordEnv,
+								},
+								{
+									// read by keydb-cli in the probes
+									Name:      "REDISCLI_AUTH",
+									ValueFrom: passwordEnv,
+								},
+							},
 							Ports: []corev1.ContainerPort{
 								{
 									Name:          "redis",
@@ -144,7 +307,7 @@ func newKeyDBDeploymentCr(component string, cr *gitifold.VCS) *appsv1.Deployment
 										Command: []string{
 											"sh",
 											"-c",
-											"keydb-cli -h $(hostname) ping",
+											"keydb-cli -h $(hostname) ping | grep -q PONG",
 										},
 									},
 								},
@@ -157,14 +320,14 @@ func newKeyDBDeploymentCr(component string, cr *gitifold.VCS) *appsv1.Deployment
 										Command: []string{
 											"sh",
 											"-c",
-											"keydb-cli -h $(hostname) ping",
+											"keydb-cli -h $(hostname) ping | grep -q PONG",
 										},
 									},
 								},
 								InitialDelaySeconds: int32(5),
 								PeriodSeconds:       int32(6),
 							},
-							Resources: corev1.ResourceRequirements{
+							Resources: workloadResources(keydbSpec(component, cr).WorkloadSpec, corev1.ResourceRequirements{
 								Limits: corev1.ResourceList{
 									"cpu":    limitCpu,
 									"memory": limitMemory,
@@ -173,11 +336,33 @@ func newKeyDBDeploymentCr(component string, cr *gitifold.VCS) *appsv1.Deployment
 									"cpu":    requestCpu,
 									"memory": requestMemory,
 								},
-							},
+							}),
 						},
 					},
 				},
 			},
 		},
 	}
+	schedulePod(keydbSpec(component, cr).WorkloadSpec, &dep.Spec.Template.Spec)
+	if keydbSpec(component, cr).Persistence != nil {
+		// the volume can only be attached to one pod at a time
+		dep.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+		dep.Spec.Template.Spec.Volumes = []corev1.Volume{
+			{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: name,
+					},
+				},
+			},
+		}
+		dep.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      "data",
+				MountPath: "/data",
+			},
+		}
+	}
+	return dep, nil
 }
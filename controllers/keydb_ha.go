@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// keydbHAScript has every pod replicate from all of the others, through
+// the headless Service. The arguments are those of keydbArgs.
+const keydbHAScript = `set -e
+ORDINAL="${HOSTNAME##*-}"
+i=0
+while [ "${i}" -lt "${REPLICAS}" ] ; do
+	if [ "${i}" != "${ORDINAL}" ] ; then
+		set -- "$@" --replicaof "${NAME}-${i}.${PEERS}" 6379
+	fi
+	i=$((i + 1))
+done
+exec docker-entrypoint.sh "$@"
+`
+
+func keydbHeadlessName(component string, cr *gitifold.VCS) string {
+	name, _ := keydbLabelNames(component, cr)
+	return strings.Join([]string{name, "headless"}, "-")
+}
+
+// keydbHAObjects are the objects only deployed along with active replicas.
+func keydbHAObjects(component string, cr *gitifold.VCS) []managedObject {
+	name, _ := keydbLabelNames(component, cr)
+	return []managedObject{
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: keydbHeadlessName(component, cr)}},
+		&policyv1beta1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: name}},
+	}
+}
+
+// keydbClaimNames are the claims the KeyDB StatefulSet creates from its
+// volumeClaimTemplate, one per pod.
+func keydbClaimNames(component string, cr *gitifold.VCS) []string {
+	name, _ := keydbLabelNames(component, cr)
+	claims := []string{}
+	for ordinal := int32(0); ordinal < keydbSpec(component, cr).Replicas; ordinal++ {
+		claims = append(claims, fmt.Sprintf("data-%s-%d", name, ordinal))
+	}
+	return claims
+}
+
+// reconcileKeyDBHA runs KeyDB as active replicas, in place of the single
+// pod. The sessions are not carried over from it.
+func reconcileKeyDBHA(component, configHash string, cr *gitifold.VCS, r *VCSReconciler) error {
+	name, _ := keydbLabelNames(component, cr)
+	sts, err := newKeyDBStatefulSetCr(component, cr)
+	if err != nil {
+		return err
+	}
+	if err = reconcileService(cr, r, newKeyDBHeadlessServiceCr(component, cr)); err != nil {
+		return err
+	}
+
+	sts.Spec.Template.Annotations = map[string]string{
+		configHashAnnotation: configHash,
+	}
+	if err := reconcileStatefulSet(cr, r, sts); err != nil {
+		return err
+	}
+	claims := []string{}
+	if keydbSpec(component, cr).Persistence != nil {
+		claims = keydbClaimNames(component, cr)
+		// The volumeClaimTemplate only applies to new claims
+		for _, claim := range claims {
+			if err := expandClaim(claim, claimSize(keydbSpec(component, cr).Persistence.Storage, "1Gi"), cr, r); err != nil {
+				return err
+			}
+		}
+	}
+	if err := reconcilePDB(cr, r, newKeyDBPDBCr(component, cr)); err != nil {
+		return err
+	}
+
+	err = deleteObjects([]managedObject{
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name}},
+	}, cr, r)
+	if err != nil {
+		return err
+	}
+	return deleteKeyDBClaims(component, claims, cr, r)
+}
+
+// newKeyDBHeadlessServiceCr gives every pod a name to replicate from, known
+// before the pod is ready.
+func newKeyDBHeadlessServiceCr(component string, cr *gitifold.VCS) *corev1.Service {
+	_, labels := keydbLabelNames(component, cr)
+
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        keydbHeadlessName(component, cr),
+			Namespace:   cr.Namespace,
+			Labels:      labels,
+			Annotations: make(map[string]string),
+		},
+		Spec: corev1.ServiceSpec{
+			Selector:                 labels,
+			Type:                     "ClusterIP",
+			ClusterIP:                "None",
+			PublishNotReadyAddresses: true,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "redis",
+					Protocol:   "TCP",
+					Port:       6379,
+					TargetPort: intstr.FromString("redis"),
+				},
+			},
+		},
+	}
+}
+
+// newKeyDBStatefulSetCr runs the pod of newKeyDBDeploymentCr as active
+// replicas, each on a volume of its own with persistence.
+func newKeyDBStatefulSetCr(component string, cr *gitifold.VCS) (*appsv1.StatefulSet, error) {
+	name, labels := keydbLabelNames(component, cr)
+	spec := keydbSpec(component, cr)
+	rc := spec.Replicas
+
+	dep, err := newKeyDBDeploymentCr(component, cr)
+	if err != nil {
+		return nil, err
+	}
+	template := dep.Spec.Template
+	template.Spec.Volumes = nil
+	keydbHAPodSpec(component, &template.Spec, cr)
+
+	sts := &appsv1.StatefulSet{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "StatefulSet",
+			APIVersion: "apps/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &rc,
+			ServiceName: keydbHeadlessName(component, cr),
+			// the replicas only need their peers to resolve, not to be up
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: template,
+		},
+	}
+	if spec.Persistence != nil {
+		sts.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{
+			{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "PersistentVolumeClaim",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "data",
+					Namespace: cr.Namespace,
+					Labels:    labels,
+				},
+				Spec: claimSpec(spec.Persistence.Storage, "1Gi"),
+			},
+		}
+	}
+	return sts, nil
+}
+
+func newKeyDBPDBCr(component string, cr *gitifold.VCS) *policyv1beta1.PodDisruptionBudget {
+	name, labels := keydbLabelNames(component, cr)
+	maxUnavailable := intstr.FromInt(1)
+
+	return &policyv1beta1.PodDisruptionBudget{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "policy/v1beta1",
+			Kind:       "PodDisruptionBudget",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+		},
+	}
+}
+
+// keydbHAPodSpec starts the keydb container replicating from its peers, and
+// spreads the pods across nodes unless told otherwise.
+func keydbHAPodSpec(component string, pod *corev1.PodSpec, cr *gitifold.VCS) {
+	name, labels := keydbLabelNames(component, cr)
+
+	for i := range pod.Containers {
+		container := &pod.Containers[i]
+		if container.Name != "keydb" {
+			continue
+		}
+		// the arguments of keydbArgs follow $0
+		container.Command = []string{"/bin/sh", "-c", keydbHAScript, "--"}
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  "NAME",
+			Value: name,
+		}, corev1.EnvVar{
+			Name:  "PEERS",
+			Value: keydbHeadlessName(component, cr),
+		}, corev1.EnvVar{
+			Name:  "REPLICAS",
+			Value: fmt.Sprintf("%d", keydbSpec(component, cr).Replicas),
+		})
+	}
+
+	if pod.Affinity == nil {
+		pod.Affinity = &corev1.Affinity{
+			PodAntiAffinity: &corev1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+					{
+						Weight: 100,
+						PodAffinityTerm: corev1.PodAffinityTerm{
+							LabelSelector: &metav1.LabelSelector{
+								MatchLabels: labels,
+							},
+							TopologyKey: "kubernetes.io/hostname",
+						},
+					},
+				},
+			},
+		}
+	}
+}
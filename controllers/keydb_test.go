@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestKeyDBArgs(t *testing.T) {
+	const (
+		server      = "keydb-server /etc/keydb/keydb.conf --requirepass $(KEYDB_PASSWORD)"
+		replication = " --masterauth $(KEYDB_PASSWORD) --active-replica yes --multi-master yes"
+		snapshots   = " --save 900 1 --save 300 10 --save 60 10000"
+	)
+	tests := []struct {
+		name        string
+		replicas    int32
+		persistence *gitifold.KeyDBPersistenceSpec
+		want        string
+		wantErr     bool
+	}{
+		{name: "in memory", want: server + " --save  --appendonly no"},
+		{name: "default mode", persistence: &gitifold.KeyDBPersistenceSpec{}, want: server + " --dir /data" + snapshots + " --appendonly no"},
+		{name: "rdb", persistence: &gitifold.KeyDBPersistenceSpec{Mode: "rdb"}, want: server + " --dir /data" + snapshots + " --appendonly no"},
+		{name: "aof", persistence: &gitifold.KeyDBPersistenceSpec{Mode: "aof"}, want: server + " --dir /data --save  --appendonly yes"},
+		{name: "both", persistence: &gitifold.KeyDBPersistenceSpec{Mode: "both"}, want: server + " --dir /data" + snapshots + " --appendonly yes"},
+		{name: "unknown mode", persistence: &gitifold.KeyDBPersistenceSpec{Mode: "fsync"}, wantErr: true},
+		{name: "one replica", replicas: 1, want: server + " --save  --appendonly no"},
+		{name: "active replicas", replicas: 3, want: server + replication + " --save  --appendonly no"},
+		{name: "active replicas with aof", replicas: 2, persistence: &gitifold.KeyDBPersistenceSpec{Mode: "aof"}, want: server + replication + " --dir /data --save  --appendonly yes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			cr.Spec.Git.KeyDB.Replicas = tt.replicas
+			cr.Spec.Git.KeyDB.Persistence = tt.persistence
+			got, err := keydbArgs("gitea", cr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("keydbArgs() = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// an empty --save argument shows as two spaces
+			if want := strings.Split(tt.want, " "); !reflect.DeepEqual(got, want) {
+				t.Errorf("keydbArgs() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestKeyDBSwitch(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy gitifold.RetentionPolicy
+		// the claims left after switching to active replicas and back
+		wantHA     []string
+		wantSingle []string
+	}{
+		{
+			name:       "delete",
+			policy:     gitifold.RetentionDelete,
+			wantHA:     []string{"data-vcs-gitea-gitifold-keydb-0", "data-vcs-gitea-gitifold-keydb-1"},
+			wantSingle: []string{"vcs-gitea-gitifold-keydb"},
+		},
+		{
+			name:       "retain",
+			wantHA:     []string{"data-vcs-gitea-gitifold-keydb-0", "data-vcs-gitea-gitifold-keydb-1", "vcs-gitea-gitifold-keydb"},
+			wantSingle: []string{"data-vcs-gitea-gitifold-keydb-0", "data-vcs-gitea-gitifold-keydb-1", "vcs-gitea-gitifold-keydb"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			cr.Spec.RetentionPolicy = tt.policy
+			cr.Spec.Git.KeyDB.Persistence = &gitifold.KeyDBPersistenceSpec{}
+			r := testReconciler()
+			name, labels := keydbLabelNames("gitea", cr)
+			key := types.NamespacedName{Name: name, Namespace: cr.Namespace}
+
+			exists := func(obj runtime.Object) bool {
+				err := r.Client.Get(context.TODO(), key, obj)
+				if err != nil && !errors.IsNotFound(err) {
+					t.Fatal(err)
+				}
+				return err == nil
+			}
+			claims := func() []string {
+				list := &corev1.PersistentVolumeClaimList{}
+				if err := r.Client.List(context.TODO(), list); err != nil {
+					t.Fatal(err)
+				}
+				names := []string{}
+				for _, claim := range list.Items {
+					names = append(names, claim.Name)
+				}
+				sort.Strings(names)
+				return names
+			}
+
+			if _, err := createKeyDBService("gitea", cr, r); err != nil {
+				t.Fatal(err)
+			}
+			if !exists(&appsv1.Deployment{}) {
+				t.Fatal("the single pod is not deployed")
+			}
+
+			cr.Spec.Git.KeyDB.Replicas = 2
+			if _, err := createKeyDBService("gitea", cr, r); err != nil {
+				t.Fatal(err)
+			}
+			// created by the StatefulSet controller
+			for _, claim := range keydbClaimNames("gitea", cr) {
+				pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: claim, Namespace: cr.Namespace, Labels: labels}}
+				if err := r.Client.Create(context.TODO(), pvc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if exists(&appsv1.Deployment{}) || !exists(&appsv1.StatefulSet{}) {
+				t.Error("the single pod is not replaced by active replicas")
+			}
+			if _, err := createKeyDBService("gitea", cr, r); err != nil {
+				t.Fatal(err)
+			}
+			if got := claims(); !reflect.DeepEqual(got, tt.wantHA) {
+				t.Errorf("claims with active replicas = %v, want %v", got, tt.wantHA)
+			}
+
+			cr.Spec.Git.KeyDB.Replicas = 1
+			if _, err := createKeyDBService("gitea", cr, r); err != nil {
+				t.Fatal(err)
+			}
+			if !exists(&appsv1.Deployment{}) || exists(&appsv1.StatefulSet{}) || exists(&policyv1beta1.PodDisruptionBudget{}) {
+				t.Error("the active replicas are not replaced by the single pod")
+			}
+			if got := claims(); !reflect.DeepEqual(got, tt.wantSingle) {
+				t.Errorf("claims with a single pod = %v, want %v", got, tt.wantSingle)
+			}
+		})
+	}
+}
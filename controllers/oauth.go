@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"strconv"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+// oauthAppAnnotation records the ID of the Gitea OAuth2 application a CI
+// system logs in with on its secret, next to its client credentials.
+const oauthAppAnnotation = "gitifold.hyperspike.io/oauth2-application-id"
+
+// oauthClient describes a Gitea OAuth2 application and the secret its
+// credentials are kept in.
+type oauthClient struct {
+	name         string
+	secret       string
+	clientIDKey  string
+	secretKey    string
+	redirectURIs []string
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// listOauth2 pages through the OAuth2 applications of the signed in user.
+// Gitea before 1.12 ignores the page, so the listing stops once a page brings
+// nothing new.
+func listOauth2(gitClient *gitea.Client) ([]*gitea.Oauth2, error) {
+	const pageSize = 50
+
+	var apps []*gitea.Oauth2
+	seen := map[int64]bool{}
+	for page := 1; ; page++ {
+		batch, err := gitClient.ListOauth2(gitea.ListOauth2Option{ListOptions: gitea.ListOptions{Page: page, PageSize: pageSize}})
+		if err != nil {
+			return nil, err
+		}
+		added := 0
+		for _, app := range batch {
+			if !seen[app.ID] {
+				seen[app.ID] = true
+				apps = append(apps, app)
+				added++
+			}
+		}
+		if added == 0 || len(batch) < pageSize {
+			return apps, nil
+		}
+	}
+}
+
+// reconcileOAuthApp makes sure exactly one OAuth2 application named
+// client.name exists in Gitea, and that its redirect URIs are up to date.
+// The client secret is only handed out when an application is created, so an
+// application is reused only if client.secret still holds its credentials.
+// Gitea can not update an application, one whose redirect URIs drifted is
+// created again.
+func reconcileOAuthApp(gitClient *gitea.Client, client oauthClient, cr *gitifold.VCS, r *VCSReconciler) (*gitea.Oauth2, error) {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	found, err := lookupSecret(client.secret, cr, r)
+	if err != nil {
+		return nil, err
+	}
+	opt := gitea.CreateOauth2Option{
+		Name:         client.name,
+		RedirectURIs: client.redirectURIs,
+	}
+
+	apps, err := listOauth2(gitClient)
+	if err != nil {
+		return nil, err
+	}
+
+	var current *gitea.Oauth2
+	if found != nil {
+		if id, err := strconv.ParseInt(found.Annotations[oauthAppAnnotation], 10, 64); err == nil {
+			for _, app := range apps {
+				if app.ID == id && app.ClientID == string(found.Data[client.clientIDKey]) {
+					current = app
+				}
+			}
+		}
+	}
+
+	if current != nil && !sameStrings(current.RedirectURIs, opt.RedirectURIs) {
+		logger.Info("Replacing OAuth2 application with outdated redirect URIs", "Name", client.name, "ID", current.ID)
+		if err = gitClient.DeleteOauth2(current.ID); err != nil {
+			return nil, err
+		}
+		current = nil
+	}
+
+	// Applications left behind by earlier versions of the operator, which
+	// created a new one on every reconcile. Those made by hand under the same
+	// name point elsewhere and are kept.
+	for _, app := range apps {
+		if app.Name != client.name || !sameStrings(app.RedirectURIs, opt.RedirectURIs) || (current != nil && app.ID == current.ID) {
+			continue
+		}
+		logger.Info("Deleting orphaned OAuth2 application", "Name", app.Name, "ID", app.ID)
+		if err = gitClient.DeleteOauth2(app.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if current == nil {
+		logger.Info("Creating OAuth2 application in Gitea", "Name", client.name)
+		return gitClient.CreateOauth2(opt)
+	}
+
+	return &gitea.Oauth2{
+		ID:           current.ID,
+		Name:         current.Name,
+		ClientID:     current.ClientID,
+		ClientSecret: string(found.Data[client.secretKey]),
+		RedirectURIs: current.RedirectURIs,
+		Created:      current.Created,
+	}, nil
+}
+
+// deleteOAuthApp removes the application recorded on client.secret.
+func deleteOAuthApp(gitClient *gitea.Client, client oauthClient, cr *gitifold.VCS, r *VCSReconciler) error {
+	found, err := lookupSecret(client.secret, cr, r)
+	if err != nil || found == nil {
+		return err
+	}
+	id, err := strconv.ParseInt(found.Annotations[oauthAppAnnotation], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return gitClient.DeleteOauth2(id)
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+// oauth2Server serves total applications, paged like Gitea 1.12 or, when
+// ignorePage, always from the first one like earlier versions.
+func oauth2Server(total int, ignorePage bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/version":
+			_ = json.NewEncoder(w).Encode(map[string]string{"version": "1.12.0"})
+		case "/api/v1/user/applications/oauth2":
+			page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+			limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+			if ignorePage || page < 1 {
+				page = 1
+			}
+			apps := []*gitea.Oauth2{}
+			for id := (page-1)*limit + 1; id <= page*limit && id <= total; id++ {
+				apps = append(apps, &gitea.Oauth2{ID: int64(id), Name: "Drone"})
+			}
+			_ = json.NewEncoder(w).Encode(apps)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+}
+
+func TestListOauth2(t *testing.T) {
+	tests := []struct {
+		name       string
+		total      int
+		ignorePage bool
+		want       int
+	}{
+		{name: "none", total: 0, want: 0},
+		{name: "one page", total: 20, want: 20},
+		{name: "full pages", total: 100, want: 100},
+		{name: "several pages", total: 120, want: 120},
+		{name: "page ignored", total: 120, ignorePage: true, want: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := oauth2Server(tt.total, tt.ignorePage)
+			defer server.Close()
+
+			apps, err := listOauth2(gitea.NewClient(server.URL, ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(apps) != tt.want {
+				t.Errorf("listOauth2() returned %d applications, want %d", len(apps), tt.want)
+			}
+		})
+	}
+}
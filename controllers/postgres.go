@@ -6,25 +6,54 @@ import (
 	"encoding/base64"
 	"math/big"
 	"strings"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/util/intstr"
 
 	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
+// pgConfigDir is where the config ConfigMap of an instance is mounted.
+const pgConfigDir = "/etc/gitifold/config"
+
+// pgDataDir is the PGDATA of an instance.
+const pgDataDir = "/var/lib/postgresql/data"
+
+// pgHBA lets replicas and base backups stream from the server, otherwise it
+// matches the one written by the image. With TLS the remote connections
+// have to use it.
+func pgHBA(cr *gitifold.VCS) string {
+	remote := "host"
+	if pgTLSEnabled(cr) {
+		remote = "hostssl"
+	}
+	return `local all all trust
+host all all 127.0.0.1/32 trust
+host all all ::1/128 trust
+` + remote + ` all all all md5
+` + remote + ` replication all all md5
+`
+}
+
 type DBSecret struct {
-	Host string
-	Name string
-	Pass string
-	User string
+	Host    string
+	Name    string
+	Pass    string
+	User    string
+	Port    string
+	SSLMode string
+	// Secret holds the values above under the db_ keys, and ca.crt if CA
+	Secret string
+	CA     bool
 }
 
 func pgLabelNames(component string, cr *gitifold.VCS) (string, map[string]string) {
@@ -40,78 +69,291 @@ func pgLabelNames(component string, cr *gitifold.VCS) (string, map[string]string
 	return name, labels
 }
 
+// pgSpec returns the Postgres settings of the component owning the database.
+func pgSpec(component string, cr *gitifold.VCS) gitifold.PostgresSpec {
+	switch component {
+	case "gitea":
+		return cr.Spec.Git.Postgres
+	case "drone":
+		return cr.Spec.CI.Postgres
+	case "clair":
+		return cr.Spec.Clair.Postgres
+	case "shared":
+		spec := cr.Spec.SharedPostgres.PostgresSpec
+		spec.External = nil
+		spec.Backup = nil
+		return spec
+	}
+	return gitifold.PostgresSpec{}
+}
+
 func createPgService(component string, cr *gitifold.VCS, r *VCSReconciler) (*DBSecret, error) {
-	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+	dbSecret, err := createPgDatabase(component, cr, r)
+	if err != nil {
+		return nil, err
+	}
+	if err = reconcilePgBackup(component, dbSecret, cr, r); err != nil {
+		return nil, err
+	}
+	return pgPooledDatabase(component, dbSecret, cr), nil
+}
+
+// createPgDatabase sets up the database of a component, in a dedicated, the
+// shared or an external instance.
+func createPgDatabase(component string, cr *gitifold.VCS, r *VCSReconciler) (*DBSecret, error) {
+	if external := pgSpec(component, cr).External; external != nil {
+		return createExternalPgService(component, external, cr, r)
+	}
+	if cr.Spec.SharedPostgres.Enabled {
+		return createSharedPgDatabase(component, cr, r)
+	}
 
-	svc := newPgServiceCr(component, cr)
-	if err := controllerutil.SetControllerReference(cr, svc, r.Scheme); err != nil {
+	// left behind by a shared instance
+	provisionJob := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: pgProvisionJobName(component, cr), Namespace: cr.Namespace}}
+	if err := deleteObject("Job", cr, r, provisionJob); err != nil {
 		return nil, err
 	}
-	found := &corev1.Service{}
-	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, found)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Postgres Service")
-		err = r.Client.Create(context.TODO(), svc)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		logger.Info("Skip reconcile: Postgres service already exists")
+	return createPgInstance(component, cr, r)
+}
+
+// createPgInstance deploys a Postgres instance, and waits for it to accept
+// connections.
+func createPgInstance(component string, cr *gitifold.VCS, r *VCSReconciler) (*DBSecret, error) {
+	if err := validatePgParameters(component, cr); err != nil {
+		return nil, err
 	}
-	svc = newPgServiceHeadlessCr(component, cr)
-	if err := controllerutil.SetControllerReference(cr, svc, r.Scheme); err != nil {
+	if err := validatePgImage(component, cr); err != nil {
 		return nil, err
 	}
-	found = &corev1.Service{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, found)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Postgres Headless Service")
-		err = r.Client.Create(context.TODO(), svc)
-		if err != nil {
+	if err := reconcilePgUpgrade(component, cr, r); err != nil {
+		return nil, err
+	}
+	if err := reconcilePgHA(component, cr, r); err != nil {
+		return nil, err
+	}
+	live := &corev1.ConfigMap{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: pgConfigName(component, cr), Namespace: cr.Namespace}, live); err != nil {
+		if !errors.IsNotFound(err) {
 			return nil, err
 		}
-	} else {
-		logger.Info("Skip reconcile: Postgres Headless service already exists")
+		live = nil
+	}
+	if err := validatePgStandbyParameters(component, live, cr); err != nil {
+		return nil, err
+	}
+	config := newPgConfigMapCr(component, cr)
+	desired := config.Data
+	if err := reconcileObject("ConfigMap", cr, r, config, func() {
+		config.Data = desired
+	}); err != nil {
+		return nil, err
+	}
+	tlsHash, ca, err := reconcilePgTLS(component, cr, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := reconcileService(cr, r, newPgServiceCr(component, cr)); err != nil {
+		return nil, err
+	}
+	if err := reconcileService(cr, r, newPgServiceHeadlessCr(component, cr)); err != nil {
+		return nil, err
 	}
 
-	secret, dbSecrets := newPgSecretCr(component, cr)
-	if err := controllerutil.SetControllerReference(cr, svc, r.Scheme); err != nil {
+	name, _ := pgLabelNames(component, cr)
+	found, err := lookupSecret(name, cr, r)
+	if err != nil {
 		return nil, err
 	}
-	foundSc := &corev1.Secret{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, foundSc)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Postgres Secret")
-		err = r.Client.Create(context.TODO(), secret)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		logger.Info("Skip reconcile: Postgres Headless service already exists")
+	if err = rotatePgPassword(component, found, true, cr, r); err != nil {
+		return nil, err
+	}
+	secret, dbSecrets, err := newPgSecretCr(component, cr, found)
+	if err != nil {
+		return nil, err
+	}
+	securePgSecret(secret, dbSecrets, ca)
+	if err = reconcileSecret(cr, r, secret); err != nil {
+		return nil, err
 	}
 
+	// postgres reads the certificate copied at start, replicas authenticate
+	// with the password they were started with, and some parameters only
+	// apply at start
+	podConfig := map[string][]byte{}
+	if parameters := pgRestartParameters(component, cr); len(parameters) > 0 {
+		podConfig["parameters"] = parameters
+	}
+	if tlsHash != "" {
+		podConfig["tls"] = []byte(tlsHash)
+	}
+	if pgSpec(component, cr).Replicas > 0 {
+		podConfig["db_pass"] = secret.Data["db_pass"]
+	}
 	sts := newPgStatefulSetCr(component, cr)
-	if err = controllerutil.SetControllerReference(cr, sts, r.Scheme); err != nil {
+	if len(podConfig) > 0 {
+		sts.Spec.Template.Annotations = map[string]string{
+			configHashAnnotation: hashData(podConfig),
+		}
+	}
+	if err = replacePgStatefulSet(sts, cr, r); err != nil {
 		return nil, err
 	}
-	foundSts := &appsv1.StatefulSet{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: sts.Name, Namespace: sts.Namespace}, foundSts)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Postgres StatefulSet")
-		err = r.Client.Create(context.TODO(), sts)
-		if err != nil {
+	if err = reconcileStatefulSet(cr, r, sts); err != nil {
+		return nil, err
+	}
+	if err = reconcilePgPooler(component, secret, tlsHash, cr, r); err != nil {
+		return nil, err
+	}
+	// The volumeClaimTemplate only applies to new claims
+	for _, claim := range pgClaimNames(component, cr) {
+		if err = expandClaim(claim, claimSize(pgSpec(component, cr).Storage, "2Gi"), cr, r); err != nil {
 			return nil, err
 		}
-	} else {
-		logger.Info("Skip reconcile: Postgres StatefulSet already exists")
+	}
+	// a recovery does not need the instance up
+	if err = reconcilePgArchive(component, cr, r); err != nil {
+		return nil, err
+	}
+	if err = waitPgReady(component, cr, r); err != nil {
+		return nil, err
+	}
+	if err = completePgUpgrade(component, cr, r); err != nil {
+		return nil, err
 	}
 
 	return dbSecrets, nil
 }
 
+// removePgService deletes a postgres instance that is no longer needed, the
+// claim and the secret holding its password are only removed under the
+// Delete retention policy.
+func removePgService(component string, cr *gitifold.VCS, r *VCSReconciler) error {
+	name, _ := pgLabelNames(component, cr)
+	objects := append(pgInstanceObjects(component, cr), &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: pgProvisionJobName(component, cr)}})
+	objects = append(objects, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: pgRotateJobName(component, cr)}})
+	objects = append(objects, pgUpgradeJobs(component, cr)...)
+	objects = append(objects, pgHAObjects(component, cr)...)
+	objects = append(objects, &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: pgBackupName(component, cr)}})
+	objects = append(objects, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: pgTLSName(component, cr)}})
+	if retentionPolicy(cr) == gitifold.RetentionDelete {
+		objects = append(objects, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		claims := append(pgClaimNames(component, cr), pgPreviousClaimNames(component, cr)...)
+		for _, claim := range append(claims, pgUpgradeClaimName(component, cr)) {
+			objects = append(objects, &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: claim}})
+		}
+	}
+	return deleteObjects(objects, cr, r)
+}
+
+// pgClientEnv sets up libpq to connect to the database in secret.
+func pgClientEnv(secret string) []corev1.EnvVar {
+	env := []corev1.EnvVar{}
+	for _, key := range []struct{ env, key string }{
+		{"PGHOST", "db_host"},
+		{"PGPORT", "db_port"},
+		{"PGSSLMODE", "db_sslmode"},
+		{"PGUSER", "db_user"},
+		{"PGPASSWORD", "db_pass"},
+		{"PGDATABASE", "db_name"},
+	} {
+		env = append(env, corev1.EnvVar{
+			Name: key.env,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: secret,
+					},
+					Key: key.key,
+				},
+			},
+		})
+	}
+	return env
+}
+
+// pgInstanceObjects are the objects making up a Postgres instance, but for
+// its claims and secret. A recovered copy and the pooler go along with it.
+func pgInstanceObjects(component string, cr *gitifold.VCS) []managedObject {
+	name, _ := pgLabelNames(component, cr)
+	objects := []managedObject{
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: strings.Join([]string{name, "headless"}, "-")}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: pgConfigName(component, cr)}},
+	}
+	objects = append(objects, pgPoolerObjects(component, cr)...)
+	return append(objects, pgArchiveObjects(component, cr)...)
+}
+
+func pgConfigName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "config"}, "-")
+}
+
+// pgServerArgs are the arguments postgres is started with, nil leaves the
+// defaults of the image.
+func pgServerArgs(component string, cr *gitifold.VCS) []string {
+	spec := pgSpec(component, cr)
+	if spec.Replicas == 0 && spec.Archive == nil && !pgTLSEnabled(cr) && len(pgParameters(component, cr)) == 0 {
+		return nil
+	}
+	args := []string{"postgres"}
+	if len(pgParameters(component, cr)) > 0 {
+		args = append(args, "-c", "config_file="+pgConfigDir+"/postgresql.conf")
+	}
+	args = append(args, "-c", "hba_file="+pgConfigDir+"/pg_hba.conf")
+	if pgTLSEnabled(cr) {
+		args = append(args, pgTLSArgs()...)
+	}
+	if spec.Replicas > 0 {
+		args = append(args, "-c", "wal_log_hints=on", "-c", pgWALKeep(component, cr))
+	}
+	if spec.Archive != nil {
+		args = append(args, pgArchiveArgs(component, spec.Archive, cr)...)
+	}
+	return args
+}
+
+// waitPgReady holds off the components depending on postgres until it
+// accepts connections, with replicas until the primary does.
+func waitPgReady(component string, cr *gitifold.VCS, r *VCSReconciler) error {
+	name, _ := pgLabelNames(component, cr)
+	if pgSpec(component, cr).Replicas > 0 {
+		cm := &corev1.ConfigMap{}
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: pgHAName(component, cr), Namespace: cr.Namespace}, cm); err != nil {
+			return err
+		}
+		pod := &corev1.Pod{}
+		err := r.Client.Get(context.TODO(), types.NamespacedName{Name: cm.Data["primary"], Namespace: cr.Namespace}, pod)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if ready, _ := podReady(pod); err != nil || !ready {
+			return &requeueError{reason: strings.Join([]string{component, "postgres primary not ready yet"}, " "), after: 10 * time.Second}
+		}
+		return nil
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, sts); err != nil {
+		return err
+	}
+	if sts.Status.ReadyReplicas == 0 {
+		return &requeueError{reason: strings.Join([]string{component, "postgres not ready yet"}, " "), after: 10 * time.Second}
+	}
+	return nil
+}
+
 func newPgServiceCr(component string, cr *gitifold.VCS) *corev1.Service {
 
 	name, labels := pgLabelNames(component, cr)
+	// with replicas only the primary takes writes
+	selector := map[string]string{}
+	for key, value := range labels {
+		selector[key] = value
+	}
+	if pgSpec(component, cr).Replicas > 0 {
+		selector[pgRoleLabel] = "primary"
+	}
 
 	return &corev1.Service{
 		TypeMeta: metav1.TypeMeta{
@@ -125,7 +367,7 @@ func newPgServiceCr(component string, cr *gitifold.VCS) *corev1.Service {
 			Labels:      labels,
 		},
 		Spec: corev1.ServiceSpec{
-			Selector: labels,
+			Selector: selector,
 			Type:     "ClusterIP",
 			Ports: []corev1.ServicePort{
 				{
@@ -184,7 +426,7 @@ func GenerateRandomBase64String(length int) (string, error) {
 		// Make sure that the number/byte/letter is inside
 		// the range of printable ASCII characters (excluding space and DEL)
 		if (n >= 48 && n <= 57) || (n >= 65 && n <= 90) || (n >= 97 && n <= 122) {
-			result += string(n)
+			result += string(rune(n))
 		}
 	}
 }
@@ -202,54 +444,86 @@ func GenerateRandomASCIIString(length int) (string, error) {
 		// Make sure that the number/byte/letter is inside
 		// the range of printable ASCII characters (excluding space and DEL)
 		if (n >= 48 && n <= 57) || (n >= 65 && n <= 90) || (n >= 97 && n <= 122) {
-			result += string(n)
+			result += string(rune(n))
 		}
 	}
 }
 
-func newPgSecretCr(component string, cr *gitifold.VCS) (*corev1.Secret, *DBSecret) {
+func newPgSecretCr(component string, cr *gitifold.VCS, found *corev1.Secret) (*corev1.Secret, *DBSecret, error) {
 
-	pass, _ := GenerateRandomASCIIString(32)
+	pass, err := secretValue(found, "db_pass", func() (string, error) {
+		return GenerateRandomASCIIString(32)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 	name, labels := pgLabelNames(component, cr)
 	return &corev1.Secret{
-			TypeMeta: metav1.TypeMeta{
-				APIVersion: "v1",
-				Kind:       "Secret",
-			},
-			ObjectMeta: metav1.ObjectMeta{
-				Name:        name,
-				Namespace:   cr.Namespace,
-				Annotations: make(map[string]string),
-				Labels:      labels,
-			},
-			Data: map[string][]byte{
-				"db_user": []byte(component),
-				"db_name": []byte(component),
-				"db_pass": []byte(pass),
-				"db_host": []byte(name),
-			},
-		}, &DBSecret{
-			Name: component,
-			User: component,
-			Pass: pass,
-			Host: name,
-		}
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Data: map[string][]byte{
+			"db_user":    []byte(component),
+			"db_name":    []byte(component),
+			"db_pass":    []byte(pass),
+			"db_host":    []byte(name),
+			"db_port":    []byte("5432"),
+			"db_sslmode": []byte("disable"),
+		},
+	}, &DBSecret{
+		Name:    component,
+		User:    component,
+		Pass:    pass,
+		Host:    name,
+		Port:    "5432",
+		SSLMode: "disable",
+		Secret:  name,
+	}, nil
+}
+
+func newPgConfigMapCr(component string, cr *gitifold.VCS) *corev1.ConfigMap {
+	_, labels := pgLabelNames(component, cr)
+
+	config := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pgConfigName(component, cr),
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Data: map[string]string{
+			"pg_hba.conf": pgHBA(cr),
+		},
+	}
+	if len(pgParameters(component, cr)) > 0 {
+		config.Data["postgresql.conf"] = pgPostgresqlConf(component, cr)
+	}
+	return config
 }
 
 func newPgStatefulSetCr(component string, cr *gitifold.VCS) *appsv1.StatefulSet {
 
 	name, labels := pgLabelNames(component, cr)
+	image, pullPolicy := pgContainerImage(component, cr)
+	// every major version keeps its data on volumes of its own
+	data := pgDataName(component, pgRunningVersion(component, cr), cr)
+	exporterImage, exporterPullPolicy := containerImage("postgres-exporter", pgSpec(component, cr).ExporterImage, cr)
 
-	limitCpu, _ := resource.ParseQuantity("1000m")
-	limitMemory, _ := resource.ParseQuantity("2048Mi")
-	requestCpu, _ := resource.ParseQuantity("100m")
-	requestMemory, _ := resource.ParseQuantity("384Mi")
-
-	rc := int32(1)
+	rc := 1 + pgSpec(component, cr).Replicas
 	gracePeriod := int64(90)
-	size, _ := resource.ParseQuantity("2Gi")
 
-	return &appsv1.StatefulSet{
+	sts := &appsv1.StatefulSet{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "StatefulSet",
 			APIVersion: "apps/v1",
@@ -273,21 +547,11 @@ func newPgStatefulSetCr(component string, cr *gitifold.VCS) *appsv1.StatefulSet
 						APIVersion: "v1",
 					},
 					ObjectMeta: metav1.ObjectMeta{
-						Name:      name,
+						Name:      data,
 						Namespace: cr.Namespace,
 						Labels:    labels,
 					},
-					Spec: corev1.PersistentVolumeClaimSpec{
-						Resources: corev1.ResourceRequirements{
-							Requests: corev1.ResourceList{
-								"storage": size,
-							},
-						},
-						//StorageClassName: &storageClass,
-						AccessModes: []corev1.PersistentVolumeAccessMode{
-							corev1.ReadWriteOnce,
-						},
-					},
+					Spec: claimSpec(pgSpec(component, cr).Storage, "2Gi"),
 				},
 			},
 			Template: corev1.PodTemplateSpec{
@@ -295,6 +559,7 @@ func newPgStatefulSetCr(component string, cr *gitifold.VCS) *appsv1.StatefulSet
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
+					ImagePullSecrets:              cr.Spec.ImagePullSecrets,
 					RestartPolicy:                 "Always",
 					TerminationGracePeriodSeconds: &gracePeriod,
 					Volumes: []corev1.Volume{
@@ -325,7 +590,8 @@ func newPgStatefulSetCr(component string, cr *gitifold.VCS) *appsv1.StatefulSet
 									Value: "user=$(POSTGRES_USER) host=/run/postgresql/ sslmode=disable",
 								},
 							},
-							Image: "wrouesnel/postgres_exporter:v0.8.0",
+							Image:           exporterImage,
+							ImagePullPolicy: exporterPullPolicy,
 							LivenessProbe: &corev1.Probe{
 								Handler: corev1.Handler{
 									HTTPGet: &corev1.HTTPGetAction{
@@ -357,12 +623,13 @@ func newPgStatefulSetCr(component string, cr *gitifold.VCS) *appsv1.StatefulSet
 							},
 						},
 						{
-							Name:  "postgres",
-							Image: "postgres:12.2-alpine",
+							Name:            "postgres",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
 							Env: []corev1.EnvVar{
 								{
 									Name:  "PGDATA",
-									Value: "/var/lib/postgresql/data",
+									Value: pgDataDir,
 								},
 								{
 									Name: "POSTGRES_DB",
@@ -411,7 +678,7 @@ func newPgStatefulSetCr(component string, cr *gitifold.VCS) *appsv1.StatefulSet
 									MountPath: "/run",
 								},
 								{
-									Name:      name,
+									Name:      data,
 									MountPath: "/var/lib/postgresql",
 								},
 							},
@@ -443,20 +710,74 @@ func newPgStatefulSetCr(component string, cr *gitifold.VCS) *appsv1.StatefulSet
 								InitialDelaySeconds: int32(4),
 								PeriodSeconds:       int32(6),
 							},
-							Resources: corev1.ResourceRequirements{
-								Limits: corev1.ResourceList{
-									"cpu":    limitCpu,
-									"memory": limitMemory,
-								},
-								Requests: corev1.ResourceList{
-									"cpu":    requestCpu,
-									"memory": requestMemory,
-								},
-							},
+							Resources: pgResources(component, cr),
 						},
 					},
 				},
 			},
 		},
 	}
+	schedulePod(pgSpec(component, cr).WorkloadSpec, &sts.Spec.Template.Spec)
+	if args := pgServerArgs(component, cr); args != nil {
+		pgConfigPodSpec(component, args, &sts.Spec.Template.Spec, cr)
+	}
+	if len(pgParameters(component, cr)) > 0 {
+		pgReloadPodSpec(component, &sts.Spec.Template.Spec, cr)
+	}
+	if pgTLSEnabled(cr) {
+		pgTLSPodSpec(component, &sts.Spec.Template.Spec, cr)
+	}
+	if pgSpec(component, cr).Replicas > 0 {
+		pgHAPodSpec(component, &sts.Spec.Template.Spec, cr)
+	}
+	if archive := pgSpec(component, cr).Archive; archive != nil {
+		pgArchivePodSpec(component, archive, &sts.Spec.Template.Spec, cr)
+	}
+	return sts
+}
+
+// pgResources are those of the postgres container.
+func pgResources(component string, cr *gitifold.VCS) corev1.ResourceRequirements {
+	limitCpu, _ := resource.ParseQuantity("1000m")
+	limitMemory, _ := resource.ParseQuantity("2048Mi")
+	requestCpu, _ := resource.ParseQuantity("100m")
+	requestMemory, _ := resource.ParseQuantity("384Mi")
+
+	return workloadResources(pgSpec(component, cr).WorkloadSpec, corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			"cpu":    limitCpu,
+			"memory": limitMemory,
+		},
+		Requests: corev1.ResourceList{
+			"cpu":    requestCpu,
+			"memory": requestMemory,
+		},
+	})
+}
+
+// pgConfigPodSpec starts the postgres container with args, reading the
+// config ConfigMap.
+func pgConfigPodSpec(component string, args []string, pod *corev1.PodSpec, cr *gitifold.VCS) {
+	pod.Volumes = append(pod.Volumes, corev1.Volume{
+		Name: "config",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: pgConfigName(component, cr),
+				},
+			},
+		},
+	})
+	for i := range pod.Containers {
+		container := &pod.Containers[i]
+		if container.Name != "postgres" {
+			continue
+		}
+		container.Args = args
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "config",
+			MountPath: pgConfigDir,
+			ReadOnly:  true,
+		})
+	}
 }
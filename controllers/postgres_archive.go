@@ -0,0 +1,530 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// pgRecoveryTargetAnnotation is the target a recovered copy was started
+// with, a new target needs a new copy.
+const pgRecoveryTargetAnnotation = "gitifold.hyperspike.io/recovery-target"
+
+// pgMcDir holds the mc binary and its config, staged for archive_command
+// and restore_command.
+const pgMcDir = "/gitifold"
+
+// pgMc runs the staged mc.
+const pgMc = pgMcDir + "/mc --config-dir " + pgMcDir + "/config --quiet"
+
+// pgMcStageScript copies mc and its config out of the mc image. Whichever
+// the image, postgres does not run as root, so the files are opened up.
+const pgMcStageScript = `set -e
+cp "$(command -v mc)" ` + pgMcDir + `/mc
+` + pgMc + ` config host add s3 "${S3_ENDPOINT}" "${AWS_ACCESS_KEY_ID}" "${AWS_SECRET_ACCESS_KEY}" --api S3v4 > /dev/null
+chmod -R a+rwX ` + pgMcDir + `
+`
+
+const pgBaseBackupScript = `pg_basebackup -D - -Ft -z -X none --checkpoint=fast > /backup/base.tar.gz`
+
+// pgBaseBackupUploadScript uploads the base backup taken by the init
+// container, along with the first WAL segment it needs. All but the newest
+// RETENTION base backups are pruned, and the WAL older than the oldest one
+// kept. The ones kept are left in the termination message for the status.
+const pgBaseBackupUploadScript = mcConfigScript + `
+NAME=$(date -u +%Y%m%d-%H%M%S)
+START=$(tar -xzOf /backup/base.tar.gz backup_label | awk '/^START WAL LOCATION/ { sub(/\)$/, "", $NF); print $NF }')
+mc cp /backup/base.tar.gz "s3/${S3_BUCKET}/${S3_PREFIX}/base/${NAME}.tar.gz"
+echo "${START}" | mc pipe "s3/${S3_BUCKET}/${S3_PREFIX}/base/${NAME}.start"
+
+BASES=$(mc ls "s3/${S3_BUCKET}/${S3_PREFIX}/base/" | awk '{ print $NF }' | grep '\.tar\.gz$' | sort -r)
+for OLD in $(echo "${BASES}" | tail -n +$((RETENTION + 1))) ; do
+	mc rm "s3/${S3_BUCKET}/${S3_PREFIX}/base/${OLD}" "s3/${S3_BUCKET}/${S3_PREFIX}/base/${OLD%.tar.gz}.start"
+done
+OLDEST=$(echo "${BASES}" | head -n "${RETENTION}" | tail -n 1)
+KEEP=$(mc cat "s3/${S3_BUCKET}/${S3_PREFIX}/base/${OLDEST%.tar.gz}.start")
+# segment names sort by timeline and position, the history files are kept
+for WAL in $(mc ls "s3/${S3_BUCKET}/${S3_PREFIX}/wal/" | awk -v keep="${KEEP}" '$NF ~ /^[0-9A-F]{24}$/ && ($NF "") < (keep "") { print $NF }') ; do
+	mc rm "s3/${S3_BUCKET}/${S3_PREFIX}/wal/${WAL}"
+done
+echo "${BASES}" | head -n "${RETENTION}" | sed 's/\.tar\.gz$//' > /dev/termination-log
+`
+
+// pgRecoveryDownloadScript seeds an empty data directory with the newest
+// base backup taken before TARGET, postgres then replays the WAL on top.
+const pgRecoveryDownloadScript = pgMcStageScript + `
+if [ -s "${PGDATA}/PG_VERSION" ] ; then
+	exit 0
+fi
+BASE=$(` + pgMc + ` ls "s3/${S3_BUCKET}/${S3_PREFIX}/base/" | awk '{ print $NF }' | grep '\.tar\.gz$' | sort -r | awk -v target="${TARGET}.tar.gz" '($1 "") <= (target "")' | head -n 1)
+if [ -z "${BASE}" ] ; then
+	echo "no base backup taken before ${TARGET}" | tee /dev/termination-log
+	exit 1
+fi
+mkdir -p "${PGDATA}"
+` + pgMc + ` cat "s3/${S3_BUCKET}/${S3_PREFIX}/base/${BASE}" | tar -xzf - -C "${PGDATA}"
+touch "${PGDATA}/recovery.signal"
+`
+
+func pgBaseBackupName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "basebackup"}, "-")
+}
+
+func pgRecoveryName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "recovery"}, "-")
+}
+
+func pgRecoveryClaimName(component string, cr *gitifold.VCS) string {
+	name := pgRecoveryName(component, cr)
+	return strings.Join([]string{name, name, "0"}, "-")
+}
+
+// pgArchiveS3 is where the archive of the version running goes, the WAL of
+// an upgraded instance starts over and may not mix with the former one.
+func pgArchiveS3(component string, archive *gitifold.PostgresArchiveSpec, cr *gitifold.VCS) gitifold.S3Spec {
+	s3 := archive.S3
+	if version := pgRunningVersion(component, cr); version != pgDefaultVersion {
+		s3.Prefix = strings.Join([]string{pgBackupPrefix(component, archive.S3, cr), "pg" + version}, "/")
+	}
+	return s3
+}
+
+// pgArchiveURL is where the WAL of an instance is archived.
+func pgArchiveURL(component string, archive *gitifold.PostgresArchiveSpec, cr *gitifold.VCS) string {
+	return strings.Join([]string{"s3", archive.S3.Bucket, pgBackupPrefix(component, pgArchiveS3(component, archive, cr), cr), "wal"}, "/")
+}
+
+// pgArchiveArgs ship every WAL segment as it is completed, or at least once
+// a minute.
+func pgArchiveArgs(component string, archive *gitifold.PostgresArchiveSpec, cr *gitifold.VCS) []string {
+	return []string{
+		"-c", "archive_mode=on",
+		"-c", "archive_command=" + pgMc + " cp %p " + pgArchiveURL(component, archive, cr) + "/%f",
+		"-c", "archive_timeout=60",
+	}
+}
+
+// pgArchiveObjects are the objects only deployed along with an archive.
+func pgArchiveObjects(component string, cr *gitifold.VCS) []managedObject {
+	return append([]managedObject{
+		&batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: pgBaseBackupName(component, cr)}},
+	}, pgRecoveryObjects(component, cr)...)
+}
+
+// pgRecoveryObjects make up a recovered copy, the claim is only a copy and
+// goes along with it.
+func pgRecoveryObjects(component string, cr *gitifold.VCS) []managedObject {
+	name := pgRecoveryName(component, cr)
+	return []managedObject{
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: pgRecoveryClaimName(component, cr)}},
+	}
+}
+
+// reconcilePgArchive schedules the base backups of an archived instance,
+// and recovers a copy of it when asked to.
+func reconcilePgArchive(component string, cr *gitifold.VCS, r *VCSReconciler) error {
+	archive := pgSpec(component, cr).Archive
+	if archive == nil {
+		return deleteObjects(pgArchiveObjects(component, cr), cr, r)
+	}
+
+	cronJob := newPgBaseBackupCronJobCr(component, archive, cr)
+	desired := cronJob.Spec.DeepCopy()
+	if err := reconcileObject("CronJob", cr, r, cronJob, func() {
+		if specMatches(*desired, cronJob.Spec) {
+			return
+		}
+		cronJob.Spec = *desired
+	}); err != nil {
+		return err
+	}
+
+	return reconcilePgRecovery(component, archive, cr, r)
+}
+
+// reconcilePgRecovery deploys the recovered copy, starting over when the
+// target changed.
+func reconcilePgRecovery(component string, archive *gitifold.PostgresArchiveSpec, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	recovery := pgSpec(component, cr).Recovery
+	if recovery == nil {
+		return deleteObjects(pgRecoveryObjects(component, cr), cr, r)
+	}
+
+	sts := newPgRecoveryStatefulSetCr(component, archive, recovery, cr)
+	live := &appsv1.StatefulSet{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: sts.Name, Namespace: cr.Namespace}, live)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && live.Annotations[pgRecoveryTargetAnnotation] != sts.Annotations[pgRecoveryTargetAnnotation] {
+		logger.Info("Recovering Postgres to a new target", "Instance", component, "Target", sts.Annotations[pgRecoveryTargetAnnotation])
+		if err = deleteObjects(pgRecoveryObjects(component, cr), cr, r); err != nil {
+			return err
+		}
+		return &requeueError{reason: "dropping the recovered " + component + " postgres", after: 5 * time.Second}
+	}
+	if errors.IsNotFound(err) {
+		// the copy of a former target has to be gone first
+		claim := &corev1.PersistentVolumeClaim{}
+		err = r.Client.Get(context.TODO(), types.NamespacedName{Name: pgRecoveryClaimName(component, cr), Namespace: cr.Namespace}, claim)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil && claim.DeletionTimestamp != nil {
+			return &requeueError{reason: "waiting for the recovered " + component + " postgres volume to be deleted", after: 5 * time.Second}
+		}
+	}
+
+	if err = reconcileService(cr, r, newPgRecoveryServiceCr(component, cr)); err != nil {
+		return err
+	}
+	return reconcileStatefulSet(cr, r, sts)
+}
+
+// observePgArchive fills in the last base backup, and those kept as reported
+// by the newest base backup Job that succeeded.
+func observePgArchive(component string, status *gitifold.PostgresArchiveStatus, cr *gitifold.VCS, r *VCSReconciler) error {
+	last, backups, err := lastBackupJob(pgBackupLabels("basebackup", component, cr), cr, r)
+	if err != nil || last == nil {
+		return err
+	}
+	status.LastBaseBackupTime = last.Status.CompletionTime.DeepCopy()
+	status.BaseBackups = backups
+	return nil
+}
+
+// pgArchivePodSpec stages mc for archive_command in an init container.
+func pgArchivePodSpec(component string, archive *gitifold.PostgresArchiveSpec, pod *corev1.PodSpec, cr *gitifold.VCS) {
+	mcImage, mcPullPolicy := containerImage("mc", archive.Image, cr)
+
+	pod.Volumes = append(pod.Volumes, corev1.Volume{
+		Name: "mc",
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+	mount := corev1.VolumeMount{
+		Name:      "mc",
+		MountPath: pgMcDir,
+	}
+	pod.InitContainers = append(pod.InitContainers, corev1.Container{
+		Name:            "mc",
+		Image:           mcImage,
+		ImagePullPolicy: mcPullPolicy,
+		Command:         []string{"/bin/sh", "-c", pgMcStageScript},
+		Env:             pgS3Env(component, pgArchiveS3(component, archive, cr), cr),
+		VolumeMounts:    []corev1.VolumeMount{mount},
+	})
+	for i := range pod.Containers {
+		container := &pod.Containers[i]
+		if container.Name != "postgres" {
+			continue
+		}
+		container.VolumeMounts = append(container.VolumeMounts, mount)
+	}
+}
+
+func pgArchiveRetention(archive *gitifold.PostgresArchiveSpec) int32 {
+	if archive.Retention == 0 {
+		return 2
+	}
+	return archive.Retention
+}
+
+func newPgBaseBackupCronJobCr(component string, archive *gitifold.PostgresArchiveSpec, cr *gitifold.VCS) *batchv1beta1.CronJob {
+	name, labels := pgLabelNames(component, cr)
+	jobLabels := pgBackupLabels("basebackup", component, cr)
+	pgImage, pgPullPolicy := pgContainerImage(component, cr)
+	mcImage, mcPullPolicy := containerImage("mc", archive.Image, cr)
+
+	backoffLimit := int32(2)
+	successfulJobs := int32(3)
+	failedJobs := int32(1)
+	fal := false
+
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "backup",
+			MountPath: "/backup",
+		},
+	}
+	pod := corev1.PodSpec{
+		ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+		AutomountServiceAccountToken: &fal,
+		RestartPolicy:                corev1.RestartPolicyNever,
+		Volumes: []corev1.Volume{
+			{
+				Name: "backup",
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			},
+		},
+		InitContainers: []corev1.Container{
+			{
+				Name:            "basebackup",
+				Image:           pgImage,
+				ImagePullPolicy: pgPullPolicy,
+				Command:         []string{"/bin/sh", "-c", pgBaseBackupScript},
+				Env:             pgClientEnv(name),
+				VolumeMounts:    mounts,
+			},
+		},
+		Containers: []corev1.Container{
+			{
+				Name:            "upload",
+				Image:           mcImage,
+				ImagePullPolicy: mcPullPolicy,
+				Command:         []string{"/bin/sh", "-c", pgBaseBackupUploadScript},
+				Env: append(pgS3Env(component, pgArchiveS3(component, archive, cr), cr), corev1.EnvVar{
+					Name:  "RETENTION",
+					Value: strconv.Itoa(int(pgArchiveRetention(archive))),
+				}),
+				VolumeMounts: mounts,
+			},
+		},
+	}
+	schedulePod(pgSpec(component, cr).WorkloadSpec, &pod)
+	mountDatabaseCA(&DBSecret{Secret: name, CA: pgTLSEnabled(cr)}, &pod)
+
+	return &batchv1beta1.CronJob{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "CronJob",
+			APIVersion: "batch/v1beta1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgBaseBackupName(component, cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1beta1.CronJobSpec{
+			Schedule:                   archive.BaseBackupSchedule,
+			ConcurrencyPolicy:          batchv1beta1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: &successfulJobs,
+			FailedJobsHistoryLimit:     &failedJobs,
+			JobTemplate: batchv1beta1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: jobLabels,
+				},
+				Spec: batchv1.JobSpec{
+					BackoffLimit: &backoffLimit,
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: jobLabels,
+						},
+						Spec: pod,
+					},
+				},
+			},
+		},
+	}
+}
+
+func newPgRecoveryServiceCr(component string, cr *gitifold.VCS) *corev1.Service {
+	labels := pgBackupLabels("recovery", component, cr)
+
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pgRecoveryName(component, cr),
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Type:     "ClusterIP",
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "postgres",
+					Protocol:   "TCP",
+					Port:       5432,
+					TargetPort: intstr.FromString("postgres"),
+				},
+			},
+		},
+	}
+}
+
+// newPgRecoveryStatefulSetCr replays the archive onto a base backup up to
+// the target, and is promoted there. Without hot standby it only takes
+// connections, and turns ready, once recovered.
+func newPgRecoveryStatefulSetCr(component string, archive *gitifold.PostgresArchiveSpec, recovery *gitifold.PostgresRecoverySpec, cr *gitifold.VCS) *appsv1.StatefulSet {
+	secret, _ := pgLabelNames(component, cr)
+	name := pgRecoveryName(component, cr)
+	labels := pgBackupLabels("recovery", component, cr)
+	image, pullPolicy := pgContainerImage(component, cr)
+	mcImage, mcPullPolicy := containerImage("mc", archive.Image, cr)
+
+	target := recovery.TargetTime.UTC()
+	args := []string{
+		"postgres",
+		"-c", "restore_command=" + pgMc + " cp " + pgArchiveURL(component, archive, cr) + "/%f %p",
+		"-c", "recovery_target_time=" + target.Format("2006-01-02 15:04:05") + "+00",
+		"-c", "recovery_target_action=promote",
+		"-c", "hot_standby=off",
+	}
+	rc := int32(1)
+	gracePeriod := int64(90)
+
+	pgEnv := []corev1.EnvVar{
+		{
+			Name:  "PGDATA",
+			Value: pgDataDir,
+		},
+	}
+	for _, key := range []struct{ env, key string }{
+		{"POSTGRES_DB", "db_name"},
+		{"POSTGRES_USER", "db_user"},
+	} {
+		pgEnv = append(pgEnv, corev1.EnvVar{
+			Name: key.env,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: secret,
+					},
+					Key: key.key,
+				},
+			},
+		})
+	}
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "mc",
+			MountPath: pgMcDir,
+		},
+		{
+			Name:      name,
+			MountPath: "/var/lib/postgresql",
+		},
+	}
+	probe := &corev1.Probe{
+		Handler: corev1.Handler{
+			Exec: &corev1.ExecAction{
+				Command: []string{
+					"sh",
+					"-c",
+					"psql -U $POSTGRES_USER -d $POSTGRES_DB -q -c 'SELECT 1'",
+				},
+			},
+		},
+		InitialDelaySeconds: int32(4),
+		PeriodSeconds:       int32(6),
+	}
+
+	sts := &appsv1.StatefulSet{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "StatefulSet",
+			APIVersion: "apps/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				pgRecoveryTargetAnnotation: target.Format(time.RFC3339),
+			},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &rc,
+			ServiceName: name,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{
+					TypeMeta: metav1.TypeMeta{
+						Kind:       "PersistentVolumeClaim",
+						APIVersion: "v1",
+					},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      name,
+						Namespace: cr.Namespace,
+						Labels:    labels,
+					},
+					Spec: claimSpec(pgSpec(component, cr).Storage, "2Gi"),
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:              cr.Spec.ImagePullSecrets,
+					RestartPolicy:                 "Always",
+					TerminationGracePeriodSeconds: &gracePeriod,
+					Volumes: []corev1.Volume{
+						{
+							Name: "mc",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+					InitContainers: []corev1.Container{
+						{
+							Name:            "download",
+							Image:           mcImage,
+							ImagePullPolicy: mcPullPolicy,
+							Command:         []string{"/bin/sh", "-c", pgRecoveryDownloadScript},
+							Env: append(pgS3Env(component, pgArchiveS3(component, archive, cr), cr), pgEnv[0], corev1.EnvVar{
+								Name:  "TARGET",
+								Value: target.Format(pgBackupTimeFormat),
+							}),
+							VolumeMounts: mounts,
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:            "postgres",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Args:            args,
+							Env:             pgEnv,
+							Ports: []corev1.ContainerPort{
+								{
+									ContainerPort: 5432,
+									Protocol:      "TCP",
+									Name:          "postgres",
+								},
+							},
+							VolumeMounts:   mounts,
+							ReadinessProbe: probe,
+							Resources:      workloadResources(pgSpec(component, cr).WorkloadSpec, corev1.ResourceRequirements{}),
+						},
+					},
+				},
+			},
+		},
+	}
+	schedulePod(pgSpec(component, cr).WorkloadSpec, &sts.Spec.Template.Spec)
+	if pgTLSEnabled(cr) {
+		// the copy is served like the instance
+		args = append(args, "-c", "hba_file="+pgConfigDir+"/pg_hba.conf")
+		pgConfigPodSpec(component, append(args, pgTLSArgs()...), &sts.Spec.Template.Spec, cr)
+		pgTLSPodSpec(component, &sts.Spec.Template.Spec, cr)
+	}
+	return sts
+}
@@ -0,0 +1,440 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// pgBackupTimeFormat names the backups, they sort by age.
+const pgBackupTimeFormat = "20060102-150405"
+
+// mcConfigScript points the mc alias s3 at the object store.
+const mcConfigScript = `set -e
+mc config host add s3 "${S3_ENDPOINT}" "${AWS_ACCESS_KEY_ID}" "${AWS_SECRET_ACCESS_KEY}" --api S3v4 > /dev/null
+`
+
+// pgBackupUploadScript uploads the dump taken by the init container, prunes
+// all but the newest RETENTION backups, and leaves the ones kept in the
+// termination message for the status.
+const pgBackupUploadScript = mcConfigScript + `
+mc cp /backup/dump.pgdump "s3/${S3_BUCKET}/${S3_PREFIX}/$(date -u +%Y%m%d-%H%M%S).pgdump"
+BACKUPS=$(mc ls "s3/${S3_BUCKET}/${S3_PREFIX}/" | awk '{ print $NF }' | grep '\.pgdump$' | sort -r)
+for OLD in $(echo "${BACKUPS}" | tail -n +$((RETENTION + 1))) ; do
+	mc rm "s3/${S3_BUCKET}/${S3_PREFIX}/${OLD}"
+done
+echo "${BACKUPS}" | head -n "${RETENTION}" | sed 's/\.pgdump$//' > /dev/termination-log
+`
+
+const pgBackupDumpScript = `pg_dump -Fc -f /backup/dump.pgdump`
+
+const pgRestoreDownloadScript = mcConfigScript + `
+mc cp "s3/${S3_BUCKET}/${S3_PREFIX}/${BACKUP}.pgdump" /backup/dump.pgdump
+`
+
+// pgRestoreBackupScript refuses to restore over existing tables, a restore
+// only ever seeds a new database.
+const pgRestoreBackupScript = `set -e
+TABLES=$(psql -tAc "SELECT count(*) FROM pg_tables WHERE schemaname = 'public'")
+if [ "${TABLES}" != "0" ] ; then
+	echo "database ${PGDATABASE} is not empty, not restoring ${BACKUP}" | tee /dev/termination-log
+	exit 1
+fi
+pg_restore --no-owner --exit-on-error -d "${PGDATABASE}" /backup/dump.pgdump
+`
+
+func pgBackupName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "backup"}, "-")
+}
+
+func pgRestoreName(component, backup string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "restore", backup}, "-")
+}
+
+func pgBackupLabels(step, component string, cr *gitifold.VCS) map[string]string {
+	_, labels := pgLabelNames(component, cr)
+	backupLabels := make(map[string]string, len(labels))
+	for key, value := range labels {
+		backupLabels[key] = value
+	}
+	// must not match the Service selector of the instance
+	backupLabels["app.kubernetes.io/name"] = "postgres-" + step
+
+	return backupLabels
+}
+
+func pgBackupPrefix(component string, s3 gitifold.S3Spec, cr *gitifold.VCS) string {
+	if s3.Prefix != "" {
+		return strings.Trim(s3.Prefix, "/")
+	}
+	return strings.Join([]string{cr.Namespace, cr.Name, component}, "/")
+}
+
+// reconcilePgBackup schedules the backups of the database of a component,
+// and first seeds it from a backup when asked to.
+func reconcilePgBackup(component string, dbSecret *DBSecret, cr *gitifold.VCS, r *VCSReconciler) error {
+	backup := pgSpec(component, cr).Backup
+	if backup == nil {
+		return deleteObjects([]managedObject{
+			&batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: pgBackupName(component, cr)}},
+		}, cr, r)
+	}
+
+	if err := restorePgBackup(component, dbSecret, backup, cr, r); err != nil {
+		return err
+	}
+
+	cronJob := newPgBackupCronJobCr(component, dbSecret, backup, cr)
+	desired := cronJob.Spec.DeepCopy()
+	return reconcileObject("CronJob", cr, r, cronJob, func() {
+		if specMatches(*desired, cronJob.Spec) {
+			return
+		}
+		cronJob.Spec = *desired
+	})
+}
+
+// restorePgBackup runs the Job restoring backup.RestoreFrom once, the
+// outcome is kept in the status.
+func restorePgBackup(component string, dbSecret *DBSecret, backup *gitifold.PostgresBackupSpec, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	status := pgBackupStatus(component, &cr.Status)
+	if backup.RestoreFrom == "" || status.RestoredFrom == backup.RestoreFrom {
+		return nil
+	}
+
+	job := newPgRestoreJobCr(component, dbSecret, backup, cr)
+	if err := runJob(job, cr, r); err != nil {
+		if failed, ok := err.(*jobFailedError); ok {
+			// not retried, the backup has to be changed or the database emptied
+			return fmt.Errorf("restoring backup %s failed: %s", backup.RestoreFrom, failed.message)
+		}
+		return err
+	}
+
+	status.RestoredFrom = backup.RestoreFrom
+	if err := r.Client.Status().Update(context.TODO(), cr); err != nil {
+		return err
+	}
+	logger.Info("Restored Postgres", "Database", component, "Backup", backup.RestoreFrom)
+	return deleteObject("Job", cr, r, job)
+}
+
+// pgBackupStatus returns the backup status of component, adding it if
+// there is none yet.
+func pgBackupStatus(component string, status *gitifold.VCSStatus) *gitifold.PostgresBackupStatus {
+	for i := range status.Backups {
+		if status.Backups[i].Name == component {
+			return &status.Backups[i]
+		}
+	}
+	status.Backups = append(status.Backups, gitifold.PostgresBackupStatus{Name: component})
+	return &status.Backups[len(status.Backups)-1]
+}
+
+// observePgBackups fills in the last backup, and the backups kept as
+// reported by the newest backup Job that succeeded.
+func observePgBackups(component string, status *gitifold.PostgresBackupStatus, cr *gitifold.VCS, r *VCSReconciler) error {
+	last, backups, err := lastBackupJob(pgBackupLabels("backup", component, cr), cr, r)
+	if err != nil || last == nil {
+		return err
+	}
+	status.LastBackupTime = last.Status.CompletionTime.DeepCopy()
+	if backups != nil {
+		status.Backups = backups
+	}
+	return nil
+}
+
+// lastBackupJob finds the newest Job labelled labels that succeeded, and the
+// backups its upload container left in its termination message, nil when
+// the pod is gone.
+func lastBackupJob(labels map[string]string, cr *gitifold.VCS, r *VCSReconciler) (*batchv1.Job, []gitifold.Backup, error) {
+	jobs := &batchv1.JobList{}
+	err := r.Client.List(context.TODO(), jobs, client.InNamespace(cr.Namespace), client.MatchingLabels(labels))
+	if err != nil {
+		return nil, nil, err
+	}
+	var last *batchv1.Job
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if job.Status.Succeeded == 0 || job.Status.CompletionTime == nil {
+			continue
+		}
+		if last == nil || last.Status.CompletionTime.Before(job.Status.CompletionTime) {
+			last = job
+		}
+	}
+	if last == nil {
+		return nil, nil, nil
+	}
+
+	pods := &corev1.PodList{}
+	if err = r.Client.List(context.TODO(), pods, client.InNamespace(cr.Namespace), client.MatchingLabels{"job-name": last.Name}); err != nil {
+		return nil, nil, err
+	}
+	var backups []gitifold.Backup
+	for _, pod := range pods.Items {
+		for _, container := range pod.Status.ContainerStatuses {
+			if container.Name != "upload" || container.State.Terminated == nil || container.State.Terminated.ExitCode != 0 {
+				continue
+			}
+			backups = parseBackups(container.State.Terminated.Message)
+		}
+	}
+	return last, backups, nil
+}
+
+// parseBackups reads the backup names, one per line, left behind by the
+// upload container.
+func parseBackups(message string) []gitifold.Backup {
+	backups := []gitifold.Backup{}
+	for _, name := range strings.Fields(message) {
+		t, err := time.Parse(pgBackupTimeFormat, name)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, gitifold.Backup{Name: name, Time: metav1.NewTime(t)})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[j].Time.Before(&backups[i].Time)
+	})
+	return backups
+}
+
+// newPgBackupPodSpec dumps the database in an init container, for the
+// container named step to move it to or from the object store.
+func newPgBackupPodSpec(step, component string, dbSecret *DBSecret, backup *gitifold.PostgresBackupSpec, cr *gitifold.VCS) corev1.PodSpec {
+	pgImage, pgPullPolicy := pgContainerImage(pgInstance(component, cr), cr)
+	mcImage, mcPullPolicy := containerImage("mc", backup.Image, cr)
+
+	s3Env := pgS3Env(component, backup.S3, cr)
+
+	pg := corev1.Container{
+		Name:            "dump",
+		Image:           pgImage,
+		ImagePullPolicy: pgPullPolicy,
+		Command:         []string{"/bin/sh", "-c", pgBackupDumpScript},
+		Env:             pgClientEnv(dbSecret.Secret),
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "backup",
+				MountPath: "/backup",
+			},
+		},
+	}
+	mc := corev1.Container{
+		Name:            "upload",
+		Image:           mcImage,
+		ImagePullPolicy: mcPullPolicy,
+		Command:         []string{"/bin/sh", "-c", pgBackupUploadScript},
+		Env: append(s3Env, corev1.EnvVar{
+			Name:  "RETENTION",
+			Value: strconv.Itoa(int(pgBackupRetention(backup))),
+		}),
+		VolumeMounts: pg.VolumeMounts,
+	}
+
+	fal := false
+	pod := corev1.PodSpec{
+		ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+		AutomountServiceAccountToken: &fal,
+		RestartPolicy:                corev1.RestartPolicyNever,
+		Volumes: []corev1.Volume{
+			{
+				Name: "backup",
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			},
+		},
+		InitContainers: []corev1.Container{pg},
+		Containers:     []corev1.Container{mc},
+	}
+	if step == "restore" {
+		// the other way around
+		mc.Name = "download"
+		mc.Command = []string{"/bin/sh", "-c", pgRestoreDownloadScript}
+		mc.Env = append(s3Env, corev1.EnvVar{
+			Name:  "BACKUP",
+			Value: backup.RestoreFrom,
+		})
+		pg.Name = "restore"
+		pg.Command = []string{"/bin/sh", "-c", pgRestoreBackupScript}
+		pg.Env = append(pg.Env, corev1.EnvVar{
+			Name:  "BACKUP",
+			Value: backup.RestoreFrom,
+		})
+		pod.InitContainers = []corev1.Container{mc}
+		pod.Containers = []corev1.Container{pg}
+	}
+
+	schedulePod(pgSpec(pgInstance(component, cr), cr).WorkloadSpec, &pod)
+	mountDatabaseCA(dbSecret, &pod)
+	return pod
+}
+
+// pgS3Env points mcConfigScript at the bucket and prefix of s3.
+func pgS3Env(component string, s3 gitifold.S3Spec, cr *gitifold.VCS) []corev1.EnvVar {
+	endpoint := s3.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	env := []corev1.EnvVar{
+		{
+			Name:  "S3_ENDPOINT",
+			Value: endpoint,
+		},
+		{
+			Name:  "S3_BUCKET",
+			Value: s3.Bucket,
+		},
+		{
+			Name:  "S3_PREFIX",
+			Value: pgBackupPrefix(component, s3, cr),
+		},
+	}
+	for _, key := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		env = append(env, corev1.EnvVar{
+			Name: key,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: s3.SecretName,
+					},
+					Key: key,
+				},
+			},
+		})
+	}
+	return env
+}
+
+func pgBackupRetention(backup *gitifold.PostgresBackupSpec) int32 {
+	if backup.Retention == 0 {
+		return 7
+	}
+	return backup.Retention
+}
+
+func newPgBackupCronJobCr(component string, dbSecret *DBSecret, backup *gitifold.PostgresBackupSpec, cr *gitifold.VCS) *batchv1beta1.CronJob {
+	_, labels := pgLabelNames(component, cr)
+	jobLabels := pgBackupLabels("backup", component, cr)
+
+	backoffLimit := int32(2)
+	successfulJobs := int32(3)
+	failedJobs := int32(1)
+
+	return &batchv1beta1.CronJob{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "CronJob",
+			APIVersion: "batch/v1beta1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgBackupName(component, cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1beta1.CronJobSpec{
+			Schedule:                   backup.Schedule,
+			ConcurrencyPolicy:          batchv1beta1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: &successfulJobs,
+			FailedJobsHistoryLimit:     &failedJobs,
+			JobTemplate: batchv1beta1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: jobLabels,
+				},
+				Spec: batchv1.JobSpec{
+					BackoffLimit: &backoffLimit,
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: jobLabels,
+						},
+						Spec: newPgBackupPodSpec("backup", component, dbSecret, backup, cr),
+					},
+				},
+			},
+		},
+	}
+}
+
+func newPgRestoreJobCr(component string, dbSecret *DBSecret, backup *gitifold.PostgresBackupSpec, cr *gitifold.VCS) *batchv1.Job {
+	labels := pgBackupLabels("restore", component, cr)
+	backoffLimit := int32(2)
+
+	return &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgRestoreName(component, backup.RestoreFrom, cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: newPgBackupPodSpec("restore", component, dbSecret, backup, cr),
+			},
+		},
+	}
+}
+
+// cronJobConditions reports the backups of a database, Degraded when the
+// last one failed.
+func cronJobConditions(name string, cr *gitifold.VCS, r *VCSReconciler) ([]gitifold.Condition, error) {
+	cronJob := &batchv1beta1.CronJob{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, cronJob)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return missingConditions(cr), nil
+		}
+		return nil, err
+	}
+
+	jobs := &batchv1.JobList{}
+	if err = r.Client.List(context.TODO(), jobs, client.InNamespace(cr.Namespace), client.MatchingLabels(cronJob.Spec.JobTemplate.Labels)); err != nil {
+		return nil, err
+	}
+	var last *batchv1.Job
+	for i := range jobs.Items {
+		if last == nil || last.CreationTimestamp.Before(&jobs.Items[i].CreationTimestamp) {
+			last = &jobs.Items[i]
+		}
+	}
+
+	degraded, reason, message := false, "AsExpected", ""
+	if last != nil {
+		for _, c := range last.Status.Conditions {
+			if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+				degraded, reason, message = true, c.Reason, "backup "+last.Name+" failed: "+c.Message
+			}
+		}
+	}
+
+	return []gitifold.Condition{
+		newCondition(gitifold.ConditionReady, true, "Scheduled", "", cr),
+		newCondition(gitifold.ConditionProgressing, len(cronJob.Status.Active) > 0, "BackingUp", "", cr),
+		newCondition(gitifold.ConditionDegraded, degraded, reason, message, cr),
+	}, nil
+}
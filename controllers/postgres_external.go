@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// dbCADir is where the CA verifying a database server is mounted.
+const dbCADir = "/etc/gitifold/postgres"
+
+// createExternalPgService copies the connection details of an external
+// database into the postgres secret of the component, so it is consumed
+// exactly like a bundled one. A bundled instance left over from before is
+// removed, its claim is left to the retention policy.
+func createExternalPgService(component string, external *gitifold.ExternalPostgresSpec, cr *gitifold.VCS, r *VCSReconciler) (*DBSecret, error) {
+	source := &corev1.Secret{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: external.SecretName, Namespace: cr.Namespace}, source)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Errorf("external database secret %s not found", external.SecretName)
+		}
+		return nil, err
+	}
+
+	secret, dbSecret, err := newExternalPgSecretCr(component, source, cr)
+	if err != nil {
+		return nil, err
+	}
+	if err = reconcileSecret(cr, r, secret); err != nil {
+		return nil, err
+	}
+
+	err = deleteObjects(append(pgInstanceObjects(component, cr), &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: pgProvisionJobName(component, cr)}}), cr, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return dbSecret, nil
+}
+
+func newExternalPgSecretCr(component string, source *corev1.Secret, cr *gitifold.VCS) (*corev1.Secret, *DBSecret, error) {
+	name, labels := pgLabelNames(component, cr)
+
+	for _, key := range []string{"host", "database", "user", "password"} {
+		if len(source.Data[key]) == 0 {
+			return nil, nil, fmt.Errorf("external database secret %s has no %s", source.Name, key)
+		}
+	}
+	dbSecret := &DBSecret{
+		Host:    string(source.Data["host"]),
+		Name:    string(source.Data["database"]),
+		User:    string(source.Data["user"]),
+		Pass:    string(source.Data["password"]),
+		Port:    "5432",
+		SSLMode: "require",
+		Secret:  name,
+		CA:      len(source.Data["ca.crt"]) > 0,
+	}
+	if port := string(source.Data["port"]); port != "" {
+		dbSecret.Port = port
+	}
+	if sslMode := string(source.Data["sslmode"]); sslMode != "" {
+		dbSecret.SSLMode = sslMode
+	}
+
+	data := map[string][]byte{
+		"db_user":    []byte(dbSecret.User),
+		"db_name":    []byte(dbSecret.Name),
+		"db_pass":    []byte(dbSecret.Pass),
+		"db_host":    []byte(dbSecret.Host),
+		"db_port":    []byte(dbSecret.Port),
+		"db_sslmode": []byte(dbSecret.SSLMode),
+	}
+	if dbSecret.CA {
+		data["ca.crt"] = source.Data["ca.crt"]
+	}
+
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Data: data,
+	}, dbSecret, nil
+}
+
+// mountDatabaseCA mounts the CA of the database into every container of
+// pod, libpq based clients pick it up through PGSSLROOTCERT.
+func mountDatabaseCA(dbSecret *DBSecret, pod *corev1.PodSpec) {
+	if dbSecret == nil || !dbSecret.CA {
+		return
+	}
+	pod.Volumes = append(pod.Volumes, corev1.Volume{
+		Name: "postgres-ca",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: dbSecret.Secret,
+				Items: []corev1.KeyToPath{
+					{
+						Key:  "ca.crt",
+						Path: "ca.crt",
+					},
+				},
+			},
+		},
+	})
+	for _, containers := range [][]corev1.Container{pod.InitContainers, pod.Containers} {
+		for i := range containers {
+			containers[i].VolumeMounts = append(containers[i].VolumeMounts, corev1.VolumeMount{
+				Name:      "postgres-ca",
+				MountPath: dbCADir,
+				ReadOnly:  true,
+			})
+			containers[i].Env = append(containers[i].Env, corev1.EnvVar{
+				Name:  "PGSSLROOTCERT",
+				Value: strings.Join([]string{dbCADir, "ca.crt"}, "/"),
+			})
+		}
+	}
+}
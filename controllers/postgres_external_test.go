@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewExternalPgSecretCr(t *testing.T) {
+	required := func() map[string][]byte {
+		return map[string][]byte{
+			"host":     []byte("db.example.com"),
+			"database": []byte("gitea"),
+			"user":     []byte("gitea"),
+			"password": []byte("secret"),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		data    func(map[string][]byte)
+		want    map[string]string
+		wantCA  bool
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{
+				"db_host": "db.example.com", "db_name": "gitea", "db_user": "gitea", "db_pass": "secret",
+				"db_port": "5432", "db_sslmode": "require",
+			},
+		},
+		{
+			name: "port, sslmode and ca",
+			data: func(data map[string][]byte) {
+				data["port"] = []byte("6432")
+				data["sslmode"] = []byte("verify-full")
+				data["ca.crt"] = []byte("-----BEGIN CERTIFICATE-----")
+			},
+			want: map[string]string{
+				"db_host": "db.example.com", "db_name": "gitea", "db_user": "gitea", "db_pass": "secret",
+				"db_port": "6432", "db_sslmode": "verify-full", "ca.crt": "-----BEGIN CERTIFICATE-----",
+			},
+			wantCA: true,
+		},
+		{
+			name:    "no host",
+			data:    func(data map[string][]byte) { delete(data, "host") },
+			wantErr: true,
+		},
+		{
+			name:    "empty password",
+			data:    func(data map[string][]byte) { data["password"] = nil },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			source := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "external"}, Data: required()}
+			if tt.data != nil {
+				tt.data(source.Data)
+			}
+
+			secret, dbSecret, err := newExternalPgSecretCr("gitea", source, cr)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("newExternalPgSecretCr() returned no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(secret.Data) != len(tt.want) {
+				t.Errorf("secret has %d keys, want %d", len(secret.Data), len(tt.want))
+			}
+			for key, value := range tt.want {
+				if string(secret.Data[key]) != value {
+					t.Errorf("secret %s = %q, want %q", key, secret.Data[key], value)
+				}
+			}
+			if name, _ := pgLabelNames("gitea", cr); secret.Name != name || dbSecret.Secret != name {
+				t.Errorf("secret name = %q, DBSecret.Secret = %q, want %q", secret.Name, dbSecret.Secret, name)
+			}
+			if dbSecret.CA != tt.wantCA {
+				t.Errorf("DBSecret.CA = %v, want %v", dbSecret.CA, tt.wantCA)
+			}
+			if dbSecret.Port != tt.want["db_port"] || dbSecret.SSLMode != tt.want["db_sslmode"] {
+				t.Errorf("DBSecret port %q sslmode %q, want %q %q", dbSecret.Port, dbSecret.SSLMode, tt.want["db_port"], tt.want["db_sslmode"])
+			}
+		})
+	}
+}
@@ -0,0 +1,593 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// pgRoleLabel tells the primary apart from the replicas, the read-write and
+// read-only Services select on it.
+const pgRoleLabel = "gitifold.hyperspike.io/role"
+
+const (
+	pgFailoverTimeAnnotation = "gitifold.hyperspike.io/failover-time"
+	pgFenceAnnotation        = "gitifold.hyperspike.io/fence-uid"
+	pgPromoteAnnotation      = "gitifold.hyperspike.io/promote-uid"
+)
+
+// pgFailoverTimeout is how long the primary may be unready before writes
+// fail over, a primary being deleted fails over right away.
+const pgFailoverTimeout = 30 * time.Second
+
+// pgHADir is where the HA ConfigMap, naming the primary, is mounted.
+const pgHADir = "/etc/gitifold/ha"
+
+// pgHAScript starts the pod named in the HA ConfigMap as the primary, and
+// every other pod as a streaming replica. A former primary is rewound onto
+// the timeline of the new one, or cloned again when that fails. The
+// arguments are those of pgServerArgs.
+const pgHAScript = `set -e
+
+PRIMARY=$(cat ` + pgHADir + `/primary)
+export PGPASSWORD="${POSTGRES_PASSWORD}"
+mkdir -p "${PGDATA}"
+chown postgres:postgres "${PGDATA}"
+chmod 700 "${PGDATA}"
+
+if [ "${PRIMARY}" = "${HOSTNAME}" ] ; then
+	rm -f "${PGDATA}/standby.signal"
+else
+	until psql -h "${PRIMARY_HOST}" -U "${POSTGRES_USER}" -d "${POSTGRES_DB}" -tAc 'SELECT NOT pg_is_in_recovery()' 2> /dev/null | grep -q t ; do
+		echo "waiting for primary ${PRIMARY}"
+		sleep 2
+	done
+	if [ -s "${PGDATA}/PG_VERSION" ] && [ ! -f "${PGDATA}/standby.signal" ] ; then
+		su-exec postgres pg_rewind -D "${PGDATA}" --source-server="host=${PRIMARY_HOST} user=${POSTGRES_USER} dbname=${POSTGRES_DB}" || rm -rf "${PGDATA:?}"/*
+	fi
+	if [ ! -s "${PGDATA}/PG_VERSION" ] ; then
+		su-exec postgres pg_basebackup -h "${PRIMARY_HOST}" -U "${POSTGRES_USER}" -D "${PGDATA}" -X stream
+	fi
+	su-exec postgres touch "${PGDATA}/standby.signal"
+fi
+
+exec docker-entrypoint.sh "$@" \
+	-c "primary_conninfo=host=${PRIMARY_HOST} user=${POSTGRES_USER} application_name=${HOSTNAME}"
+`
+
+func pgHAName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "ha"}, "-")
+}
+
+func pgReadServiceName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "ro"}, "-")
+}
+
+func pgPodName(component string, ordinal int32, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return fmt.Sprintf("%s-%d", name, ordinal)
+}
+
+// pgOrdinal is the StatefulSet ordinal of a postgres pod.
+func pgOrdinal(pod string) int32 {
+	ordinal, _ := strconv.Atoi(pod[strings.LastIndex(pod, "-")+1:])
+	return int32(ordinal)
+}
+
+// reconcilePgHA runs before the StatefulSet, it keeps track of the primary
+// and moves writes to a replica when the primary goes away. Before the
+// replicas are scaled away writes are moved back to the first pod.
+func reconcilePgHA(component string, cr *gitifold.VCS, r *VCSReconciler) error {
+	replicas := pgSpec(component, cr).Replicas
+
+	cm := &corev1.ConfigMap{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: pgHAName(component, cr), Namespace: cr.Namespace}, cm)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if errors.IsNotFound(err) {
+		if replicas == 0 {
+			return deleteObjects(pgHAObjects(component, cr)[1:], cr, r)
+		}
+		cm = newPgHAConfigMapCr(component, pgPodName(component, 0, cr), cr)
+		if err = reconcileObject("ConfigMap", cr, r, cm, func() {}); err != nil {
+			return err
+		}
+	}
+
+	pods, err := pgPods(component, cr, r)
+	if err != nil {
+		return err
+	}
+	if err = finishPgFailover(component, cm, pods, cr, r); err != nil {
+		return err
+	}
+
+	if primary := cm.Data["primary"]; pgOrdinal(primary) > replicas {
+		return switchPgPrimary(component, cm, pods, pgPodName(component, 0, cr), "scaling down", cr, r)
+	}
+	if replicas == 0 {
+		return deleteObjects(pgHAObjects(component, cr), cr, r)
+	}
+
+	if err = failoverPg(component, cm, pods, cr, r); err != nil {
+		return err
+	}
+	if err = labelPgPods(cm.Data["primary"], pods, r); err != nil {
+		return err
+	}
+	if err = reconcileService(cr, r, newPgReadServiceCr(component, cr)); err != nil {
+		return err
+	}
+	return reconcilePDB(cr, r, newPgPDBCr(component, cr))
+}
+
+// pgHAObjects are the objects only deployed along with replicas.
+func pgHAObjects(component string, cr *gitifold.VCS) []managedObject {
+	name, _ := pgLabelNames(component, cr)
+	return []managedObject{
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: pgHAName(component, cr)}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: pgReadServiceName(component, cr)}},
+		&policyv1beta1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: name}},
+	}
+}
+
+func pgPods(component string, cr *gitifold.VCS, r *VCSReconciler) (map[string]*corev1.Pod, error) {
+	_, labels := pgLabelNames(component, cr)
+	list := &corev1.PodList{}
+	if err := r.Client.List(context.TODO(), list, client.InNamespace(cr.Namespace), client.MatchingLabels(labels)); err != nil {
+		return nil, err
+	}
+	pods := make(map[string]*corev1.Pod, len(list.Items))
+	for i := range list.Items {
+		pods[list.Items[i].Name] = &list.Items[i]
+	}
+	return pods, nil
+}
+
+func podReady(pod *corev1.Pod) (bool, time.Time) {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue, c.LastTransitionTime.Time
+		}
+	}
+	return false, pod.CreationTimestamp.Time
+}
+
+// failoverPg moves writes to a replica when the primary is being deleted,
+// like during a drain, or has not been ready for pgFailoverTimeout.
+func failoverPg(component string, cm *corev1.ConfigMap, pods map[string]*corev1.Pod, cr *gitifold.VCS, r *VCSReconciler) error {
+	primary, ok := pods[cm.Data["primary"]]
+	if !ok {
+		// about to be created again by the StatefulSet
+		return nil
+	}
+
+	reason := "primary is shutting down"
+	if primary.DeletionTimestamp == nil {
+		ready, since := podReady(primary)
+		if ready {
+			return nil
+		}
+		if failedOver, err := time.Parse(time.RFC3339, cm.Annotations[pgFailoverTimeAnnotation]); err == nil && failedOver.After(since) {
+			since = failedOver
+		}
+		if wait := pgFailoverTimeout - time.Since(since); wait > 0 {
+			return &requeueError{reason: component + " postgres primary not ready", after: wait}
+		}
+		reason = "primary not ready for " + pgFailoverTimeout.String()
+	}
+
+	candidate := pgFailoverCandidate(component, primary, pods, cr, r)
+	if candidate == "" {
+		return &requeueError{reason: component + " postgres has no ready replica to fail over to", after: 10 * time.Second}
+	}
+	return switchPgPrimary(component, cm, pods, candidate, reason, cr, r)
+}
+
+// pgFailoverCandidate picks the ready replica with the least lag, as last
+// seen by the primary, the first one when the lag is not known.
+func pgFailoverCandidate(component string, primary *corev1.Pod, pods map[string]*corev1.Pod, cr *gitifold.VCS, r *VCSReconciler) string {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	lag, err := pgReplicationLag(primary)
+	if err != nil {
+		logger.Info("Replication lag not available, using the last known", "Instance", component, "Error", err.Error())
+		lag = map[string]int64{}
+		for _, status := range cr.Status.Postgres {
+			if status.Name != component {
+				continue
+			}
+			for _, replica := range status.Replicas {
+				if replica.Streaming {
+					lag[replica.Name] = replica.LagBytes
+				}
+			}
+		}
+	}
+
+	candidates := []string{}
+	for name, pod := range pods {
+		ready, _ := podReady(pod)
+		if name == primary.Name || !ready || pod.DeletionTimestamp != nil || pgOrdinal(name) > pgSpec(component, cr).Replicas {
+			continue
+		}
+		candidates = append(candidates, name)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		li, iok := lag[candidates[i]]
+		lj, jok := lag[candidates[j]]
+		if iok != jok {
+			return iok
+		}
+		if li != lj {
+			return li < lj
+		}
+		return pgOrdinal(candidates[i]) < pgOrdinal(candidates[j])
+	})
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0]
+}
+
+// switchPgPrimary names the new primary, the pods are restarted into their
+// new roles by finishPgFailover.
+func switchPgPrimary(component string, cm *corev1.ConfigMap, pods map[string]*corev1.Pod, candidate, reason string, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	previous := cm.Data["primary"]
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	cm.Annotations[pgFailoverTimeAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	cm.Annotations[pgFenceAnnotation] = ""
+	if pod, ok := pods[previous]; ok {
+		cm.Annotations[pgFenceAnnotation] = string(pod.UID)
+	}
+	cm.Annotations[pgPromoteAnnotation] = ""
+	if pod, ok := pods[candidate]; ok {
+		cm.Annotations[pgPromoteAnnotation] = string(pod.UID)
+	}
+	cm.Data["primary"] = candidate
+	if err := r.Client.Update(context.TODO(), cm); err != nil {
+		return err
+	}
+	logger.Info("Postgres failing over", "Instance", component, "From", previous, "To", candidate, "Reason", reason)
+
+	// the former primary stops taking writes through the Service right away
+	if err := labelPgPods(candidate, pods, r); err != nil {
+		return err
+	}
+	return &requeueError{reason: component + " postgres failing over to " + candidate, after: 2 * time.Second}
+}
+
+// finishPgFailover stops the former primary, and only then restarts the new
+// one out of recovery, so there never are two primaries.
+func finishPgFailover(component string, cm *corev1.ConfigMap, pods map[string]*corev1.Pod, cr *gitifold.VCS, r *VCSReconciler) error {
+	fence, promote := cm.Annotations[pgFenceAnnotation], cm.Annotations[pgPromoteAnnotation]
+	if fence == "" && promote == "" {
+		return nil
+	}
+
+	for _, pod := range pods {
+		if fence != "" && string(pod.UID) == fence {
+			if pod.DeletionTimestamp == nil {
+				if err := deleteObject("Pod", cr, r, pod); err != nil {
+					return err
+				}
+			}
+			// A pod past its grace period is stuck on a node that does not
+			// answer, and may still be taking writes. Only the operator can
+			// tell, so promoting waits until they force-delete it.
+			if pod.DeletionTimestamp != nil && pod.DeletionTimestamp.Time.Before(time.Now()) {
+				return pgFenceStuckError(component, pod, cm.Data["primary"], r)
+			}
+			return &requeueError{reason: "waiting for the former " + component + " postgres primary " + pod.Name + " to stop", after: 5 * time.Second}
+		}
+	}
+	for _, pod := range pods {
+		if promote != "" && string(pod.UID) == promote {
+			if pod.DeletionTimestamp == nil {
+				if err := deleteObject("Pod", cr, r, pod); err != nil {
+					return err
+				}
+			}
+			return &requeueError{reason: "restarting " + pod.Name + " as the " + component + " postgres primary", after: 5 * time.Second}
+		}
+	}
+
+	delete(cm.Annotations, pgFenceAnnotation)
+	delete(cm.Annotations, pgPromoteAnnotation)
+	return r.Client.Update(context.TODO(), cm)
+}
+
+// pgFenceStuckError asks the operator to force-delete a former primary that
+// is stuck terminating, naming the state of its node.
+func pgFenceStuckError(component string, pod *corev1.Pod, candidate string, r *VCSReconciler) error {
+	state := "is not ready"
+	node := &corev1.Node{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: pod.Spec.NodeName}, node)
+	switch {
+	case errors.IsNotFound(err):
+		state = "is gone"
+	case err != nil:
+		return err
+	case nodeReady(node):
+		state = "is ready but has not stopped it"
+	}
+	return &requeueError{
+		reason: fmt.Sprintf("former %s postgres primary %s is stuck terminating and node %q %s, "+
+			"%s is promoted once the pod is force-deleted (kubectl delete pod %s --grace-period=0 --force), "+
+			"do so only once the node is confirmed down",
+			component, pod.Name, pod.Spec.NodeName, state, candidate, pod.Name),
+		after:    30 * time.Second,
+		degraded: true,
+	}
+}
+
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func labelPgPods(primary string, pods map[string]*corev1.Pod, r *VCSReconciler) error {
+	for name, pod := range pods {
+		role := "replica"
+		if name == primary {
+			role = "primary"
+		}
+		if pod.Labels[pgRoleLabel] == role {
+			continue
+		}
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		pod.Labels[pgRoleLabel] = role
+		if err := r.Client.Update(context.TODO(), pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pgReplicationLag scrapes the replay lag of every replica, by application
+// name, off the exporter of the primary.
+func pgReplicationLag(primary *corev1.Pod) (map[string]int64, error) {
+	if primary.Status.PodIP == "" {
+		return nil, fmt.Errorf("pod %s has no IP", primary.Name)
+	}
+	httpClient := &http.Client{Timeout: 3 * time.Second}
+	resp, err := httpClient.Get("http://" + primary.Status.PodIP + ":9187/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("exporter of %s returned %s", primary.Name, resp.Status)
+	}
+
+	lag := map[string]int64{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "pg_stat_replication_pg_wal_lsn_diff{") {
+			continue
+		}
+		start := strings.Index(line, `application_name="`)
+		end := strings.LastIndex(line, "}")
+		if start < 0 || end < 0 {
+			continue
+		}
+		name := line[start+len(`application_name="`):]
+		name = name[:strings.Index(name, `"`)]
+		value, err := strconv.ParseFloat(strings.TrimSpace(line[end+1:]), 64)
+		if err != nil {
+			continue
+		}
+		lag[name] = int64(value)
+	}
+	return lag, scanner.Err()
+}
+
+// pgReplicationStatus reports the primary and the replicas of an instance
+// for the VCS status.
+func pgReplicationStatus(component string, cr *gitifold.VCS, r *VCSReconciler) (gitifold.PostgresStatus, error) {
+	status := gitifold.PostgresStatus{Name: component}
+
+	cm := &corev1.ConfigMap{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: pgHAName(component, cr), Namespace: cr.Namespace}, cm)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return status, nil
+		}
+		return status, err
+	}
+	status.Primary = cm.Data["primary"]
+	if failedOver, err := time.Parse(time.RFC3339, cm.Annotations[pgFailoverTimeAnnotation]); err == nil {
+		t := metav1.NewTime(failedOver)
+		status.LastFailoverTime = &t
+	}
+
+	pods, err := pgPods(component, cr, r)
+	if err != nil {
+		return status, err
+	}
+	lag := map[string]int64{}
+	if primary, ok := pods[status.Primary]; ok {
+		// lag is left out while the exporter can not be reached
+		lag, _ = pgReplicationLag(primary)
+	}
+	for ordinal := int32(0); ordinal <= pgSpec(component, cr).Replicas; ordinal++ {
+		name := pgPodName(component, ordinal, cr)
+		if name == status.Primary {
+			continue
+		}
+		replicaLag, streaming := lag[name]
+		status.Replicas = append(status.Replicas, gitifold.PostgresReplicaStatus{
+			Name:      name,
+			Streaming: streaming,
+			LagBytes:  replicaLag,
+		})
+	}
+	return status, nil
+}
+
+func newPgHAConfigMapCr(component, primary string, cr *gitifold.VCS) *corev1.ConfigMap {
+	_, labels := pgLabelNames(component, cr)
+
+	return &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pgHAName(component, cr),
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Data: map[string]string{
+			"primary": primary,
+		},
+	}
+}
+
+func newPgReadServiceCr(component string, cr *gitifold.VCS) *corev1.Service {
+	_, labels := pgLabelNames(component, cr)
+	selector := map[string]string{pgRoleLabel: "replica"}
+	for key, value := range labels {
+		selector[key] = value
+	}
+
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pgReadServiceName(component, cr),
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: selector,
+			Type:     "ClusterIP",
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "postgres",
+					Protocol:   "TCP",
+					Port:       5432,
+					TargetPort: intstr.FromString("postgres"),
+				},
+			},
+		},
+	}
+}
+
+func newPgPDBCr(component string, cr *gitifold.VCS) *policyv1beta1.PodDisruptionBudget {
+	name, labels := pgLabelNames(component, cr)
+	maxUnavailable := intstr.FromInt(1)
+
+	return &policyv1beta1.PodDisruptionBudget{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "policy/v1beta1",
+			Kind:       "PodDisruptionBudget",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+		},
+	}
+}
+
+// pgHAPodSpec turns the postgres container into one starting as either the
+// primary or a replica, and spreads the pods across nodes unless told
+// otherwise.
+func pgHAPodSpec(component string, pod *corev1.PodSpec, cr *gitifold.VCS) {
+	name, labels := pgLabelNames(component, cr)
+
+	pod.Volumes = append(pod.Volumes, corev1.Volume{
+		Name: "ha",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: pgHAName(component, cr),
+				},
+			},
+		},
+	})
+	for i := range pod.Containers {
+		container := &pod.Containers[i]
+		if container.Name != "postgres" {
+			continue
+		}
+		// the arguments set by pgConfigPodSpec follow $0
+		container.Command = []string{"/bin/sh", "-c", pgHAScript, "--"}
+		// a smart shutdown waits on the pooled connections until killed,
+		// leaving a primary that can not be rewound
+		container.Lifecycle = &corev1.Lifecycle{
+			PreStop: &corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"/bin/sh", "-c", "su-exec postgres pg_ctl stop -m fast"},
+				},
+			},
+		}
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  "PRIMARY_HOST",
+			Value: name,
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "ha",
+			MountPath: pgHADir,
+			ReadOnly:  true,
+		})
+	}
+
+	if pod.Affinity == nil {
+		pod.Affinity = &corev1.Affinity{
+			PodAntiAffinity: &corev1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+					{
+						Weight: 100,
+						PodAffinityTerm: corev1.PodAffinityTerm{
+							LabelSelector: &metav1.LabelSelector{
+								MatchLabels: labels,
+							},
+							TopologyKey: "kubernetes.io/hostname",
+						},
+					},
+				},
+			},
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestFinishPgFailover(t *testing.T) {
+	past := metav1.NewTime(time.Now().Add(-time.Minute))
+	future := metav1.NewTime(time.Now().Add(time.Minute))
+	node := func(ready corev1.ConditionStatus) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+			Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: ready},
+			}},
+		}
+	}
+	tests := []struct {
+		name string
+		// nil when the former primary is gone
+		deleting *metav1.Time
+		fenced   bool
+		node     *corev1.Node
+		// whether the wait shows in the status, and what it says
+		degraded   bool
+		message    string
+		wantFenced bool
+		promoted   bool
+	}{
+		{
+			name:       "running primary is stopped first",
+			fenced:     true,
+			wantFenced: false,
+		},
+		{
+			name:       "within the grace period",
+			fenced:     true,
+			deleting:   &future,
+			wantFenced: true,
+		},
+		{
+			name:       "stuck on a NotReady node",
+			fenced:     true,
+			deleting:   &past,
+			node:       node(corev1.ConditionUnknown),
+			degraded:   true,
+			message:    `node "node-a" is not ready`,
+			wantFenced: true,
+		},
+		{
+			name:       "stuck on a ready node",
+			fenced:     true,
+			deleting:   &past,
+			node:       node(corev1.ConditionTrue),
+			degraded:   true,
+			message:    `node "node-a" is ready`,
+			wantFenced: true,
+		},
+		{
+			name:       "stuck on a removed node",
+			fenced:     true,
+			deleting:   &past,
+			degraded:   true,
+			message:    `node "node-a" is gone`,
+			wantFenced: true,
+		},
+		{
+			name:     "force-deleted",
+			promoted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			primary, candidate := pgPodName("gitea", 0, cr), pgPodName("gitea", 1, cr)
+			newPod := func(name, uid string) *corev1.Pod {
+				return &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cr.Namespace, UID: types.UID(uid)},
+					Spec:       corev1.PodSpec{NodeName: "node-a"},
+				}
+			}
+			pods := map[string]*corev1.Pod{candidate: newPod(candidate, "promote")}
+			objs := []runtime.Object{pods[candidate]}
+			if tt.fenced {
+				pods[primary] = newPod(primary, "fence")
+				pods[primary].DeletionTimestamp = tt.deleting
+				objs = append(objs, pods[primary])
+			}
+			if tt.node != nil {
+				objs = append(objs, tt.node)
+			}
+			cm := newPgHAConfigMapCr("gitea", candidate, cr)
+			cm.Annotations = map[string]string{pgFenceAnnotation: "fence", pgPromoteAnnotation: "promote"}
+			objs = append(objs, cm)
+			r := testReconciler(objs...)
+
+			err := finishPgFailover("gitea", cm, pods, cr, r)
+			wait, ok := err.(*requeueError)
+			if !ok {
+				t.Fatalf("finishPgFailover() = %v, want a requeue", err)
+			}
+			if wait.degraded != tt.degraded {
+				t.Errorf("degraded = %v, want %v: %s", wait.degraded, tt.degraded, wait.reason)
+			}
+			if !strings.Contains(wait.reason, tt.message) {
+				t.Errorf("reason %q does not mention %q", wait.reason, tt.message)
+			}
+
+			if tt.fenced {
+				err = r.Client.Get(context.TODO(), types.NamespacedName{Name: primary, Namespace: cr.Namespace}, &corev1.Pod{})
+				if exists := !errors.IsNotFound(err); exists != tt.wantFenced {
+					t.Errorf("former primary exists = %v, want %v", exists, tt.wantFenced)
+				}
+			}
+			err = r.Client.Get(context.TODO(), types.NamespacedName{Name: candidate, Namespace: cr.Namespace}, &corev1.Pod{})
+			if restarted := errors.IsNotFound(err); restarted != tt.promoted {
+				t.Errorf("candidate restarted = %v, want %v", restarted, tt.promoted)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pgParameter is a parameter which may be set, and whether postgres has to
+// be restarted for it to apply, the others are reloaded.
+type pgParameter struct {
+	restart bool
+	// valid checks a value, the error tells what is expected instead
+	valid func(string) error
+}
+
+var (
+	pgIntegerValue  = regexp.MustCompile(`^-?[0-9]+$`)
+	pgRealValue     = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	pgMemoryValue   = regexp.MustCompile(`^(-?[0-9]+(\.[0-9]+)?)\s*(B|kB|MB|GB|TB)?$`)
+	pgDurationValue = regexp.MustCompile(`^(-?[0-9]+(\.[0-9]+)?)\s*(us|ms|s|min|h|d)?$`)
+)
+
+// pgMemoryUnits and pgDurationUnits are the units postgres takes, in kB and
+// ms, along with the 8kB blocks some sizes are counted in.
+var (
+	pgMemoryUnits   = map[string]float64{"B": 1.0 / 1024, "kB": 1, "8kB": 8, "MB": 1024, "GB": 1024 * 1024, "TB": 1024 * 1024 * 1024}
+	pgDurationUnits = map[string]float64{"us": 0.001, "ms": 1, "s": 1000, "min": 60 * 1000, "h": 60 * 60 * 1000, "d": 24 * 60 * 60 * 1000}
+)
+
+// pgInteger accepts whole numbers of at least min.
+func pgInteger(min int64) func(string) error {
+	return func(value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || !pgIntegerValue.MatchString(value) {
+			return fmt.Errorf("a whole number is expected")
+		}
+		if n < min {
+			return fmt.Errorf("the minimum is %d", min)
+		}
+		return nil
+	}
+}
+
+func pgReal(value string) error {
+	if !pgRealValue.MatchString(value) {
+		return fmt.Errorf("a positive number is expected")
+	}
+	return nil
+}
+
+// pgMemory accepts sizes of at least min, a number without a unit counts in
+// unit, as it does for postgres.
+func pgMemory(unit, min string) func(string) error {
+	return pgQuantity(pgMemoryValue, pgMemoryUnits, "size", unit, min)
+}
+
+// pgDuration accepts durations of at least min, a number without a unit
+// counts in unit, as it does for postgres.
+func pgDuration(unit, min string) func(string) error {
+	return pgQuantity(pgDurationValue, pgDurationUnits, "duration", unit, min)
+}
+
+func pgQuantity(pattern *regexp.Regexp, units map[string]float64, kind, unit, min string) func(string) error {
+	minimum, _ := pgQuantityValue(pattern, units, unit, min)
+	return func(value string) error {
+		n, ok := pgQuantityValue(pattern, units, unit, value)
+		if !ok {
+			return fmt.Errorf("a %s is expected", kind)
+		}
+		if n < minimum {
+			return fmt.Errorf("the minimum is %s", min)
+		}
+		return nil
+	}
+}
+
+// pgQuantityValue reads value in unit.
+func pgQuantityValue(pattern *regexp.Regexp, units map[string]float64, unit, value string) (float64, bool) {
+	match := pattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	if match[3] != "" {
+		n = n * units[match[3]] / units[unit]
+	}
+	return n, true
+}
+
+func pgOneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if strings.EqualFold(value, v) {
+				return nil
+			}
+		}
+		return fmt.Errorf("one of %s is expected", strings.Join(values, ", "))
+	}
+}
+
+var pgBoolValue = pgOneOf("on", "off", "true", "false", "yes", "no", "1", "0")
+
+// pgParameterSpecs lists the parameters which may be set, with the lowest
+// value postgres starts with. Those the operator sets itself, like hba_file
+// or archive_command, are left out.
+var pgParameterSpecs = map[string]pgParameter{
+	"max_connections":                     {true, pgInteger(1)},
+	"shared_buffers":                      {true, pgMemory("8kB", "128kB")},
+	"huge_pages":                          {true, pgOneOf("on", "off", "try")},
+	"wal_buffers":                         {true, pgMemory("8kB", "-1")},
+	"max_worker_processes":                {true, pgInteger(0)},
+	"max_locks_per_transaction":           {true, pgInteger(10)},
+	"max_pred_locks_per_transaction":      {true, pgInteger(10)},
+	"max_prepared_transactions":           {true, pgInteger(0)},
+	"max_files_per_process":               {true, pgInteger(64)},
+	"autovacuum_max_workers":              {true, pgInteger(1)},
+	"track_activity_query_size":           {true, pgMemory("B", "100B")},
+	"work_mem":                            {false, pgMemory("kB", "64kB")},
+	"maintenance_work_mem":                {false, pgMemory("kB", "1MB")},
+	"autovacuum_work_mem":                 {false, pgMemory("kB", "-1")},
+	"temp_buffers":                        {false, pgMemory("8kB", "800kB")},
+	"effective_cache_size":                {false, pgMemory("8kB", "8kB")},
+	"effective_io_concurrency":            {false, pgInteger(0)},
+	"random_page_cost":                    {false, pgReal},
+	"seq_page_cost":                       {false, pgReal},
+	"default_statistics_target":           {false, pgInteger(1)},
+	"jit":                                 {false, pgBoolValue},
+	"max_parallel_workers":                {false, pgInteger(0)},
+	"max_parallel_workers_per_gather":     {false, pgInteger(0)},
+	"max_parallel_maintenance_workers":    {false, pgInteger(0)},
+	"checkpoint_timeout":                  {false, pgDuration("s", "30s")},
+	"checkpoint_completion_target":        {false, pgReal},
+	"max_wal_size":                        {false, pgMemory("MB", "2MB")},
+	"min_wal_size":                        {false, pgMemory("MB", "2MB")},
+	"wal_compression":                     {false, pgBoolValue},
+	"synchronous_commit":                  {false, pgOneOf("on", "off", "local", "remote_write", "remote_apply")},
+	"commit_delay":                        {false, pgInteger(0)},
+	"statement_timeout":                   {false, pgDuration("ms", "0")},
+	"lock_timeout":                        {false, pgDuration("ms", "0")},
+	"idle_in_transaction_session_timeout": {false, pgDuration("ms", "0")},
+	"deadlock_timeout":                    {false, pgDuration("ms", "1ms")},
+	"autovacuum":                          {false, pgBoolValue},
+	"autovacuum_naptime":                  {false, pgDuration("s", "1s")},
+	"autovacuum_vacuum_scale_factor":      {false, pgReal},
+	"autovacuum_analyze_scale_factor":     {false, pgReal},
+	"autovacuum_vacuum_cost_delay":        {false, pgDuration("ms", "-1")},
+	"autovacuum_vacuum_cost_limit":        {false, pgInteger(-1)},
+	"log_min_duration_statement":          {false, pgDuration("ms", "-1")},
+	"log_autovacuum_min_duration":         {false, pgDuration("ms", "-1")},
+	"log_checkpoints":                     {false, pgBoolValue},
+	"log_connections":                     {false, pgBoolValue},
+	"log_disconnections":                  {false, pgBoolValue},
+	"log_lock_waits":                      {false, pgBoolValue},
+	"log_temp_files":                      {false, pgMemory("kB", "-1")},
+}
+
+// pgStandbyParameters can not be lower on a standby than on its primary, a
+// standby started with less refuses to run. They default to these.
+var pgStandbyParameters = map[string]int64{
+	"max_connections":           100,
+	"max_worker_processes":      8,
+	"max_prepared_transactions": 0,
+	"max_locks_per_transaction": 64,
+}
+
+// pgReloadScript reloads postgres whenever the mounted postgresql.conf
+// changes, the kubelet updates it a while after the ConfigMap.
+const pgReloadScript = `CONF=` + pgConfigDir + `/postgresql.conf
+LAST=$(md5sum "${CONF}")
+while sleep 10 ; do
+	CURRENT=$(md5sum "${CONF}")
+	if [ "${CURRENT}" != "${LAST}" ] && psql -h /run/postgresql -U "${POSTGRES_USER}" -d postgres -qtAc 'SELECT pg_reload_conf()' ; then
+		LAST="${CURRENT}"
+	fi
+done
+`
+
+// validatePgParameters refuses the parameters which are not known to be
+// safe to set, or whose value postgres would not start with.
+func validatePgParameters(component string, cr *gitifold.VCS) error {
+	for name, value := range pgSpec(component, cr).Parameters {
+		parameter, ok := pgParameterSpecs[name]
+		if !ok {
+			return fmt.Errorf("postgres parameter %s is not supported", name)
+		}
+		if err := parameter.valid(value); err != nil {
+			return fmt.Errorf("postgres parameter %s can not be set to %q, %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// validatePgStandbyParameters refuses to lower the parameters a standby needs
+// at least as high as its primary while the instance has replicas, the
+// replicas restart first and would not come back. live is the ConfigMap
+// applied, nil before there is one.
+func validatePgStandbyParameters(component string, live *corev1.ConfigMap, cr *gitifold.VCS) error {
+	if live == nil || pgSpec(component, cr).Replicas == 0 {
+		return nil
+	}
+	applied := pgReadParameters(live.Data["postgresql.conf"])
+	desired := pgParameters(component, cr)
+	for name, defaultValue := range pgStandbyParameters {
+		from, to := defaultValue, defaultValue
+		if n, err := strconv.ParseInt(applied[name], 10, 64); err == nil {
+			from = n
+		}
+		if n, err := strconv.ParseInt(desired[name], 10, 64); err == nil {
+			to = n
+		}
+		if to < from {
+			return fmt.Errorf("postgres parameter %s can not be lowered from %d to %d while the instance has replicas", name, from, to)
+		}
+	}
+	return nil
+}
+
+// pgParameters are the parameters asked for, over defaults sized to the
+// memory limit of postgres. Instances without any parameters keep running
+// with the configuration of the image.
+func pgParameters(component string, cr *gitifold.VCS) map[string]string {
+	parameters := map[string]string{}
+	if len(pgSpec(component, cr).Parameters) == 0 {
+		return parameters
+	}
+
+	resources := pgResources(component, cr)
+	if limit, ok := resources.Limits[corev1.ResourceMemory]; ok && !limit.IsZero() {
+		memory := limit.Value() / 1024
+		connections := int64(100)
+		if n, err := strconv.ParseInt(pgSpec(component, cr).Parameters["max_connections"], 10, 64); err == nil && n > 0 {
+			connections = n
+		}
+		workMem := (memory - memory/4) / (connections * 3)
+		if workMem < 4096 {
+			workMem = 4096
+		}
+		parameters["shared_buffers"] = fmt.Sprintf("%dkB", memory/4)
+		parameters["effective_cache_size"] = fmt.Sprintf("%dkB", memory*3/4)
+		parameters["maintenance_work_mem"] = fmt.Sprintf("%dkB", memory/16)
+		parameters["work_mem"] = fmt.Sprintf("%dkB", workMem)
+	}
+
+	for name, value := range pgSpec(component, cr).Parameters {
+		parameters[name] = value
+	}
+	return parameters
+}
+
+// pgRestartParameters are the parameters which roll the pods when changed.
+func pgRestartParameters(component string, cr *gitifold.VCS) []byte {
+	return []byte(pgRenderParameters(pgParameters(component, cr), true))
+}
+
+// pgPostgresqlConf is the postgresql.conf postgres is started with, it reads
+// the one in the data directory first. Settings made with ALTER SYSTEM still
+// take precedence.
+func pgPostgresqlConf(component string, cr *gitifold.VCS) string {
+	return "include_if_exists '" + pgDataDir + "/postgresql.conf'\n" +
+		pgRenderParameters(pgParameters(component, cr), false)
+}
+
+// pgRenderParameters renders parameters into postgresql.conf lines, only
+// those needing a restart when restartOnly.
+func pgRenderParameters(parameters map[string]string, restartOnly bool) string {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		if !restartOnly || pgParameterSpecs[name].restart {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	conf := ""
+	for _, name := range names {
+		conf += name + " = '" + strings.Replace(parameters[name], "'", "''", -1) + "'\n"
+	}
+	return conf
+}
+
+// pgReadParameters reads back the parameters pgRenderParameters rendered.
+func pgReadParameters(conf string) map[string]string {
+	parameters := map[string]string{}
+	for _, line := range strings.Split(conf, "\n") {
+		parts := strings.SplitN(line, " = ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSuffix(strings.TrimPrefix(parts[1], "'"), "'")
+		parameters[parts[0]] = strings.Replace(value, "''", "'", -1)
+	}
+	return parameters
+}
+
+// pgReloadPodSpec runs a sidecar next to postgres reloading it when a
+// parameter changes.
+func pgReloadPodSpec(component string, pod *corev1.PodSpec, cr *gitifold.VCS) {
+	name, _ := pgLabelNames(component, cr)
+	image, pullPolicy := pgContainerImage(component, cr)
+
+	limitCpu, _ := resource.ParseQuantity("50m")
+	limitMemory, _ := resource.ParseQuantity("32Mi")
+	requestCpu, _ := resource.ParseQuantity("5m")
+	requestMemory, _ := resource.ParseQuantity("8Mi")
+
+	pod.Containers = append(pod.Containers, corev1.Container{
+		Name:            "reload",
+		Image:           image,
+		ImagePullPolicy: pullPolicy,
+		Command:         []string{"/bin/sh", "-c", pgReloadScript},
+		Env: []corev1.EnvVar{
+			{
+				Name: "POSTGRES_USER",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: name,
+						},
+						Key: "db_user",
+					},
+				},
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "runner",
+				MountPath: "/run",
+			},
+			{
+				Name:      "config",
+				MountPath: pgConfigDir,
+				ReadOnly:  true,
+			},
+		},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				"cpu":    limitCpu,
+				"memory": limitMemory,
+			},
+			Requests: corev1.ResourceList{
+				"cpu":    requestCpu,
+				"memory": requestMemory,
+			},
+		},
+	})
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestPgParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		memory     string
+		want       map[string]string
+	}{
+		{name: "none", memory: "1Gi", want: map[string]string{}},
+		{
+			name:       "defaults from the memory limit",
+			parameters: map[string]string{"jit": "off"},
+			memory:     "1Gi",
+			want: map[string]string{
+				"jit":                  "off",
+				"shared_buffers":       "262144kB",
+				"effective_cache_size": "786432kB",
+				"maintenance_work_mem": "65536kB",
+				"work_mem":             "4096kB",
+			},
+		},
+		{
+			name:       "set over the defaults",
+			parameters: map[string]string{"shared_buffers": "128MB", "max_connections": "20"},
+			memory:     "1Gi",
+			want: map[string]string{
+				"max_connections":      "20",
+				"shared_buffers":       "128MB",
+				"effective_cache_size": "786432kB",
+				"maintenance_work_mem": "65536kB",
+				"work_mem":             "13107kB",
+			},
+		},
+		{
+			name:       "no memory limit",
+			parameters: map[string]string{"work_mem": "16MB"},
+			want:       map[string]string{"work_mem": "16MB"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			cr.Spec.Git.Postgres.Parameters = tt.parameters
+			cr.Spec.Git.Postgres.Resources = &corev1.ResourceRequirements{Limits: corev1.ResourceList{}}
+			if tt.memory != "" {
+				cr.Spec.Git.Postgres.Resources.Limits[corev1.ResourceMemory] = resource.MustParse(tt.memory)
+			}
+			got := pgParameters("gitea", cr)
+			if len(got) != len(tt.want) {
+				t.Errorf("pgParameters() = %v, want %v", got, tt.want)
+			}
+			for name, value := range tt.want {
+				if got[name] != value {
+					t.Errorf("pgParameters()[%s] = %q, want %q", name, got[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestValidatePgParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		wantErr    bool
+	}{
+		{name: "none"},
+		{name: "integer", parameters: map[string]string{"max_connections": "200"}},
+		{name: "memory", parameters: map[string]string{"work_mem": "16MB", "shared_buffers": "1GB"}},
+		{name: "memory without unit", parameters: map[string]string{"wal_buffers": "-1"}},
+		{name: "memory in blocks", parameters: map[string]string{"shared_buffers": "16"}},
+		{name: "disabled", parameters: map[string]string{"log_temp_files": "-1", "log_min_duration_statement": "-1"}},
+		{name: "zero where allowed", parameters: map[string]string{"max_prepared_transactions": "0", "statement_timeout": "0"}},
+		{name: "duration", parameters: map[string]string{"statement_timeout": "30s", "checkpoint_timeout": "5min"}},
+		{name: "real", parameters: map[string]string{"random_page_cost": "1.1"}},
+		{name: "bool", parameters: map[string]string{"jit": "Off", "autovacuum": "on"}},
+		{name: "enum", parameters: map[string]string{"synchronous_commit": "remote_apply", "huge_pages": "try"}},
+		{name: "unsupported", parameters: map[string]string{"archive_command": "true"}, wantErr: true},
+		{name: "integer with unit", parameters: map[string]string{"max_connections": "200MB"}, wantErr: true},
+		{name: "unknown memory unit", parameters: map[string]string{"work_mem": "16M"}, wantErr: true},
+		{name: "unknown duration unit", parameters: map[string]string{"lock_timeout": "5sec"}, wantErr: true},
+		{name: "not a bool", parameters: map[string]string{"jit": "maybe"}, wantErr: true},
+		{name: "not in the enum", parameters: map[string]string{"huge_pages": "always"}, wantErr: true},
+		{name: "no connections", parameters: map[string]string{"max_connections": "0"}, wantErr: true},
+		{name: "negative connections", parameters: map[string]string{"max_connections": "-5"}, wantErr: true},
+		{name: "no memory", parameters: map[string]string{"work_mem": "0"}, wantErr: true},
+		{name: "negative memory", parameters: map[string]string{"shared_buffers": "-1"}, wantErr: true},
+		{name: "memory below the minimum", parameters: map[string]string{"shared_buffers": "64kB"}, wantErr: true},
+		{name: "blocks below the minimum", parameters: map[string]string{"shared_buffers": "15"}, wantErr: true},
+		{name: "below disabled", parameters: map[string]string{"wal_buffers": "-2"}, wantErr: true},
+		{name: "duration below the minimum", parameters: map[string]string{"checkpoint_timeout": "10s"}, wantErr: true},
+		{name: "several lines", parameters: map[string]string{"work_mem": "16MB\nfsync = off"}, wantErr: true},
+		{name: "quoted", parameters: map[string]string{"work_mem": "16MB'"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			cr.Spec.Git.Postgres.Parameters = tt.parameters
+			err := validatePgParameters("gitea", cr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePgParameters() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePgStandbyParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		replicas   int32
+		applied    map[string]string
+		parameters map[string]string
+		noLive     bool
+		wantErr    bool
+	}{
+		{name: "raised", replicas: 1, applied: map[string]string{"max_connections": "100"}, parameters: map[string]string{"max_connections": "200"}},
+		{name: "lowered", replicas: 1, applied: map[string]string{"max_connections": "200"}, parameters: map[string]string{"max_connections": "100"}, wantErr: true},
+		{name: "unset lowers to the default", replicas: 1, applied: map[string]string{"max_worker_processes": "16"}, parameters: map[string]string{"jit": "off"}, wantErr: true},
+		{name: "lowered below the default", replicas: 1, parameters: map[string]string{"max_locks_per_transaction": "32"}, wantErr: true},
+		{name: "lowered without replicas", applied: map[string]string{"max_connections": "200"}, parameters: map[string]string{"max_connections": "100"}},
+		{name: "first install", replicas: 1, noLive: true, parameters: map[string]string{"max_connections": "50"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			cr.Spec.Git.Postgres.Replicas = tt.replicas
+			var live *corev1.ConfigMap
+			if !tt.noLive {
+				applied := testVCS()
+				applied.Spec.Git.Postgres.Parameters = tt.applied
+				live = newPgConfigMapCr("gitea", applied)
+			}
+			cr.Spec.Git.Postgres.Parameters = tt.parameters
+			err := validatePgStandbyParameters("gitea", live, cr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePgStandbyParameters() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePgParametersMessage(t *testing.T) {
+	cr := testVCS()
+	cr.Spec.Git.Postgres.Parameters = map[string]string{"shared_buffers": "1kB"}
+	err := validatePgParameters("gitea", cr)
+	if err == nil || !strings.Contains(err.Error(), "the minimum is 128kB") {
+		t.Errorf("validatePgParameters() = %v, want the minimum", err)
+	}
+}
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pgPoolerDir is where the PgBouncer image reads its config from.
+const pgPoolerDir = "/etc/pgbouncer"
+
+// pgPoolerGID is the group PgBouncer runs as in its image, the certificate
+// key is readable to it.
+const pgPoolerGID = int64(70)
+
+func pgPoolerLabelNames(component string, cr *gitifold.VCS) (string, map[string]string) {
+	labels := map[string]string{
+		"app.kubernetes.io/name":       "pgbouncer",
+		"app.kubernetes.io/component":  component,
+		"app.kubernetes.io/deployment": "gitifold",
+		"app.kubernetes.io/instance":   cr.Name,
+	}
+
+	name, _ := pgLabelNames(component, cr)
+
+	return strings.Join([]string{name, "pooler"}, "-"), labels
+}
+
+// pgPoolerObjects are the objects only deployed along with a pooler.
+func pgPoolerObjects(component string, cr *gitifold.VCS) []managedObject {
+	name, _ := pgPoolerLabelNames(component, cr)
+	return []managedObject{
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name}},
+	}
+}
+
+// pgPooledDatabase points the component at the pooler of the instance
+// holding its database, if it has one. Backups and the other maintenance
+// Jobs keep talking to postgres itself.
+func pgPooledDatabase(component string, dbSecret *DBSecret, cr *gitifold.VCS) *DBSecret {
+	instance := pgInstance(component, cr)
+	spec := pgSpec(instance, cr)
+	if spec.External != nil || spec.Pooler == nil {
+		return dbSecret
+	}
+	pooled := *dbSecret
+	pooled.Host, _ = pgPoolerLabelNames(instance, cr)
+	return &pooled
+}
+
+// reconcilePgPooler deploys PgBouncer in front of an instance, or removes it.
+// It signs in as the superuser in secret, and looks up the roles of the
+// shared databases with it.
+func reconcilePgPooler(component string, secret *corev1.Secret, tlsHash string, cr *gitifold.VCS, r *VCSReconciler) error {
+	if pgSpec(component, cr).Pooler == nil {
+		return deleteObjects(pgPoolerObjects(component, cr), cr, r)
+	}
+
+	config := newPgPoolerSecretCr(component, secret, cr)
+	if err := reconcileSecret(cr, r, config); err != nil {
+		return err
+	}
+	if err := reconcileService(cr, r, newPgPoolerServiceCr(component, cr)); err != nil {
+		return err
+	}
+
+	podConfig := map[string][]byte{
+		"config": []byte(hashData(config.Data)),
+	}
+	if tlsHash != "" {
+		podConfig["tls"] = []byte(tlsHash)
+	}
+	dep := newPgPoolerDeploymentCr(component, cr)
+	dep.Spec.Template.Annotations = map[string]string{
+		configHashAnnotation: hashData(podConfig),
+	}
+	return reconcileDeployment(cr, r, dep)
+}
+
+// pgPoolerConfig is the pgbouncer.ini of an instance.
+func pgPoolerConfig(component, user string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	pooler := pgSpec(component, cr).Pooler
+
+	poolMode := pooler.PoolMode
+	if poolMode == "" {
+		poolMode = "transaction"
+	}
+	poolSize := pooler.DefaultPoolSize
+	if poolSize == 0 {
+		poolSize = 20
+	}
+	maxClientConn := pooler.MaxClientConn
+	if maxClientConn == 0 {
+		maxClientConn = 500
+	}
+
+	config := fmt.Sprintf(`[databases]
+* = host=%s port=5432
+
+[pgbouncer]
+listen_addr = *
+listen_port = 5432
+unix_socket_dir =
+auth_type = md5
+auth_file = %s/userlist.txt
+auth_user = %s
+auth_query = SELECT usename, passwd FROM pg_shadow WHERE usename = $1
+pool_mode = %s
+default_pool_size = %d
+max_client_conn = %d
+max_db_connections = %d
+ignore_startup_parameters = extra_float_digits
+`, name, pgPoolerDir, user, poolMode, poolSize, maxClientConn, pooler.MaxDBConnections)
+
+	if pgTLSEnabled(cr) {
+		config += `server_tls_sslmode = verify-full
+server_tls_ca_file = ` + pgTLSSecretDir + `/ca.crt
+client_tls_sslmode = require
+client_tls_cert_file = ` + pgTLSSecretDir + `/tls.crt
+client_tls_key_file = ` + pgTLSSecretDir + `/tls.key
+`
+	}
+	return config
+}
+
+func newPgPoolerSecretCr(component string, secret *corev1.Secret, cr *gitifold.VCS) *corev1.Secret {
+	name, labels := pgPoolerLabelNames(component, cr)
+	user := string(secret.Data["db_user"])
+
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Data: map[string][]byte{
+			"pgbouncer.ini": []byte(pgPoolerConfig(component, user, cr)),
+			"userlist.txt":  []byte(fmt.Sprintf("%q %q\n", user, secret.Data["db_pass"])),
+		},
+	}
+}
+
+func newPgPoolerServiceCr(component string, cr *gitifold.VCS) *corev1.Service {
+
+	name, labels := pgPoolerLabelNames(component, cr)
+
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Labels:      labels,
+			Annotations: make(map[string]string),
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Type:     "ClusterIP",
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "postgres",
+					Protocol:   "TCP",
+					Port:       5432,
+					TargetPort: intstr.FromString("postgres"),
+				},
+			},
+		},
+	}
+}
+
+func newPgPoolerDeploymentCr(component string, cr *gitifold.VCS) *appsv1.Deployment {
+
+	name, labels := pgPoolerLabelNames(component, cr)
+	pooler := pgSpec(component, cr).Pooler
+	image, pullPolicy := containerImage("pgbouncer", pooler.Image, cr)
+
+	limitCpu, _ := resource.ParseQuantity("500m")
+	limitMemory, _ := resource.ParseQuantity("128Mi")
+	requestCpu, _ := resource.ParseQuantity("10m")
+	requestMemory, _ := resource.ParseQuantity("16Mi")
+
+	rc := pooler.Replicas
+	if rc == 0 {
+		rc = 1
+	}
+	gid := pgPoolerGID
+	fal := false
+
+	volumes := []corev1.Volume{
+		{
+			Name: "config",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: name,
+				},
+			},
+		},
+	}
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "config",
+			MountPath: pgPoolerDir,
+			ReadOnly:  true,
+		},
+	}
+	if pgTLSEnabled(cr) {
+		mode := int32(0440)
+		volumes = append(volumes, corev1.Volume{
+			Name: "tls-secret",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  pgTLSName(component, cr),
+					DefaultMode: &mode,
+				},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      "tls-secret",
+			MountPath: pgTLSSecretDir,
+			ReadOnly:  true,
+		})
+	}
+
+	dep := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Deployment",
+			APIVersion: "apps/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &rc,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+					AutomountServiceAccountToken: &fal,
+					SecurityContext: &corev1.PodSecurityContext{
+						FSGroup: &gid,
+					},
+					Volumes: volumes,
+					Containers: []corev1.Container{
+						{
+							Name:            "pgbouncer",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "postgres",
+									ContainerPort: 5432,
+									Protocol:      "TCP",
+								},
+							},
+							LivenessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									TCPSocket: &corev1.TCPSocketAction{
+										Port: intstr.FromString("postgres"),
+									},
+								},
+								InitialDelaySeconds: int32(10),
+								PeriodSeconds:       int32(10),
+							},
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									TCPSocket: &corev1.TCPSocketAction{
+										Port: intstr.FromString("postgres"),
+									},
+								},
+								InitialDelaySeconds: int32(2),
+								PeriodSeconds:       int32(5),
+							},
+							VolumeMounts: mounts,
+							Resources: workloadResources(pooler.WorkloadSpec, corev1.ResourceRequirements{
+								Limits: corev1.ResourceList{
+									"cpu":    limitCpu,
+									"memory": limitMemory,
+								},
+								Requests: corev1.ResourceList{
+									"cpu":    requestCpu,
+									"memory": requestMemory,
+								},
+							}),
+						},
+					},
+				},
+			},
+		},
+	}
+	schedulePod(pooler.WorkloadSpec, &dep.Spec.Template.Spec)
+	return dep
+}
@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// pgRotateAnnotation on a postgres secret asks for its password to be
+	// rotated right away.
+	pgRotateAnnotation = "gitifold.hyperspike.io/rotate-password"
+	// pgRotatedAnnotation is when the password was last rotated.
+	pgRotatedAnnotation = "gitifold.hyperspike.io/password-rotated"
+)
+
+// pgRotateScript sets the password of the role it connects as to NEW_PASS,
+// it is a no-op when a former run already did.
+const pgRotateScript = `set -e
+if PGPASSWORD="${NEW_PASS}" psql -tAc 'SELECT 1' > /dev/null 2>&1 ; then
+	echo "password already rotated"
+	exit 0
+fi
+psql -v ON_ERROR_STOP=1 -v pass="${NEW_PASS}" <<'EOF'
+ALTER ROLE CURRENT_USER WITH PASSWORD :'pass';
+EOF
+`
+
+func pgRotateJobName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "rotate"}, "-")
+}
+
+// pgPasswordDue tells whether the password in found is to be rotated.
+func pgPasswordDue(found *corev1.Secret, cr *gitifold.VCS) bool {
+	if _, ok := found.Annotations[pgRotateAnnotation]; ok {
+		return true
+	}
+	interval := cr.Spec.PostgresPasswordRotation.Interval
+	if interval == nil || interval.Duration <= 0 {
+		return false
+	}
+	rotated := found.CreationTimestamp.Time
+	if t, err := time.Parse(time.RFC3339, found.Annotations[pgRotatedAnnotation]); err == nil {
+		rotated = t
+	}
+	return time.Since(rotated) >= interval.Duration
+}
+
+// rotatePgPassword replaces the generated password in found when it is due.
+// The superuser of an instance changes its own password with a Job, the new
+// one is kept in db_pass_next until then, so a rotation cut short carries on
+// with the same password. The role of a database in the shared instance is
+// altered by the provision Job, which runs again on its own.
+func rotatePgPassword(component string, found *corev1.Secret, alter bool, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	if found == nil || len(found.Data["db_pass"]) == 0 {
+		return nil
+	}
+	next := found.Data["db_pass_next"]
+	if len(next) == 0 {
+		if !pgPasswordDue(found, cr) {
+			return nil
+		}
+		pass, err := GenerateRandomASCIIString(32)
+		if err != nil {
+			return err
+		}
+		next = []byte(pass)
+		if alter {
+			found.Data["db_pass_next"] = next
+			if err = r.Client.Update(context.TODO(), found); err != nil {
+				return err
+			}
+		}
+	}
+
+	if alter {
+		job := newPgRotateJobCr(component, hashData(map[string][]byte{"db_pass": next}), cr)
+		live := &batchv1.Job{}
+		err := r.Client.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, live)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil && live.Annotations[configHashAnnotation] != job.Annotations[configHashAnnotation] {
+			if err = deleteObject("Job", cr, r, live); err != nil {
+				return err
+			}
+			return &requeueError{reason: "rotating the " + component + " postgres password again", after: 5 * time.Second}
+		}
+		if err = runJob(job, cr, r); err != nil {
+			if _, ok := err.(*jobFailedError); ok {
+				// retried with the next reconcile
+				if delErr := deleteObject("Job", cr, r, job); delErr != nil {
+					return delErr
+				}
+			}
+			return err
+		}
+		if err = deleteObject("Job", cr, r, job); err != nil {
+			return err
+		}
+	}
+
+	found.Data["db_pass"] = next
+	delete(found.Data, "db_pass_next")
+	if found.Annotations == nil {
+		found.Annotations = map[string]string{}
+	}
+	delete(found.Annotations, pgRotateAnnotation)
+	found.Annotations[pgRotatedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if err := r.Client.Update(context.TODO(), found); err != nil {
+		return err
+	}
+	logger.Info("Rotated Postgres password", "Database", component)
+	return nil
+}
+
+func newPgRotateJobCr(component, configHash string, cr *gitifold.VCS) *batchv1.Job {
+	name, _ := pgLabelNames(component, cr)
+	labels := pgBackupLabels("rotate", component, cr)
+	image, pullPolicy := pgContainerImage(component, cr)
+
+	backoffLimit := int32(2)
+	fal := false
+
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgRotateJobName(component, cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				configHashAnnotation: configHash,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+					AutomountServiceAccountToken: &fal,
+					RestartPolicy:                corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:            "rotate",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Command:         []string{"/bin/sh", "-c", pgRotateScript},
+							Env: append(pgClientEnv(name), corev1.EnvVar{
+								Name: "NEW_PASS",
+								ValueFrom: &corev1.EnvVarSource{
+									SecretKeyRef: &corev1.SecretKeySelector{
+										LocalObjectReference: corev1.LocalObjectReference{
+											Name: name,
+										},
+										Key: "db_pass_next",
+									},
+								},
+							}),
+						},
+					},
+				},
+			},
+		},
+	}
+	schedulePod(pgSpec(component, cr).WorkloadSpec, &job.Spec.Template.Spec)
+	mountDatabaseCA(&DBSecret{Secret: name, CA: pgTLSEnabled(cr)}, &job.Spec.Template.Spec)
+	return job
+}
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// pgProvisionScript creates the role and database of a component in the
+// shared instance, or resets the password of an existing role. The public
+// schema is handed to the role, so it can restore a dump on its own.
+const pgProvisionScript = `set -e
+psql -v ON_ERROR_STOP=1 -v user="${DB_USER}" -v pass="${DB_PASS}" -v db="${DB_NAME}" <<'EOF'
+SELECT format('CREATE ROLE %I', :'user') WHERE NOT EXISTS (SELECT FROM pg_roles WHERE rolname = :'user')\gexec
+ALTER ROLE :"user" WITH LOGIN PASSWORD :'pass';
+SELECT format('CREATE DATABASE %I OWNER %I', :'db', :'user') WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = :'db')\gexec
+REVOKE ALL ON DATABASE :"db" FROM PUBLIC;
+\c :"db"
+ALTER SCHEMA public OWNER TO :"user";
+EOF
+`
+
+// reconcileSharedPg deploys the shared Postgres instance when it is enabled
+// and removes it otherwise.
+func reconcileSharedPg(cr *gitifold.VCS, r *VCSReconciler) error {
+	if !cr.Spec.SharedPostgres.Enabled {
+		return removePgService("shared", cr, r)
+	}
+	_, err := createPgInstance("shared", cr, r)
+	return err
+}
+
+// pgInstance is the Postgres instance holding the database of component.
+func pgInstance(component string, cr *gitifold.VCS) string {
+	if cr.Spec.SharedPostgres.Enabled && pgSpec(component, cr).External == nil {
+		return "shared"
+	}
+	return component
+}
+
+func pgProvisionJobName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "provision"}, "-")
+}
+
+// createSharedPgDatabase gives a component its own database and role in the
+// shared instance. The credentials live in the secret a dedicated instance
+// would use, so switching keeps the password.
+func createSharedPgDatabase(component string, cr *gitifold.VCS, r *VCSReconciler) (*DBSecret, error) {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	name, _ := pgLabelNames(component, cr)
+	sharedName, _ := pgLabelNames("shared", cr)
+	found, err := lookupSecret(name, cr, r)
+	if err != nil {
+		return nil, err
+	}
+	// applied by the provision Job, as the password is part of its hash
+	if err = rotatePgPassword(component, found, false, cr, r); err != nil {
+		return nil, err
+	}
+	secret, dbSecret, err := newPgSecretCr(component, cr, found)
+	if err != nil {
+		return nil, err
+	}
+	secret.Data["db_host"] = []byte(sharedName)
+	dbSecret.Host = sharedName
+	shared, err := lookupSecret(sharedName, cr, r)
+	if err != nil {
+		return nil, err
+	}
+	if shared != nil {
+		securePgSecret(secret, dbSecret, shared.Data["ca.crt"])
+	}
+	if err = reconcileSecret(cr, r, secret); err != nil {
+		return nil, err
+	}
+
+	// a dedicated instance left over from before, its claim is left to the
+	// retention policy
+	if err = deleteObjects(pgInstanceObjects(component, cr), cr, r); err != nil {
+		return nil, err
+	}
+
+	// The Job is run again whenever the credentials change
+	job := newPgProvisionJobCr(component, hashData(secret.Data), cr)
+	live := &batchv1.Job{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, live)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil && live.Annotations[configHashAnnotation] != job.Annotations[configHashAnnotation] {
+		if err = deleteObject("Job", cr, r, live); err != nil {
+			return nil, err
+		}
+		return nil, &requeueError{reason: "provisioning the " + component + " database again", after: 5 * time.Second}
+	}
+
+	if err = runJob(job, cr, r); err != nil {
+		if _, ok := err.(*jobFailedError); ok {
+			// retried with the next reconcile
+			logger.Info("Provisioning the database failed", "Component", component)
+			if delErr := deleteObject("Job", cr, r, job); delErr != nil {
+				return nil, delErr
+			}
+		}
+		return nil, err
+	}
+
+	return dbSecret, nil
+}
+
+func newPgProvisionJobCr(component, configHash string, cr *gitifold.VCS) *batchv1.Job {
+	_, labels := pgLabelNames(component, cr)
+	sharedName, _ := pgLabelNames("shared", cr)
+	name, _ := pgLabelNames(component, cr)
+	image, pullPolicy := pgContainerImage("shared", cr)
+
+	// must not match the Service selector of the instance
+	jobLabels := make(map[string]string, len(labels))
+	for key, value := range labels {
+		jobLabels[key] = value
+	}
+	jobLabels["app.kubernetes.io/name"] = "postgres-provision"
+
+	env := []corev1.EnvVar{
+		{
+			Name:  "PGHOST",
+			Value: sharedName,
+		},
+	}
+	for _, key := range []struct{ env, secret, key string }{
+		{"PGUSER", sharedName, "db_user"},
+		{"PGPASSWORD", sharedName, "db_pass"},
+		{"PGDATABASE", sharedName, "db_name"},
+		{"PGSSLMODE", sharedName, "db_sslmode"},
+		{"DB_USER", name, "db_user"},
+		{"DB_PASS", name, "db_pass"},
+		{"DB_NAME", name, "db_name"},
+	} {
+		env = append(env, corev1.EnvVar{
+			Name: key.env,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: key.secret,
+					},
+					Key: key.key,
+				},
+			},
+		})
+	}
+
+	backoffLimit := int32(2)
+	fal := false
+
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgProvisionJobName(component, cr),
+			Namespace: cr.Namespace,
+			Labels:    jobLabels,
+			Annotations: map[string]string{
+				configHashAnnotation: configHash,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: jobLabels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+					AutomountServiceAccountToken: &fal,
+					RestartPolicy:                corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:            "provision",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Command:         []string{"/bin/sh", "-c", pgProvisionScript},
+							Env:             env,
+						},
+					},
+				},
+			},
+		},
+	}
+	schedulePod(pgSpec("shared", cr).WorkloadSpec, &job.Spec.Template.Spec)
+	mountDatabaseCA(&DBSecret{Secret: sharedName, CA: pgTLSEnabled(cr)}, &job.Spec.Template.Spec)
+	return job
+}
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPgProvisionScript(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to parse the script with")
+	}
+	if out, err := exec.Command(sh, "-n", "-c", pgProvisionScript).CombinedOutput(); err != nil {
+		t.Errorf("script does not parse: %v: %s", err, out)
+	}
+}
+
+func TestNewPgProvisionJobCr(t *testing.T) {
+	cr := testVCS()
+	job := newPgProvisionJobCr("drone", "abc", cr)
+	name, labels := pgLabelNames("drone", cr)
+	sharedName, _ := pgLabelNames("shared", cr)
+
+	if job.Annotations[configHashAnnotation] != "abc" {
+		t.Errorf("config hash = %q, want %q", job.Annotations[configHashAnnotation], "abc")
+	}
+	// the instance Service selects on the labels of the component
+	matches := true
+	for key, value := range labels {
+		if job.Spec.Template.Labels[key] != value {
+			matches = false
+		}
+	}
+	if matches {
+		t.Errorf("pod labels %v are selected by the postgres Service", job.Spec.Template.Labels)
+	}
+
+	want := map[string]string{
+		"PGUSER":     sharedName + "/db_user",
+		"PGPASSWORD": sharedName + "/db_pass",
+		"PGDATABASE": sharedName + "/db_name",
+		"PGSSLMODE":  sharedName + "/db_sslmode",
+		"DB_USER":    name + "/db_user",
+		"DB_PASS":    name + "/db_pass",
+		"DB_NAME":    name + "/db_name",
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	for _, env := range container.Env {
+		if env.Name == "PGHOST" {
+			if env.Value != sharedName {
+				t.Errorf("PGHOST = %q, want %q", env.Value, sharedName)
+			}
+			continue
+		}
+		if env.Name == "PGSSLROOTCERT" {
+			// the CA mounted by mountDatabaseCA
+			continue
+		}
+		ref := env.ValueFrom.SecretKeyRef
+		if got := ref.Name + "/" + ref.Key; got != want[env.Name] {
+			t.Errorf("%s from %s, want %s", env.Name, got, want[env.Name])
+		}
+		delete(want, env.Name)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing env %v", want)
+	}
+	if container.Command[len(container.Command)-1] != pgProvisionScript {
+		t.Error("the container does not run the provision script")
+	}
+}
+
+func TestCreateSharedPgDatabase(t *testing.T) {
+	failed := func(job *batchv1.Job) {
+		job.Status.Failed = 3
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+	}
+	tests := []struct {
+		name string
+		// applied to the Job the first pass created
+		job func(*batchv1.Job)
+		// applied to the component secret after the first pass
+		secret  func(*corev1.Secret)
+		wantErr func(error) bool
+		wantJob bool
+	}{
+		{
+			name:    "running",
+			wantErr: func(err error) bool { _, ok := err.(*requeueError); return ok },
+			wantJob: true,
+		},
+		{
+			name:    "provisioned",
+			job:     func(job *batchv1.Job) { job.Status.Succeeded = 1 },
+			wantErr: func(err error) bool { return err == nil },
+			wantJob: true,
+		},
+		{
+			name:    "failed is retried",
+			job:     failed,
+			wantErr: func(err error) bool { _, ok := err.(*jobFailedError); return ok },
+		},
+		{
+			name:    "credentials changed",
+			job:     func(job *batchv1.Job) { job.Status.Succeeded = 1 },
+			secret:  func(secret *corev1.Secret) { secret.Data["db_pass"] = []byte("rotated") },
+			wantErr: func(err error) bool { _, ok := err.(*requeueError); return ok },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			r := testReconciler()
+			name, _ := pgLabelNames("drone", cr)
+			jobKey := types.NamespacedName{Name: pgProvisionJobName("drone", cr), Namespace: cr.Namespace}
+
+			if _, err := createSharedPgDatabase("drone", cr, r); err == nil {
+				t.Fatal("the first pass did not wait on the Job")
+			}
+			job := &batchv1.Job{}
+			if err := r.Client.Get(context.TODO(), jobKey, job); err != nil {
+				t.Fatal(err)
+			}
+			if tt.job != nil {
+				tt.job(job)
+				if err := r.Client.Update(context.TODO(), job); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.secret != nil {
+				secret := &corev1.Secret{}
+				if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, secret); err != nil {
+					t.Fatal(err)
+				}
+				tt.secret(secret)
+				if err := r.Client.Update(context.TODO(), secret); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dbSecret, err := createSharedPgDatabase("drone", cr, r)
+			if !tt.wantErr(err) {
+				t.Errorf("createSharedPgDatabase() = %v", err)
+			}
+			if err == nil {
+				if sharedName, _ := pgLabelNames("shared", cr); dbSecret.Host != sharedName {
+					t.Errorf("host = %q, want %q", dbSecret.Host, sharedName)
+				}
+			}
+			err = r.Client.Get(context.TODO(), jobKey, &batchv1.Job{})
+			if exists := !errors.IsNotFound(err); exists != tt.wantJob {
+				t.Errorf("job exists = %v, want %v", exists, tt.wantJob)
+			}
+			if tt.wantJob {
+				return
+			}
+
+			// the next pass runs it again
+			if _, err := createSharedPgDatabase("drone", cr, r); err == nil {
+				t.Error("the Job was not run again")
+			}
+			rerun := &batchv1.Job{}
+			if err := r.Client.Get(context.TODO(), jobKey, rerun); err != nil {
+				t.Fatal(err)
+			}
+			if rerun.Status.Failed != 0 || rerun.Status.Succeeded != 0 {
+				t.Errorf("job status = %+v, want a new Job", rerun.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var certificateGVK = schema.GroupVersionKind{
+	Group:   "cert-manager.io",
+	Version: "v1alpha2",
+	Kind:    "Certificate",
+}
+
+// pgTLSDir holds the server certificate, copied out of its secret so
+// postgres owns the key.
+const pgTLSDir = "/etc/gitifold/tls"
+
+const pgTLSSecretDir = "/etc/gitifold/tls-secret"
+
+const pgTLSCopyScript = `set -e
+install -o postgres -g postgres -m 644 ` + pgTLSSecretDir + `/tls.crt ` + pgTLSDir + `/server.crt
+install -o postgres -g postgres -m 600 ` + pgTLSSecretDir + `/tls.key ` + pgTLSDir + `/server.key
+`
+
+// pgCertRenewBefore is how long before it expires a server certificate
+// signed by the operator is issued again.
+const pgCertRenewBefore = 30 * 24 * time.Hour
+
+// pgTLSEnabled tells whether TLS was turned on, existing installs keep
+// plain connections until then.
+func pgTLSEnabled(cr *gitifold.VCS) bool {
+	return cr.Spec.PostgresTLS.Enabled != nil && *cr.Spec.PostgresTLS.Enabled
+}
+
+func pgCAName(cr *gitifold.VCS) string {
+	return strings.Join([]string{cr.Name, "gitifold", "postgres", "ca"}, "-")
+}
+
+func pgTLSName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "tls"}, "-")
+}
+
+// pgDNSNames are the names an instance is reached by, through any of its
+// Services.
+func pgDNSNames(component string, cr *gitifold.VCS) []string {
+	name, _ := pgLabelNames(component, cr)
+	pooler, _ := pgPoolerLabelNames(component, cr)
+	names := []string{}
+	for _, service := range []string{
+		name,
+		strings.Join([]string{name, "headless"}, "-"),
+		pgReadServiceName(component, cr),
+		pgRecoveryName(component, cr),
+		pooler,
+	} {
+		names = append(names, service, service+"."+cr.Namespace, service+"."+cr.Namespace+".svc")
+	}
+	return names
+}
+
+// pgTLSArgs serve TLS with the certificate staged by pgTLSPodSpec.
+func pgTLSArgs() []string {
+	return []string{
+		"-c", "ssl=on",
+		"-c", "ssl_cert_file=" + pgTLSDir + "/server.crt",
+		"-c", "ssl_key_file=" + pgTLSDir + "/server.key",
+	}
+}
+
+// reconcilePgTLS makes sure the server certificate of an instance is
+// issued, and returns a hash of it to roll the pods with, along with the CA
+// the clients verify it with. Both are empty with TLS turned off.
+func reconcilePgTLS(component string, cr *gitifold.VCS, r *VCSReconciler) (string, []byte, error) {
+	certificate := &unstructured.Unstructured{}
+	certificate.SetGroupVersionKind(certificateGVK)
+	certificate.SetName(pgTLSName(component, cr))
+
+	if !pgTLSEnabled(cr) || cr.Spec.PostgresTLS.IssuerRef == nil {
+		// cert-manager may not even be installed
+		certificate.SetNamespace(cr.Namespace)
+		if err := deleteObject("Certificate", cr, r, certificate); err != nil && !meta.IsNoMatchError(err) {
+			return "", nil, err
+		}
+	}
+	if !pgTLSEnabled(cr) {
+		return "", nil, deleteObjects([]managedObject{
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: pgTLSName(component, cr)}},
+		}, cr, r)
+	}
+
+	var secret *corev1.Secret
+	var err error
+	if cr.Spec.PostgresTLS.IssuerRef != nil {
+		secret, err = requestPgCertificate(component, certificate, cr, r)
+	} else {
+		secret, err = signPgCertificate(component, cr, r)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return hashData(secret.Data), secret.Data["ca.crt"], nil
+}
+
+// requestPgCertificate has cert-manager issue the server certificate.
+func requestPgCertificate(component string, certificate *unstructured.Unstructured, cr *gitifold.VCS, r *VCSReconciler) (*corev1.Secret, error) {
+	name, labels := pgLabelNames(component, cr)
+	issuer := cr.Spec.PostgresTLS.IssuerRef
+	kind := issuer.Kind
+	if kind == "" {
+		kind = "Issuer"
+	}
+	group := issuer.Group
+	if group == "" {
+		group = "cert-manager.io"
+	}
+
+	dnsNames := []interface{}{}
+	for _, dnsName := range pgDNSNames(component, cr) {
+		dnsNames = append(dnsNames, dnsName)
+	}
+	spec := map[string]interface{}{
+		"secretName": pgTLSName(component, cr),
+		"commonName": name,
+		"dnsNames":   dnsNames,
+		"usages":     []interface{}{"server auth"},
+		"issuerRef": map[string]interface{}{
+			"name":  issuer.Name,
+			"kind":  kind,
+			"group": group,
+		},
+	}
+	certificate.SetNamespace(cr.Namespace)
+	certificate.SetLabels(labels)
+	if err := reconcileObject("Certificate", cr, r, certificate, func() {
+		if live, _, _ := unstructured.NestedMap(certificate.Object, "spec"); reflect.DeepEqual(live, spec) {
+			return
+		}
+		_ = unstructured.SetNestedMap(certificate.Object, spec, "spec")
+	}); err != nil {
+		return nil, err
+	}
+
+	secret, err := lookupSecret(pgTLSName(component, cr), cr, r)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || len(secret.Data["tls.crt"]) == 0 {
+		return nil, &requeueError{reason: "waiting for cert-manager to issue the " + component + " postgres certificate", after: 10 * time.Second}
+	}
+	if len(secret.Data["ca.crt"]) == 0 {
+		return nil, fmt.Errorf("issuer %s hands out no ca.crt to verify the %s postgres certificate with", issuer.Name, component)
+	}
+	return secret, nil
+}
+
+// signPgCertificate signs the server certificate with the CA of the VCS,
+// and only issues it again when it is about to expire, the names changed
+// or the CA did.
+func signPgCertificate(component string, cr *gitifold.VCS, r *VCSReconciler) (*corev1.Secret, error) {
+	ca, err := reconcilePgCA(cr, r)
+	if err != nil {
+		return nil, err
+	}
+	caCert, caKey, err := parseKeyPair(ca.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := lookupSecret(pgTLSName(component, cr), cr, r)
+	if err != nil {
+		return nil, err
+	}
+	if found != nil {
+		if cert, _, err := parseKeyPair(found.Data); err == nil &&
+			cert.CheckSignatureFrom(caCert) == nil &&
+			time.Until(cert.NotAfter) > pgCertRenewBefore &&
+			sameNames(cert.DNSNames, pgDNSNames(component, cr)) {
+			return found, nil
+		}
+	}
+
+	name, labels := pgLabelNames(component, cr)
+	certPEM, keyPEM, err := signCertificate(name, pgDNSNames(component, cr), 365*24*time.Hour, caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	secret := newTLSSecretCr(pgTLSName(component, cr), labels, certPEM, keyPEM, ca.Data["tls.crt"], cr)
+	if err = reconcileSecret(cr, r, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// reconcilePgCA generates the CA of the VCS once.
+func reconcilePgCA(cr *gitifold.VCS, r *VCSReconciler) (*corev1.Secret, error) {
+	found, err := lookupSecret(pgCAName(cr), cr, r)
+	if err != nil {
+		return nil, err
+	}
+	if found != nil {
+		if _, _, err = parseKeyPair(found.Data); err == nil {
+			return found, nil
+		}
+	}
+
+	certPEM, keyPEM, err := signCertificate(pgCAName(cr), nil, 10*365*24*time.Hour, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{
+		"app.kubernetes.io/name":       "postgres-ca",
+		"app.kubernetes.io/deployment": "gitifold",
+		"app.kubernetes.io/instance":   cr.Name,
+	}
+	secret := newTLSSecretCr(pgCAName(cr), labels, certPEM, keyPEM, certPEM, cr)
+	if err = reconcileSecret(cr, r, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// signCertificate issues a server certificate for dnsNames signed by
+// caCert, or a self-signed CA without one.
+func signCertificate(commonName string, dnsNames []string, validity time.Duration, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if caCert == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.ExtKeyUsage = nil
+		caCert, caKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// parseKeyPair reads back a certificate and key written by signCertificate.
+func parseKeyPair(data map[string][]byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(data["tls.crt"])
+	keyBlock, _ := pem.Decode(data["tls.key"])
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("no certificate or key")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func sameNames(a, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
+
+func newTLSSecretCr(name string, labels map[string]string, certPEM, keyPEM, caPEM []byte, cr *gitifold.VCS) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Annotations: make(map[string]string),
+			Labels:      labels,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": certPEM,
+			"tls.key": keyPEM,
+			"ca.crt":  caPEM,
+		},
+	}
+}
+
+// securePgSecret has the clients of a database verify the server with ca.
+func securePgSecret(secret *corev1.Secret, dbSecret *DBSecret, ca []byte) {
+	if len(ca) == 0 {
+		return
+	}
+	secret.Data["db_sslmode"] = []byte("verify-full")
+	secret.Data["ca.crt"] = ca
+	dbSecret.SSLMode = "verify-full"
+	dbSecret.CA = true
+}
+
+// pgTLSPodSpec copies the server certificate into place for postgres, in an
+// init container running the postgres image so the user is known.
+func pgTLSPodSpec(component string, pod *corev1.PodSpec, cr *gitifold.VCS) {
+	image, pullPolicy := pgContainerImage(component, cr)
+
+	pod.Volumes = append(pod.Volumes, corev1.Volume{
+		Name: "tls-secret",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: pgTLSName(component, cr),
+				Items: []corev1.KeyToPath{
+					{
+						Key:  "tls.crt",
+						Path: "tls.crt",
+					},
+					{
+						Key:  "tls.key",
+						Path: "tls.key",
+					},
+				},
+			},
+		},
+	}, corev1.Volume{
+		Name: "tls",
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+	mount := corev1.VolumeMount{
+		Name:      "tls",
+		MountPath: pgTLSDir,
+	}
+	pod.InitContainers = append(pod.InitContainers, corev1.Container{
+		Name:            "tls",
+		Image:           image,
+		ImagePullPolicy: pullPolicy,
+		Command:         []string{"/bin/sh", "-c", pgTLSCopyScript},
+		VolumeMounts: []corev1.VolumeMount{
+			mount,
+			{
+				Name:      "tls-secret",
+				MountPath: pgTLSSecretDir,
+				ReadOnly:  true,
+			},
+		},
+	})
+	mount.ReadOnly = true
+	for i := range pod.Containers {
+		container := &pod.Containers[i]
+		if container.Name != "postgres" {
+			continue
+		}
+		container.VolumeMounts = append(container.VolumeMounts, mount)
+	}
+}
@@ -0,0 +1,552 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// pgDefaultVersion is the major version of the default image, instances
+// created before versions were recorded run it.
+const pgDefaultVersion = "12"
+
+// pgConfirmUpgradeAnnotation on the VCS lists the upgrades confirmed, comma
+// separated, as <instance>=<version>.
+const pgConfirmUpgradeAnnotation = "gitifold.hyperspike.io/confirm-postgres-upgrade"
+
+// pgForceRollbackAnnotation on the VCS lists the rollbacks to go through
+// with although the new version has taken writes, as <instance>=<version>.
+const pgForceRollbackAnnotation = "gitifold.hyperspike.io/force-postgres-rollback"
+
+// pgUpgradeDumpScript keeps the components from writing to the instance
+// while it is dumped, the lock is lifted again on a rollback.
+const pgUpgradeDumpScript = `set -e
+psql -v ON_ERROR_STOP=1 -d postgres <<'EOF'
+ALTER SYSTEM SET default_transaction_read_only = on;
+SELECT pg_reload_conf();
+SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND backend_type = 'client backend';
+EOF
+pg_dumpall -f /upgrade/dump.sql
+`
+
+// pgRowsWrittenScript counts the rows written to every database, into the
+// termination log. The counts are those of the statistics, so they are
+// given a moment to catch up with the last writes.
+const pgRowsWrittenScript = `sleep 2
+IFS='
+'
+rows=0
+databases=$(psql -XtA -d postgres -c 'SELECT datname FROM pg_database WHERE datallowconn')
+for db in ${databases} ; do
+	count=$(psql -XtA -d "${db}" -c 'SELECT coalesce(sum(n_tup_ins + n_tup_upd + n_tup_del), 0) FROM pg_stat_user_tables')
+	rows=$((rows + count))
+done
+echo "${rows}" > /dev/termination-log
+`
+
+// pgUpgradeRestoreScript restores the dump into the fresh instance, the
+// superuser and its database already exist there. The rows it wrote are
+// counted, to tell later whether the instance has taken writes since.
+const pgUpgradeRestoreScript = `set -e
+psql -X -d postgres -f /upgrade/dump.sql > /dev/null 2> /upgrade/restore.log || true
+if grep ERROR /upgrade/restore.log | grep -v 'already exists' | tee /dev/termination-log | grep -q . ; then
+	exit 1
+fi
+` + pgRowsWrittenScript
+
+const pgUpgradeCheckScript = `set -e
+` + pgRowsWrittenScript
+
+const pgUpgradeUnlockScript = `set -e
+psql -v ON_ERROR_STOP=1 -d postgres <<'EOF'
+ALTER SYSTEM RESET default_transaction_read_only;
+SELECT pg_reload_conf();
+EOF
+`
+
+// pgVersion is the major version asked for.
+func pgVersion(component string, cr *gitifold.VCS) string {
+	if version := pgSpec(component, cr).Version; version != "" {
+		return version
+	}
+	return pgDefaultVersion
+}
+
+// pgRunningVersion is the major version the StatefulSet runs, which lags
+// behind pgVersion during an upgrade.
+func pgRunningVersion(component string, cr *gitifold.VCS) string {
+	for _, status := range cr.Status.PostgresVersions {
+		if status.Name == component && status.Version != "" {
+			return status.Version
+		}
+	}
+	return pgVersion(component, cr)
+}
+
+// pgContainerImage is the postgres image of the version running, and
+// pgContainerImageAt the one of version.
+func pgContainerImage(component string, cr *gitifold.VCS) (string, corev1.PullPolicy) {
+	return pgContainerImageAt(component, pgRunningVersion(component, cr), cr)
+}
+
+func pgContainerImageAt(component, version string, cr *gitifold.VCS) (string, corev1.PullPolicy) {
+	image := pgSpec(component, cr).Image
+	// a pinned tag is of the version asked for, the other side of an upgrade
+	// runs the tag of its own version
+	if version != pgVersion(component, cr) {
+		image.Tag = ""
+	}
+	if image.Tag == "" && version != pgDefaultVersion {
+		image.Tag = version + "-alpine"
+	}
+	return containerImage("postgres", image, cr)
+}
+
+// pgTagVersion is the major version a postgres image tag starts with, or
+// nothing when the tag does not tell.
+func pgTagVersion(tag string) string {
+	end := 0
+	for end < len(tag) && tag[end] >= '0' && tag[end] <= '9' {
+		end++
+	}
+	return tag[:end]
+}
+
+// validatePgImage refuses a pinned image tag of another major version than
+// the one asked for, the new volumes would be started with the former
+// binaries.
+func validatePgImage(component string, cr *gitifold.VCS) error {
+	tag := pgSpec(component, cr).Image.Tag
+	if major := pgTagVersion(tag); major != "" && major != pgVersion(component, cr) {
+		return fmt.Errorf("postgres image tag %s is not of version %s, set both to the same major version", tag, pgVersion(component, cr))
+	}
+	return nil
+}
+
+// pgWALKeep keeps 1GB of WAL for the replicas to catch up with, Postgres 13
+// counts it in size instead of segments.
+func pgWALKeep(component string, cr *gitifold.VCS) string {
+	if version, _ := strconv.Atoi(pgRunningVersion(component, cr)); version >= 13 {
+		return "wal_keep_size=1GB"
+	}
+	return "wal_keep_segments=64"
+}
+
+// pgDataName names the volumeClaimTemplate, every major version gets volumes
+// of its own.
+func pgDataName(component, version string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	if version == pgDefaultVersion {
+		return name
+	}
+	return strings.Join([]string{name, "pg" + version}, "-")
+}
+
+func pgUpgradeClaimName(component string, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "upgrade"}, "-")
+}
+
+func pgUpgradeJobName(step, component string, upgrade *gitifold.PostgresUpgradeStatus, cr *gitifold.VCS) string {
+	name, _ := pgLabelNames(component, cr)
+	return strings.Join([]string{name, "upgrade", step, upgrade.ToVersion}, "-")
+}
+
+// pgVersionStatus returns the version status of an instance, adding it if
+// there is none yet.
+func pgVersionStatus(component string, status *gitifold.VCSStatus) *gitifold.PostgresVersionStatus {
+	for i := range status.PostgresVersions {
+		if status.PostgresVersions[i].Name == component {
+			return &status.PostgresVersions[i]
+		}
+	}
+	status.PostgresVersions = append(status.PostgresVersions, gitifold.PostgresVersionStatus{Name: component})
+	return &status.PostgresVersions[len(status.PostgresVersions)-1]
+}
+
+// pgUpgradeInProgress is true while the instance does not run the version
+// it is being upgraded to, or the former volumes are still around.
+func pgUpgradeInProgress(upgrade *gitifold.PostgresUpgradeStatus) bool {
+	if upgrade == nil {
+		return false
+	}
+	return upgrade.Phase != gitifold.PostgresUpgradeSucceeded && upgrade.Phase != gitifold.PostgresUpgradeFailed
+}
+
+// pgPreviousClaimNames are the claims of the version being upgraded from,
+// while they are kept.
+func pgPreviousClaimNames(component string, cr *gitifold.VCS) []string {
+	for _, status := range cr.Status.PostgresVersions {
+		if status.Name != component || !pgUpgradeInProgress(status.Upgrade) {
+			continue
+		}
+		other := status.Upgrade.FromVersion
+		if status.Version == other {
+			other = status.Upgrade.ToVersion
+		}
+		return pgClaimNamesAt(component, other, cr)
+	}
+	return nil
+}
+
+// reconcilePgUpgrade runs before the StatefulSet, it records the version
+// running and dumps the instance when a new major version is asked for.
+func reconcilePgUpgrade(component string, cr *gitifold.VCS, r *VCSReconciler) error {
+	desired := pgVersion(component, cr)
+	status := pgVersionStatus(component, &cr.Status)
+
+	if status.Version == "" {
+		status.Version = desired
+		// instances created before versions were recorded
+		sts := &appsv1.StatefulSet{}
+		name, _ := pgLabelNames(component, cr)
+		err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, sts)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil {
+			status.Version = pgDefaultVersion
+		}
+		if err = r.Client.Status().Update(context.TODO(), cr); err != nil {
+			return err
+		}
+	}
+
+	upgrade := status.Upgrade
+	if !pgUpgradeInProgress(upgrade) {
+		failed := upgrade != nil && upgrade.Phase == gitifold.PostgresUpgradeFailed
+		if failed && desired == status.Version {
+			// set back, so the upgrade may be tried again
+			status.Upgrade = nil
+			return r.Client.Status().Update(context.TODO(), cr)
+		}
+		if desired == status.Version || failed {
+			return nil
+		}
+		return startPgUpgrade(component, desired, cr, r)
+	}
+	if upgrade.Phase != gitifold.PostgresUpgradeDumping {
+		return nil
+	}
+
+	if err := reconcilePVC(cr, r, newPgUpgradePVCCr(component, cr)); err != nil {
+		return err
+	}
+	err := runJob(newPgUpgradeJobCr("dump", component, upgrade.FromVersion, upgrade, cr), cr, r)
+	if failed, ok := err.(*jobFailedError); ok {
+		return setPgUpgradePhase(component, gitifold.PostgresUpgradeRollingBack, "dump failed: "+failed.message, cr, r)
+	}
+	if err != nil {
+		return err
+	}
+	status.Version = upgrade.ToVersion
+	return setPgUpgradePhase(component, gitifold.PostgresUpgradeRestoring, "starting postgres "+upgrade.ToVersion, cr, r)
+}
+
+// completePgUpgrade runs once the instance is ready, on the new version to
+// restore the dump into, or on the former one to unlock it again.
+func completePgUpgrade(component string, cr *gitifold.VCS, r *VCSReconciler) error {
+	status := pgVersionStatus(component, &cr.Status)
+	upgrade := status.Upgrade
+	if !pgUpgradeInProgress(upgrade) {
+		return nil
+	}
+
+	switch upgrade.Phase {
+	case gitifold.PostgresUpgradeRestoring:
+		err := runJob(newPgUpgradeJobCr("restore", component, upgrade.ToVersion, upgrade, cr), cr, r)
+		if failed, ok := err.(*jobFailedError); ok {
+			status.Version = upgrade.FromVersion
+			return setPgUpgradePhase(component, gitifold.PostgresUpgradeRollingBack, "restore failed: "+failed.message, cr, r)
+		}
+		if err != nil {
+			return err
+		}
+		message, err := jobMessage(pgUpgradeJobName("restore", component, upgrade, cr), "restore", cr, r)
+		if err != nil {
+			return err
+		}
+		if rows, err := strconv.ParseInt(strings.TrimSpace(message), 10, 64); err == nil {
+			upgrade.RestoredRows = &rows
+		}
+		message = fmt.Sprintf("add %s=%s to the %s annotation to delete the volumes of postgres %s. "+
+			"Setting the version back rolls back to the data as of the dump, every write taken by postgres %s since is lost, "+
+			"so it is refused once there are any unless %s=%s is added to the %s annotation",
+			component, upgrade.ToVersion, pgConfirmUpgradeAnnotation, upgrade.FromVersion,
+			upgrade.ToVersion, component, upgrade.ToVersion, pgForceRollbackAnnotation)
+		return setPgUpgradePhase(component, gitifold.PostgresUpgradeAwaitingConfirmation, message, cr, r)
+
+	case gitifold.PostgresUpgradeAwaitingConfirmation:
+		if pgVersion(component, cr) == upgrade.FromVersion {
+			if err := checkPgRollback(component, upgrade, cr, r); err != nil {
+				return err
+			}
+			status.Version = upgrade.FromVersion
+			return setPgUpgradePhase(component, gitifold.PostgresUpgradeRollingBack, "rolled back on request", cr, r)
+		}
+		// a rollback asked for again is checked again
+		check := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: pgUpgradeJobName("check", component, upgrade, cr)}}
+		if err := deleteObjects([]managedObject{check}, cr, r); err != nil {
+			return err
+		}
+		if pgUpgradeListed(pgConfirmUpgradeAnnotation, component, upgrade.ToVersion, cr) {
+			if err := deletePgUpgradeObjects(component, upgrade.FromVersion, cr, r); err != nil {
+				return err
+			}
+			return setPgUpgradePhase(component, gitifold.PostgresUpgradeSucceeded, "", cr, r)
+		}
+		return nil
+
+	case gitifold.PostgresUpgradeRollingBack:
+		err := runJob(newPgUpgradeJobCr("unlock", component, upgrade.FromVersion, upgrade, cr), cr, r)
+		if failed, ok := err.(*jobFailedError); ok {
+			return fmt.Errorf("unlocking postgres %s failed: %s", upgrade.FromVersion, failed.message)
+		}
+		if err != nil {
+			return err
+		}
+		// a retry starts over on empty volumes
+		if err = deletePgUpgradeObjects(component, upgrade.ToVersion, cr, r); err != nil {
+			return err
+		}
+		return setPgUpgradePhase(component, gitifold.PostgresUpgradeFailed, upgrade.Message, cr, r)
+	}
+	return nil
+}
+
+// checkPgRollback refuses to roll back once the new version has taken
+// writes, which the former volumes do not hold, unless the rollback is
+// forced. Writes are told by the rows counted after the restore changing.
+func checkPgRollback(component string, upgrade *gitifold.PostgresUpgradeStatus, cr *gitifold.VCS, r *VCSReconciler) error {
+	if pgUpgradeListed(pgForceRollbackAnnotation, component, upgrade.ToVersion, cr) {
+		return nil
+	}
+	force := fmt.Sprintf("add %s=%s to the %s annotation to roll back anyway", component, upgrade.ToVersion, pgForceRollbackAnnotation)
+
+	job := newPgUpgradeJobCr("check", component, upgrade.ToVersion, upgrade, cr)
+	err := runJob(job, cr, r)
+	if failed, ok := err.(*jobFailedError); ok {
+		return fmt.Errorf("counting the writes to postgres %s failed: %s, %s", upgrade.ToVersion, failed.message, force)
+	}
+	if err != nil {
+		return err
+	}
+	message, err := jobMessage(job.Name, "check", cr, r)
+	if err != nil {
+		return err
+	}
+	rows, err := strconv.ParseInt(strings.TrimSpace(message), 10, 64)
+	if err == nil && upgrade.RestoredRows != nil && rows == *upgrade.RestoredRows {
+		return nil
+	}
+	return fmt.Errorf("postgres %s has taken writes since the upgrade, rolling back to %s would lose them, %s",
+		upgrade.ToVersion, upgrade.FromVersion, force)
+}
+
+// pgUpgradeListed tells whether <component>=<version> is listed in the
+// annotation of the VCS.
+func pgUpgradeListed(annotation, component, version string, cr *gitifold.VCS) bool {
+	for _, listed := range strings.Split(cr.Annotations[annotation], ",") {
+		if strings.TrimSpace(listed) == component+"="+version {
+			return true
+		}
+	}
+	return false
+}
+
+// startPgUpgrade records a new upgrade to version.
+func startPgUpgrade(component, version string, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	status := pgVersionStatus(component, &cr.Status)
+	from, _ := strconv.Atoi(status.Version)
+	to, _ := strconv.Atoi(version)
+	if to < from {
+		return fmt.Errorf("downgrading postgres from %s to %s is not supported, set the version back to %s", status.Version, version, status.Version)
+	}
+
+	now := metav1.Now()
+	status.Upgrade = &gitifold.PostgresUpgradeStatus{
+		Phase:       gitifold.PostgresUpgradeDumping,
+		FromVersion: status.Version,
+		ToVersion:   version,
+		Message:     "dumping postgres " + status.Version,
+		StartTime:   &now,
+	}
+	if err := r.Client.Status().Update(context.TODO(), cr); err != nil {
+		return err
+	}
+	logger.Info("Upgrading Postgres", "Instance", component, "From", status.Version, "To", version)
+	return &requeueError{reason: component + " postgres upgrade started", after: 5 * time.Second}
+}
+
+// setPgUpgradePhase saves the next phase of the upgrade, and asks for the
+// reconcile to be retried unless the upgrade is over or waits on the user.
+func setPgUpgradePhase(component string, phase gitifold.PostgresUpgradePhase, message string, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	upgrade := pgVersionStatus(component, &cr.Status).Upgrade
+	upgrade.Phase = phase
+	upgrade.Message = message
+	if !pgUpgradeInProgress(upgrade) {
+		now := metav1.Now()
+		upgrade.CompletionTime = &now
+	}
+	if err := r.Client.Status().Update(context.TODO(), cr); err != nil {
+		return err
+	}
+	logger.Info("Postgres upgrade "+string(phase), "Instance", component, "From", upgrade.FromVersion, "To", upgrade.ToVersion, "Message", message)
+
+	if !pgUpgradeInProgress(upgrade) || phase == gitifold.PostgresUpgradeAwaitingConfirmation {
+		return nil
+	}
+	return &requeueError{reason: component + " postgres upgrade " + string(phase), after: 5 * time.Second}
+}
+
+// deletePgUpgradeObjects removes the volumes of version once they are no
+// longer needed, along with the dump and the Jobs of the upgrade.
+func deletePgUpgradeObjects(component, version string, cr *gitifold.VCS, r *VCSReconciler) error {
+	objects := append(pgUpgradeJobs(component, cr), &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: pgUpgradeClaimName(component, cr)}})
+	for _, claim := range pgClaimNamesAt(component, version, cr) {
+		objects = append(objects, &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: claim}})
+	}
+	return deleteObjects(objects, cr, r)
+}
+
+// pgUpgradeJobs are the Jobs of the last upgrade.
+func pgUpgradeJobs(component string, cr *gitifold.VCS) []managedObject {
+	objects := []managedObject{}
+	for _, status := range cr.Status.PostgresVersions {
+		if status.Name != component || status.Upgrade == nil {
+			continue
+		}
+		for _, step := range []string{"dump", "restore", "check", "unlock"} {
+			objects = append(objects, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: pgUpgradeJobName(step, component, status.Upgrade, cr)}})
+		}
+	}
+	return objects
+}
+
+// replacePgStatefulSet deletes the StatefulSet when it runs on the volumes
+// of another version, the volumeClaimTemplates can not be changed.
+func replacePgStatefulSet(sts *appsv1.StatefulSet, cr *gitifold.VCS, r *VCSReconciler) error {
+	live := &appsv1.StatefulSet{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: sts.Name, Namespace: cr.Namespace}, live)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if len(live.Spec.VolumeClaimTemplates) == 0 || live.Spec.VolumeClaimTemplates[0].Name == sts.Spec.VolumeClaimTemplates[0].Name {
+		return nil
+	}
+	if live.DeletionTimestamp == nil {
+		if err = deleteObject("StatefulSet", cr, r, live); err != nil {
+			return err
+		}
+	}
+	return &requeueError{reason: "replacing the postgres StatefulSet " + sts.Name, after: 5 * time.Second}
+}
+
+func newPgUpgradePVCCr(component string, cr *gitifold.VCS) *corev1.PersistentVolumeClaim {
+	_, labels := pgLabelNames(component, cr)
+
+	return &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgUpgradeClaimName(component, cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: claimSpec(pgSpec(component, cr).Storage, "2Gi"),
+	}
+}
+
+// newPgUpgradeJobCr runs step of the upgrade with the tools of version.
+func newPgUpgradeJobCr(step, component, version string, upgrade *gitifold.PostgresUpgradeStatus, cr *gitifold.VCS) *batchv1.Job {
+	name, _ := pgLabelNames(component, cr)
+	labels := pgBackupLabels("upgrade", component, cr)
+	image, pullPolicy := pgContainerImageAt(component, version, cr)
+	script := map[string]string{
+		"dump":    pgUpgradeDumpScript,
+		"restore": pgUpgradeRestoreScript,
+		"check":   pgUpgradeCheckScript,
+		"unlock":  pgUpgradeUnlockScript,
+	}[step]
+
+	backoffLimit := int32(2)
+	fal := false
+
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgUpgradeJobName(step, component, upgrade, cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:             cr.Spec.ImagePullSecrets,
+					AutomountServiceAccountToken: &fal,
+					RestartPolicy:                corev1.RestartPolicyNever,
+					Volumes: []corev1.Volume{
+						{
+							Name: "upgrade",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: pgUpgradeClaimName(component, cr),
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:            step,
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
+							Command:         []string{"/bin/sh", "-c", script},
+							Env:             pgClientEnv(name),
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "upgrade",
+									MountPath: "/upgrade",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if step == "check" || step == "unlock" {
+		// neither needs the dump, which may be gone already
+		job.Spec.Template.Spec.Volumes = nil
+		job.Spec.Template.Spec.Containers[0].VolumeMounts = nil
+	}
+	schedulePod(pgSpec(component, cr).WorkloadSpec, &job.Spec.Template.Spec)
+	mountDatabaseCA(&DBSecret{Secret: name, CA: pgTLSEnabled(cr)}, &job.Spec.Template.Spec)
+	return job
+}
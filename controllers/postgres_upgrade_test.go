@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// testPgVCS asks for version of the gitea instance, pinned to tag, while
+// running the version in status.
+func testPgVCS(version, tag, running string) *gitifold.VCS {
+	cr := testVCS()
+	cr.Spec.Git.Postgres.Version = version
+	cr.Spec.Git.Postgres.Image.Tag = tag
+	if running != "" {
+		cr.Status.PostgresVersions = []gitifold.PostgresVersionStatus{{Name: "gitea", Version: running}}
+	}
+	return cr
+}
+
+func TestPgWALKeep(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		running string
+		want    string
+	}{
+		{name: "default", want: "wal_keep_segments=64"},
+		{name: "12", version: "12", want: "wal_keep_segments=64"},
+		{name: "13", version: "13", want: "wal_keep_size=1GB"},
+		{name: "14", version: "14", want: "wal_keep_size=1GB"},
+		{name: "upgrading to 13", version: "13", running: "12", want: "wal_keep_segments=64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pgWALKeep("gitea", testPgVCS(tt.version, "", tt.running)); got != tt.want {
+				t.Errorf("pgWALKeep() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPgContainerImageAt(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		tag     string
+		at      string
+		want    string
+	}{
+		{name: "default", at: "12", want: "postgres:12.2-alpine"},
+		{name: "version", version: "13", at: "13", want: "postgres:13-alpine"},
+		{name: "pinned", version: "13", tag: "13.1-alpine", at: "13", want: "postgres:13.1-alpine"},
+		{name: "upgrading from default", version: "13", tag: "13.1-alpine", at: "12", want: "postgres:12.2-alpine"},
+		{name: "upgrading from 13", version: "14", tag: "14.0", at: "13", want: "postgres:13-alpine"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := pgContainerImageAt("gitea", tt.at, testPgVCS(tt.version, tt.tag, "")); got != tt.want {
+				t.Errorf("pgContainerImageAt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePgImage(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		tag     string
+		wantErr bool
+	}{
+		{name: "no tag"},
+		{name: "default version", tag: "12.4-alpine"},
+		{name: "same version", version: "13", tag: "13.1"},
+		{name: "major only", version: "13", tag: "13"},
+		{name: "unversioned tag", version: "13", tag: "alpine"},
+		{name: "tag of default version", version: "13", tag: "12.2-alpine", wantErr: true},
+		{name: "tag of newer version", tag: "13.1-alpine", wantErr: true},
+		{name: "prefix of version", version: "13", tag: "1-custom", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePgImage("gitea", testPgVCS(tt.version, tt.tag, ""))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePgImage() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPgUpgradeScripts(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to parse the scripts with")
+	}
+	for _, script := range []string{pgUpgradeDumpScript, pgUpgradeRestoreScript, pgUpgradeCheckScript, pgUpgradeUnlockScript} {
+		if out, err := exec.Command(sh, "-n", "-c", script).CombinedOutput(); err != nil {
+			t.Errorf("script does not parse: %v: %s\n%s", err, out, script)
+		}
+	}
+}
+
+func TestPgRollback(t *testing.T) {
+	restored := int64(42)
+	tests := []struct {
+		name     string
+		restored *int64
+		// the rows counted by the check Job, none while it runs
+		counted     string
+		force       bool
+		wantPhase   gitifold.PostgresUpgradePhase
+		wantRefused bool
+	}{
+		{
+			name:      "counting",
+			restored:  &restored,
+			wantPhase: gitifold.PostgresUpgradeAwaitingConfirmation,
+		},
+		{
+			name:      "no writes",
+			restored:  &restored,
+			counted:   "42\n",
+			wantPhase: gitifold.PostgresUpgradeRollingBack,
+		},
+		{
+			name:        "writes",
+			restored:    &restored,
+			counted:     "43\n",
+			wantPhase:   gitifold.PostgresUpgradeAwaitingConfirmation,
+			wantRefused: true,
+		},
+		{
+			name:        "restore not counted",
+			counted:     "42\n",
+			wantPhase:   gitifold.PostgresUpgradeAwaitingConfirmation,
+			wantRefused: true,
+		},
+		{
+			name:      "writes forced",
+			restored:  &restored,
+			force:     true,
+			wantPhase: gitifold.PostgresUpgradeRollingBack,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testPgVCS("12", "", "13")
+			upgrade := &gitifold.PostgresUpgradeStatus{
+				Phase:        gitifold.PostgresUpgradeAwaitingConfirmation,
+				FromVersion:  "12",
+				ToVersion:    "13",
+				RestoredRows: tt.restored,
+			}
+			cr.Status.PostgresVersions[0].Upgrade = upgrade
+			if tt.force {
+				cr.Annotations = map[string]string{pgForceRollbackAnnotation: "drone=13, gitea=13"}
+			}
+			objs := []runtime.Object{cr}
+			if tt.counted != "" {
+				name := pgUpgradeJobName("check", "gitea", upgrade, cr)
+				job := newPgUpgradeJobCr("check", "gitea", "13", upgrade, cr)
+				job.Status.Succeeded = 1
+				pod := &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: name + "-abcde", Namespace: cr.Namespace, Labels: map[string]string{"job-name": name}},
+					Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+						Name:  "check",
+						State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: tt.counted}},
+					}}},
+				}
+				objs = append(objs, job, pod)
+			}
+			r := testReconciler(objs...)
+
+			err := completePgUpgrade("gitea", cr, r)
+			_, waiting := err.(*requeueError)
+			refused := err != nil && !waiting
+			if refused != tt.wantRefused {
+				t.Errorf("completePgUpgrade() = %v, refused %v, want %v", err, refused, tt.wantRefused)
+			}
+			if refused && !strings.Contains(err.Error(), pgForceRollbackAnnotation) {
+				t.Errorf("%q does not tell how to force the rollback", err)
+			}
+			if upgrade.Phase != tt.wantPhase {
+				t.Errorf("phase = %s, want %s", upgrade.Phase, tt.wantPhase)
+			}
+			wantVersion := "13"
+			if tt.wantPhase == gitifold.PostgresUpgradeRollingBack {
+				wantVersion = "12"
+			}
+			if version := cr.Status.PostgresVersions[0].Version; version != wantVersion {
+				t.Errorf("running version = %s, want %s", version, wantVersion)
+			}
+
+			err = r.Client.Get(context.TODO(), types.NamespacedName{Name: pgUpgradeJobName("check", "gitea", upgrade, cr), Namespace: cr.Namespace}, &batchv1.Job{})
+			if counted := err == nil; counted == tt.force {
+				t.Errorf("check Job created = %v with the rollback forced = %v", counted, tt.force)
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package controllers
 
 import (
-	"context"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/util/intstr"
 
@@ -12,10 +11,6 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 func getRegistryNames(cr *gitifold.VCS) (string, map[string]string) {
@@ -31,73 +26,32 @@ func getRegistryNames(cr *gitifold.VCS) (string, map[string]string) {
 }
 
 func createRegistryService(cr *gitifold.VCS, r *VCSReconciler) error {
-	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
-
-	service := newRegistryServiceCr(cr)
-	if err := controllerutil.SetControllerReference(cr, service, r.Scheme); err != nil {
+	if err := reconcileService(cr, r, newRegistryServiceCr(cr)); err != nil {
 		return err
 	}
-	foundService := &corev1.Service{}
-	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, foundService)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Registry Service")
-		err = r.Client.Create(context.TODO(), service)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Registry service already exists")
-	}
-
-	pvc := newRegistryPVCCr(cr)
-	if err := controllerutil.SetControllerReference(cr, pvc, r.Scheme); err != nil {
+	if err := reconcilePVC(cr, r, newRegistryPVCCr(cr)); err != nil {
 		return err
 	}
-	foundPVC := &corev1.PersistentVolumeClaim{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}, foundPVC)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Registry PVC", "PVC.Namespace")
-		err = r.Client.Create(context.TODO(), pvc)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Registry PVC already exists")
-	}
-
-	deployment := newRegistryDeploymentCr(cr)
-	if err = controllerutil.SetControllerReference(cr, deployment, r.Scheme); err != nil {
+	if err := reconcileDeployment(cr, r, newRegistryDeploymentCr(cr)); err != nil {
 		return err
 	}
-	foundDeployment := &appsv1.Deployment{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: deployment.Name, Namespace: deployment.Namespace}, foundDeployment)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Registry Deployment")
-		err = r.Client.Create(context.TODO(), deployment)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Registry Deployment already exists")
-	}
 
-	ingress := newRegistryIngressCr(cr)
-	if err = controllerutil.SetControllerReference(cr, ingress, r.Scheme); err != nil {
-		return err
+	return reconcileIngress(cr, r, newRegistryIngressCr(cr))
+}
+
+// removeRegistryService deletes the registry after it has been disabled,
+// the image store is only removed under the Delete retention policy.
+func removeRegistryService(cr *gitifold.VCS, r *VCSReconciler) error {
+	name, _ := getRegistryNames(cr)
+	objects := []managedObject{
+		&netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}},
 	}
-	foundIngress := &netv1.Ingress{}
-	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: ingress.Name, Namespace: ingress.Namespace}, foundIngress)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating a new Registry Ingress")
-		err = r.Client.Create(context.TODO(), ingress)
-		if err != nil {
-			return err
-		}
-	} else {
-		logger.Info("Skip reconcile: Registry Ingress already exists")
+	if retentionPolicy(cr) == gitifold.RetentionDelete {
+		objects = append(objects, &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name}})
 	}
-
-	return nil
+	return deleteObjects(objects, cr, r)
 }
 
 func newRegistryServiceCr(cr *gitifold.VCS) *corev1.Service {
@@ -129,15 +83,21 @@ func newRegistryServiceCr(cr *gitifold.VCS) *corev1.Service {
 func newRegistryIngressCr(cr *gitifold.VCS) *netv1.Ingress {
 	name, labels := getRegistryNames(cr)
 
+	annotations := make(map[string]string)
+	for key, value := range cr.Spec.Registry.Annotations {
+		annotations[key] = value
+	}
+
 	return &netv1.Ingress{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Ingress",
 			APIVersion: "networking.k8s.io/v1beta1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: cr.Namespace,
-			Labels:    labels,
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: netv1.IngressSpec{
 			Rules: []netv1.IngressRule{
@@ -173,8 +133,6 @@ func newRegistryIngressCr(cr *gitifold.VCS) *netv1.Ingress {
 func newRegistryPVCCr(cr *gitifold.VCS) *corev1.PersistentVolumeClaim {
 	name, labels := getRegistryNames(cr)
 
-	size, _ := resource.ParseQuantity("1Gi")
-	//storageClass := "test"
 	return &corev1.PersistentVolumeClaim{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "PersistentVolumeClaim",
@@ -185,21 +143,12 @@ func newRegistryPVCCr(cr *gitifold.VCS) *corev1.PersistentVolumeClaim {
 			Namespace: cr.Namespace,
 			Labels:    labels,
 		},
-		Spec: corev1.PersistentVolumeClaimSpec{
-			Resources: corev1.ResourceRequirements{
-				Requests: corev1.ResourceList{
-					"storage": size,
-				},
-			},
-			// StorageClassName: &storageClass,
-			AccessModes: []corev1.PersistentVolumeAccessMode{
-				corev1.ReadWriteMany,
-			},
-		},
+		Spec: claimSpec(cr.Spec.Registry.Storage, "1Gi"),
 	}
 }
 func newRegistryDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 	name, labels := getRegistryNames(cr)
+	image, pullPolicy := containerImage("registry", cr.Spec.Registry.Image, cr)
 
 	limitCpu, _ := resource.ParseQuantity("250m")
 	limitMemory, _ := resource.ParseQuantity("1024Mi")
@@ -208,7 +157,7 @@ func newRegistryDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 
 	var rc int32
 	rc = 1
-	return &appsv1.Deployment{
+	dep := &appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Deployment",
 			APIVersion: "apps/v1",
@@ -228,6 +177,7 @@ func newRegistryDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
+					ImagePullSecrets: cr.Spec.ImagePullSecrets,
 					Volumes: []corev1.Volume{
 						{
 							Name: "registry",
@@ -240,8 +190,9 @@ func newRegistryDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 					},
 					Containers: []corev1.Container{
 						{
-							Name:  "registry",
-							Image: "registry:2.7.1",
+							Name:            "registry",
+							Image:           image,
+							ImagePullPolicy: pullPolicy,
 							VolumeMounts: []corev1.VolumeMount{
 								{
 									Name:      "registry",
@@ -275,7 +226,7 @@ func newRegistryDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 								InitialDelaySeconds: int32(5),
 								PeriodSeconds:       int32(6),
 							},
-							Resources: corev1.ResourceRequirements{
+							Resources: workloadResources(cr.Spec.Registry.WorkloadSpec, corev1.ResourceRequirements{
 								Limits: corev1.ResourceList{
 									"cpu":    limitCpu,
 									"memory": limitMemory,
@@ -284,11 +235,13 @@ func newRegistryDeploymentCr(cr *gitifold.VCS) *appsv1.Deployment {
 									"cpu":    requestCpu,
 									"memory": requestMemory,
 								},
-							},
+							}),
 						},
 					},
 				},
 			},
 		},
 	}
+	schedulePod(cr.Spec.Registry.WorkloadSpec, &dep.Spec.Template.Spec)
+	return dep
 }
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var volumeSnapshotGVK = schema.GroupVersionKind{
+	Group:   "snapshot.storage.k8s.io",
+	Version: "v1beta1",
+	Kind:    "VolumeSnapshot",
+}
+
+func retentionPolicy(cr *gitifold.VCS) gitifold.RetentionPolicy {
+	if cr.Spec.RetentionPolicy == "" {
+		return gitifold.RetentionRetain
+	}
+	return cr.Spec.RetentionPolicy
+}
+
+// pgClaimNames are the claims the postgres StatefulSet creates from its
+// volumeClaimTemplate, one per pod.
+func pgClaimNames(component string, cr *gitifold.VCS) []string {
+	return pgClaimNamesAt(component, pgRunningVersion(component, cr), cr)
+}
+
+// pgClaimNamesAt are the claims holding the data of a major version.
+func pgClaimNamesAt(component, version string, cr *gitifold.VCS) []string {
+	data := pgDataName(component, version, cr)
+	claims := []string{}
+	for ordinal := int32(0); ordinal <= pgSpec(component, cr).Replicas; ordinal++ {
+		claims = append(claims, strings.Join([]string{data, pgPodName(component, ordinal, cr)}, "-"))
+	}
+	return claims
+}
+
+// vcsClaims lists every PersistentVolumeClaim holding VCS data, the
+// postgres and KeyDB replica claims are created by their StatefulSets and so
+// are not owned by the VCS.
+func vcsClaims(cr *gitifold.VCS) (owned []string, unowned []string) {
+	giteaName, _ := giteaLabels(cr)
+	registryName, _ := getRegistryNames(cr)
+	keydbName, _ := keydbLabelNames("gitea", cr)
+
+	owned = []string{giteaName, giteaBackupClaimName(cr), registryName, keydbName}
+	for _, component := range agolaComponents {
+		if component.storage {
+			name, _ := agolaLabelNames(component.name, cr)
+			owned = append(owned, name)
+		}
+	}
+	for _, component := range []string{"gitea", "drone", "clair", "shared"} {
+		unowned = append(unowned, pgClaimNames(component, cr)...)
+		unowned = append(unowned, pgPreviousClaimNames(component, cr)...)
+		owned = append(owned, pgUpgradeClaimName(component, cr))
+		unowned = append(unowned, pgRecoveryClaimName(component, cr))
+	}
+	unowned = append(unowned, keydbClaimNames("gitea", cr)...)
+	return owned, append(unowned, agolaEtcdClaimName(cr))
+}
+
+// vcsCredentials lists the secrets needed to open the retained volumes again.
+func vcsCredentials(cr *gitifold.VCS) []string {
+	giteaName, _ := giteaLabels(cr)
+	droneName, _ := droneLabelNames("app", cr)
+	agolaName, _ := agolaLabelNames("app", cr)
+	giteaPg, _ := pgLabelNames("gitea", cr)
+	dronePg, _ := pgLabelNames("drone", cr)
+	clairPg, _ := pgLabelNames("clair", cr)
+	sharedPg, _ := pgLabelNames("shared", cr)
+
+	return []string{
+		giteaName,
+		giteaAdminSecretName(cr),
+		droneName,
+		agolaName,
+		giteaPg,
+		dronePg,
+		clairPg,
+		sharedPg,
+	}
+}
+
+// finalizeVolumes applies the retention policy to the VCS data, it returns
+// false while it is still waiting on volume snapshots.
+func finalizeVolumes(cr *gitifold.VCS, r *VCSReconciler) (bool, error) {
+	owned, unowned := vcsClaims(cr)
+
+	switch retentionPolicy(cr) {
+	case gitifold.RetentionDelete:
+		// owned claims and secrets are garbage collected with the VCS
+		return true, deleteClaims(unowned, cr, r)
+	case gitifold.RetentionSnapshot:
+		ready, err := snapshotClaims(append(owned, unowned...), cr, r)
+		if err != nil || !ready {
+			return false, err
+		}
+		if err = orphanSecrets(vcsCredentials(cr), cr, r); err != nil {
+			return false, err
+		}
+		return true, deleteClaims(unowned, cr, r)
+	default:
+		for _, name := range owned {
+			if err := orphanObject("PersistentVolumeClaim", cr, r, &corev1.PersistentVolumeClaim{}, name); err != nil {
+				return false, err
+			}
+		}
+		return true, orphanSecrets(vcsCredentials(cr), cr, r)
+	}
+}
+
+func deleteClaims(names []string, cr *gitifold.VCS, r *VCSReconciler) error {
+	for _, name := range names {
+		pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cr.Namespace}}
+		if err := deleteObject("PersistentVolumeClaim", cr, r, pvc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func orphanSecrets(names []string, cr *gitifold.VCS, r *VCSReconciler) error {
+	for _, name := range names {
+		if err := orphanObject("Secret", cr, r, &corev1.Secret{}, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orphanObject drops the owner reference to the VCS, so the object outlives
+// it and is adopted again by a VCS of the same name.
+func orphanObject(kind string, cr *gitifold.VCS, r *VCSReconciler, obj managedObject, name string) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, obj)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	refs := obj.GetOwnerReferences()
+	kept := make([]metav1.OwnerReference, 0, len(refs))
+	for _, ref := range refs {
+		if ref.UID != cr.UID {
+			kept = append(kept, ref)
+		}
+	}
+	if len(kept) == len(refs) {
+		return nil
+	}
+	obj.SetOwnerReferences(kept)
+	if err = r.Client.Update(context.TODO(), obj); err != nil {
+		return err
+	}
+	logger.Info("Retained "+kind, "Name", name)
+	return nil
+}
+
+// snapshotClaims takes a VolumeSnapshot of every existing claim, it returns
+// true once all of them are ready to use.
+func snapshotClaims(names []string, cr *gitifold.VCS, r *VCSReconciler) (bool, error) {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	ready := true
+	for _, name := range names {
+		err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, &corev1.PersistentVolumeClaim{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+
+		snapshot := newVolumeSnapshot(name, cr)
+		found := &unstructured.Unstructured{}
+		found.SetGroupVersionKind(volumeSnapshotGVK)
+		err = r.Client.Get(context.TODO(), types.NamespacedName{Name: snapshot.GetName(), Namespace: cr.Namespace}, found)
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return false, err
+			}
+			if err = r.Client.Create(context.TODO(), snapshot); err != nil {
+				return false, err
+			}
+			logger.Info("Created VolumeSnapshot", "Name", snapshot.GetName(), "PersistentVolumeClaim", name)
+			ready = false
+			continue
+		}
+
+		if message, ok, _ := unstructured.NestedString(found.Object, "status", "error", "message"); ok {
+			return false, fmt.Errorf("snapshot %s of %s failed: %s", found.GetName(), name, message)
+		}
+		if done, _, _ := unstructured.NestedBool(found.Object, "status", "readyToUse"); !done {
+			ready = false
+		}
+	}
+	return ready, nil
+}
+
+// snapshotName tells the snapshots of VCSs reusing a name apart by the
+// start of their UID.
+func snapshotName(claim string, cr *gitifold.VCS) string {
+	uid := string(cr.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	if uid == "" {
+		return claim
+	}
+	return strings.Join([]string{claim, uid}, "-")
+}
+
+// newVolumeSnapshot is deliberately not owned by the VCS, the whole point
+// is for it to outlive it.
+func newVolumeSnapshot(claim string, cr *gitifold.VCS) *unstructured.Unstructured {
+	_, labels := giteaLabels(cr)
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	snapshot.SetName(snapshotName(claim, cr))
+	snapshot.SetNamespace(cr.Namespace)
+	snapshot.SetLabels(map[string]string{
+		"deployment": labels["deployment"],
+		"instance":   labels["instance"],
+	})
+
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": claim,
+		},
+	}
+	if cr.Spec.VolumeSnapshotClassName != "" {
+		spec["volumeSnapshotClassName"] = cr.Spec.VolumeSnapshotClassName
+	}
+	snapshot.Object["spec"] = spec
+
+	return snapshot
+}
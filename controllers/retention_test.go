@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSnapshotName(t *testing.T) {
+	tests := []struct {
+		uid  types.UID
+		want string
+	}{
+		{uid: "", want: "data"},
+		{uid: "1234", want: "data-1234"},
+		{uid: "0c2d6e5a-8f0b-4f6e-9d5e-2a1b3c4d5e6f", want: "data-0c2d6e5a"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.uid), func(t *testing.T) {
+			cr := testVCS()
+			cr.UID = tt.uid
+			if got := newVolumeSnapshot("data", cr).GetName(); got != tt.want {
+				t.Errorf("snapshot name = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
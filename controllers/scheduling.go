@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// workloadResources returns the resources asked for in spec, or defaults
+// when there are none. They are never merged, so a limit can be dropped.
+func workloadResources(spec gitifold.WorkloadSpec, defaults corev1.ResourceRequirements) corev1.ResourceRequirements {
+	if spec.Resources != nil {
+		return *spec.Resources.DeepCopy()
+	}
+	return defaults
+}
+
+// schedulePod copies the placement controls of spec onto a pod template.
+func schedulePod(spec gitifold.WorkloadSpec, pod *corev1.PodSpec) {
+	pod.NodeSelector = spec.NodeSelector
+	pod.Tolerations = spec.Tolerations
+	pod.Affinity = spec.Affinity.DeepCopy()
+	pod.PriorityClassName = spec.PriorityClassName
+	pod.TopologySpreadConstraints = spec.TopologySpreadConstraints
+}
+
+// samePlacement compares the fields of a pod template a user is expected
+// to unset again, which a derivative comparison can not see being removed.
+func samePlacement(desired, live *corev1.PodSpec) bool {
+	if len(desired.Containers) != len(live.Containers) {
+		return false
+	}
+	for i := range desired.Containers {
+		if !equality.Semantic.DeepEqual(desired.Containers[i].Resources, live.Containers[i].Resources) {
+			return false
+		}
+	}
+	return equality.Semantic.DeepEqual(desired.ImagePullSecrets, live.ImagePullSecrets) &&
+		equality.Semantic.DeepEqual(desired.NodeSelector, live.NodeSelector) &&
+		equality.Semantic.DeepEqual(desired.Tolerations, live.Tolerations) &&
+		equality.Semantic.DeepEqual(desired.Affinity, live.Affinity) &&
+		desired.PriorityClassName == live.PriorityClassName &&
+		equality.Semantic.DeepEqual(desired.TopologySpreadConstraints, live.TopologySpreadConstraints)
+}
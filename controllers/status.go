@@ -0,0 +1,506 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// componentError ties a reconcile failure to the component it happened in,
+// so the status can mark just that component Degraded.
+type componentError struct {
+	component string
+	err       error
+}
+
+func (e *componentError) Error() string {
+	return strings.Join([]string{e.component, e.err.Error()}, ": ")
+}
+
+func (e *componentError) Unwrap() error {
+	return e.err
+}
+
+func wrapComponent(component string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*componentError); ok {
+		return err
+	}
+	return &componentError{component: component, err: err}
+}
+
+type workload struct {
+	component string
+	kind      string
+	name      string
+	claims    []volumeClaim
+}
+
+// vcsWorkloads lists the Deployments, StatefulSets and Jobs rolled up into
+// the VCS status.
+func vcsWorkloads(cr *gitifold.VCS) []workload {
+	giteaName, _ := giteaLabels(cr)
+	bootstrapName, _ := giteaBootstrapLabels(cr)
+	keydbName, _ := keydbLabelNames("gitea", cr)
+	clairName, _ := clairLabelNames(cr)
+	registryName, _ := getRegistryNames(cr)
+
+	workloads := []workload{
+		{component: "gitea", kind: "Deployment", name: giteaName, claims: []volumeClaim{
+			{name: giteaName, size: claimSize(cr.Spec.Git.Storage, "5Gi")},
+		}},
+		{component: "gitea-bootstrap", kind: "Job", name: bootstrapName},
+		{component: "gitea-keydb", kind: "Deployment", name: keydbName},
+	}
+	if cr.Spec.Git.KeyDB.Replicas > 1 {
+		workloads[2].kind = "StatefulSet"
+	}
+	if persistence := cr.Spec.Git.KeyDB.Persistence; persistence != nil {
+		if cr.Spec.Git.KeyDB.Replicas > 1 {
+			for _, name := range keydbClaimNames("gitea", cr) {
+				workloads[2].claims = append(workloads[2].claims, volumeClaim{name: name, size: claimSize(persistence.Storage, "1Gi")})
+			}
+		} else {
+			workloads[2].claims = []volumeClaim{{name: keydbName, size: claimSize(persistence.Storage, "1Gi")}}
+		}
+	}
+	workloads = append(workloads, pgWorkloads("gitea", cr)...)
+	if cr.Spec.SharedPostgres.Enabled {
+		sharedPg, _ := pgLabelNames("shared", cr)
+		workloads = append(workloads, workload{component: "shared-postgres", kind: "StatefulSet", name: sharedPg, claims: pgClaims("shared", cr)})
+		workloads = append(workloads, pgArchiveWorkloads("shared", cr)...)
+		workloads = append(workloads, pgUpgradeWorkloads("shared", cr)...)
+		workloads = append(workloads, pgPoolerWorkloads("shared", cr)...)
+	}
+	if cr.Status.Git.Upgrade != nil {
+		workloads = append(workloads, workload{component: "gitea-upgrade", kind: "Upgrade", claims: []volumeClaim{
+			{name: giteaBackupClaimName(cr), size: claimSize(cr.Spec.Git.BackupStorage, "5Gi")},
+		}})
+	}
+	if isEnabled(cr.Spec.Clair.Enabled) {
+		workloads = append(workloads, workload{component: "clair", kind: "Deployment", name: clairName})
+		workloads = append(workloads, pgWorkloads("clair", cr)...)
+	}
+	if isEnabled(cr.Spec.Registry.Enabled) {
+		workloads = append(workloads, workload{component: "registry", kind: "Deployment", name: registryName, claims: []volumeClaim{
+			{name: registryName, size: claimSize(cr.Spec.Registry.Storage, "1Gi")},
+		}})
+	}
+	if isEnabled(cr.Spec.CI.Enabled) {
+		workloads = append(workloads, ciWorkloads(cr)...)
+	}
+	return workloads
+}
+
+func ciWorkloads(cr *gitifold.VCS) []workload {
+	if ciSystem(cr) == "agola" {
+		etcdName, _ := agolaLabelNames("etcd", cr)
+		workloads := []workload{
+			{component: "agola-etcd", kind: "StatefulSet", name: etcdName, claims: []volumeClaim{
+				{name: agolaEtcdClaimName(cr), size: claimSize(cr.Spec.CI.Storage, "1Gi")},
+			}},
+		}
+		for _, component := range agolaComponents {
+			name, _ := agolaLabelNames(component.name, cr)
+			w := workload{component: "agola-" + component.name, kind: "Deployment", name: name}
+			if component.storage {
+				w.claims = []volumeClaim{{name: name, size: claimSize(cr.Spec.CI.Storage, "5Gi")}}
+			}
+			workloads = append(workloads, w)
+		}
+		return workloads
+	}
+
+	droneName, _ := droneLabelNames("app", cr)
+	runnerName, _ := droneLabelNames("runner", cr)
+	workloads := []workload{
+		{component: "drone", kind: "Deployment", name: droneName},
+		{component: "drone-runner", kind: "Deployment", name: runnerName},
+	}
+	return append(workloads, pgWorkloads("drone", cr)...)
+}
+
+// pgWorkloads is the bundled database of a component, or the Job creating
+// it in the shared instance, and its backups. An external one is not
+// watched.
+func pgWorkloads(component string, cr *gitifold.VCS) []workload {
+	workloads := []workload{}
+	if pgSpec(component, cr).Backup != nil {
+		workloads = append(workloads, workload{component: component + "-backup", kind: "CronJob", name: pgBackupName(component, cr)})
+	}
+	if pgSpec(component, cr).External != nil {
+		return workloads
+	}
+	if cr.Spec.SharedPostgres.Enabled {
+		return append(workloads, workload{component: component + "-postgres", kind: "Job", name: pgProvisionJobName(component, cr)})
+	}
+	name, _ := pgLabelNames(component, cr)
+	workloads = append(workloads, workload{component: component + "-postgres", kind: "StatefulSet", name: name, claims: pgClaims(component, cr)})
+	workloads = append(workloads, pgUpgradeWorkloads(component, cr)...)
+	workloads = append(workloads, pgPoolerWorkloads(component, cr)...)
+	return append(workloads, pgArchiveWorkloads(component, cr)...)
+}
+
+func pgPoolerWorkloads(component string, cr *gitifold.VCS) []workload {
+	if pgSpec(component, cr).Pooler == nil {
+		return nil
+	}
+	name, _ := pgPoolerLabelNames(component, cr)
+	return []workload{{component: component + "-pooler", kind: "Deployment", name: name}}
+}
+
+// pgUpgradeWorkloads is the last major upgrade of an instance, and the
+// volume holding its dump.
+func pgUpgradeWorkloads(component string, cr *gitifold.VCS) []workload {
+	for _, status := range cr.Status.PostgresVersions {
+		if status.Name == component && status.Upgrade != nil {
+			return []workload{{component: component + "-postgres-upgrade", kind: "PostgresUpgrade", name: component, claims: []volumeClaim{
+				{name: pgUpgradeClaimName(component, cr), size: claimSize(pgSpec(component, cr).Storage, "2Gi")},
+			}}}
+		}
+	}
+	return nil
+}
+
+// pgArchiveWorkloads are the base backups of an archived instance, and its
+// recovered copy.
+func pgArchiveWorkloads(component string, cr *gitifold.VCS) []workload {
+	spec := pgSpec(component, cr)
+	if spec.Archive == nil {
+		return nil
+	}
+	workloads := []workload{{component: component + "-basebackup", kind: "CronJob", name: pgBaseBackupName(component, cr)}}
+	if spec.Recovery != nil {
+		workloads = append(workloads, workload{component: component + "-recovery", kind: "StatefulSet", name: pgRecoveryName(component, cr), claims: []volumeClaim{
+			{name: pgRecoveryClaimName(component, cr), size: claimSize(spec.Storage, "2Gi")},
+		}})
+	}
+	return workloads
+}
+
+func pgClaims(component string, cr *gitifold.VCS) []volumeClaim {
+	claims := []volumeClaim{}
+	for _, name := range pgClaimNames(component, cr) {
+		claims = append(claims, volumeClaim{name: name, size: claimSize(pgSpec(component, cr).Storage, "2Gi")})
+	}
+	return claims
+}
+
+func newCondition(conditionType gitifold.ConditionType, status bool, reason, message string, cr *gitifold.VCS) gitifold.Condition {
+	s := corev1.ConditionFalse
+	if status {
+		s = corev1.ConditionTrue
+	}
+	return gitifold.Condition{
+		Type:               conditionType,
+		Status:             s,
+		ObservedGeneration: cr.Generation,
+		Reason:             reason,
+		Message:            message,
+	}
+}
+
+func deploymentConditions(name string, cr *gitifold.VCS, r *VCSReconciler) ([]gitifold.Condition, error) {
+	dep := &appsv1.Deployment{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, dep)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return missingConditions(cr), nil
+		}
+		return nil, err
+	}
+
+	desired := int32(1)
+	if dep.Spec.Replicas != nil {
+		desired = *dep.Spec.Replicas
+	}
+	observed := dep.Status.ObservedGeneration >= dep.Generation
+	ready := observed && dep.Status.AvailableReplicas >= desired
+	rolledOut := observed && dep.Status.UpdatedReplicas == desired && dep.Status.Replicas == desired
+
+	degraded, reason, message := false, "AsExpected", ""
+	for _, c := range dep.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Status == corev1.ConditionFalse {
+			degraded, reason, message = true, c.Reason, c.Message
+		}
+		if c.Type == appsv1.DeploymentReplicaFailure && c.Status == corev1.ConditionTrue {
+			degraded, reason, message = true, c.Reason, c.Message
+		}
+	}
+
+	return []gitifold.Condition{
+		readyCondition(ready, dep.Status.AvailableReplicas, desired, cr),
+		progressingCondition(!(ready && rolledOut), cr),
+		newCondition(gitifold.ConditionDegraded, degraded, reason, message, cr),
+	}, nil
+}
+
+func statefulSetConditions(name string, cr *gitifold.VCS, r *VCSReconciler) ([]gitifold.Condition, error) {
+	sts := &appsv1.StatefulSet{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, sts)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return missingConditions(cr), nil
+		}
+		return nil, err
+	}
+
+	desired := int32(1)
+	if sts.Spec.Replicas != nil {
+		desired = *sts.Spec.Replicas
+	}
+	observed := sts.Status.ObservedGeneration >= sts.Generation
+	ready := observed && sts.Status.ReadyReplicas >= desired
+	rolledOut := observed && sts.Status.UpdatedReplicas == desired &&
+		(sts.Status.UpdateRevision == "" || sts.Status.CurrentRevision == sts.Status.UpdateRevision)
+
+	return []gitifold.Condition{
+		readyCondition(ready, sts.Status.ReadyReplicas, desired, cr),
+		progressingCondition(!(ready && rolledOut), cr),
+		newCondition(gitifold.ConditionDegraded, false, "AsExpected", "", cr),
+	}, nil
+}
+
+func jobConditions(name string, cr *gitifold.VCS, r *VCSReconciler) ([]gitifold.Condition, error) {
+	job := &batchv1.Job{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, job)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return missingConditions(cr), nil
+		}
+		return nil, err
+	}
+
+	ready := newCondition(gitifold.ConditionReady, false, "Running", "", cr)
+	if job.Status.Succeeded > 0 {
+		ready = newCondition(gitifold.ConditionReady, true, "Completed", "", cr)
+	}
+
+	degraded, reason, message := false, "AsExpected", ""
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			degraded, reason, message = true, c.Reason, c.Message
+		}
+	}
+
+	return []gitifold.Condition{
+		ready,
+		progressingCondition(job.Status.Succeeded == 0 && !degraded, cr),
+		newCondition(gitifold.ConditionDegraded, degraded, reason, message, cr),
+	}, nil
+}
+
+// upgradeConditions reports the last Gitea upgrade, a rolled back upgrade
+// stays Degraded until the version asked for is changed.
+func upgradeConditions(cr *gitifold.VCS) []gitifold.Condition {
+	upgrade := cr.Status.Git.Upgrade
+	phase := string(upgrade.Phase)
+	settled := !upgradeInProgress(cr) && giteaVersion(cr) == cr.Status.Git.Version
+	failed := upgrade.Phase == gitifold.UpgradeRollbackFailed ||
+		(upgrade.Phase == gitifold.UpgradeFailed && giteaVersion(cr) == upgrade.ToVersion)
+
+	return []gitifold.Condition{
+		newCondition(gitifold.ConditionReady, settled, phase, upgrade.Message, cr),
+		newCondition(gitifold.ConditionProgressing, upgradeInProgress(cr), phase, upgrade.Message, cr),
+		newCondition(gitifold.ConditionDegraded, failed, phase, upgrade.Message, cr),
+	}
+}
+
+// pgUpgradeConditions report the last major upgrade of a Postgres instance.
+func pgUpgradeConditions(component string, cr *gitifold.VCS) []gitifold.Condition {
+	status := pgVersionStatus(component, cr.Status.DeepCopy())
+	upgrade := status.Upgrade
+	phase := string(upgrade.Phase)
+	settled := !pgUpgradeInProgress(upgrade) && pgVersion(component, cr) == status.Version
+	failed := upgrade.Phase == gitifold.PostgresUpgradeFailed
+
+	return []gitifold.Condition{
+		newCondition(gitifold.ConditionReady, settled, phase, upgrade.Message, cr),
+		newCondition(gitifold.ConditionProgressing, pgUpgradeInProgress(upgrade), phase, upgrade.Message, cr),
+		newCondition(gitifold.ConditionDegraded, failed, phase, upgrade.Message, cr),
+	}
+}
+
+func missingConditions(cr *gitifold.VCS) []gitifold.Condition {
+	return []gitifold.Condition{
+		newCondition(gitifold.ConditionReady, false, "NotFound", "waiting for the workload to be created", cr),
+		newCondition(gitifold.ConditionProgressing, true, "Creating", "", cr),
+		newCondition(gitifold.ConditionDegraded, false, "AsExpected", "", cr),
+	}
+}
+
+func readyCondition(ready bool, available, desired int32, cr *gitifold.VCS) gitifold.Condition {
+	if ready {
+		return newCondition(gitifold.ConditionReady, true, "ReplicasAvailable", "", cr)
+	}
+	return newCondition(gitifold.ConditionReady, false, "ReplicasUnavailable",
+		fmt.Sprintf("%d of %d replicas available", available, desired), cr)
+}
+
+func progressingCondition(progressing bool, cr *gitifold.VCS) gitifold.Condition {
+	if progressing {
+		return newCondition(gitifold.ConditionProgressing, true, "RollingOut", "", cr)
+	}
+	return newCondition(gitifold.ConditionProgressing, false, "RolloutComplete", "", cr)
+}
+
+func isTrue(conditions []gitifold.Condition, conditionType gitifold.ConditionType) bool {
+	c := gitifold.FindCondition(conditions, conditionType)
+	return c != nil && c.Status == corev1.ConditionTrue
+}
+
+func endpoint(hostname string) string {
+	if hostname == "" {
+		return ""
+	}
+	return strings.Join([]string{"https://", hostname}, "")
+}
+
+// updateVCSStatus recomputes the VCS status from the live workloads and the
+// outcome of the current reconcile, and writes it back if it changed.
+func updateVCSStatus(cr *gitifold.VCS, r *VCSReconciler, reconcileErr error) error {
+	status := cr.Status.DeepCopy()
+	previous := cr.Status.DeepCopy()
+	status.Components = nil
+
+	failed := ""
+	if ce, ok := reconcileErr.(*componentError); ok {
+		failed = ce.component
+	}
+
+	anyFound, allReady, anyProgressing, anyDegraded := false, true, false, false
+	for _, w := range vcsWorkloads(cr) {
+		var conditions []gitifold.Condition
+		var err error
+		switch w.kind {
+		case "StatefulSet":
+			conditions, err = statefulSetConditions(w.name, cr, r)
+		case "Job":
+			conditions, err = jobConditions(w.name, cr, r)
+		case "CronJob":
+			conditions, err = cronJobConditions(w.name, cr, r)
+		case "Upgrade":
+			conditions = upgradeConditions(cr)
+		case "PostgresUpgrade":
+			conditions = pgUpgradeConditions(w.name, cr)
+		default:
+			conditions, err = deploymentConditions(w.name, cr, r)
+		}
+		if err != nil {
+			return err
+		}
+		if err = claimConditions(w.claims, conditions, cr, r); err != nil {
+			return err
+		}
+		if w.component == failed {
+			conditions[2] = newCondition(gitifold.ConditionDegraded, true, "ReconcileFailed", reconcileErr.Error(), cr)
+		}
+
+		component := status.Component(w.component)
+		for _, old := range previous.Components {
+			if old.Name == w.component {
+				component.Conditions = append([]gitifold.Condition(nil), old.Conditions...)
+			}
+		}
+		for _, c := range conditions {
+			gitifold.SetCondition(&component.Conditions, c)
+		}
+
+		if c := gitifold.FindCondition(component.Conditions, gitifold.ConditionReady); c != nil && c.Reason != "NotFound" {
+			anyFound = true
+		}
+		allReady = allReady && isTrue(component.Conditions, gitifold.ConditionReady)
+		anyProgressing = anyProgressing || isTrue(component.Conditions, gitifold.ConditionProgressing)
+		anyDegraded = anyDegraded || isTrue(component.Conditions, gitifold.ConditionDegraded)
+	}
+
+	degradedReason, degradedMessage := "AsExpected", ""
+	if reconcileErr != nil {
+		anyDegraded = true
+		degradedReason, degradedMessage = "ReconcileFailed", reconcileErr.Error()
+	} else if anyDegraded {
+		degradedReason = "ComponentDegraded"
+	}
+	gitifold.SetCondition(&status.Conditions, newCondition(gitifold.ConditionReady, allReady, "ComponentsReady", "", cr))
+	gitifold.SetCondition(&status.Conditions, newCondition(gitifold.ConditionProgressing, anyProgressing, "ComponentsProgressing", "", cr))
+	gitifold.SetCondition(&status.Conditions, newCondition(gitifold.ConditionDegraded, anyDegraded, degradedReason, degradedMessage, cr))
+
+	switch {
+	case anyDegraded:
+		status.Phase = gitifold.VCSDegraded
+	case allReady:
+		status.Phase = gitifold.VCSReady
+	case anyFound:
+		status.Phase = gitifold.VCSProgressing
+	default:
+		status.Phase = gitifold.VCSPending
+	}
+
+	status.ObservedGeneration = cr.Generation
+	status.Endpoints = gitifold.VCSEndpoints{
+		Git: endpoint(cr.Spec.Git.Hostname),
+	}
+	if isEnabled(cr.Spec.CI.Enabled) {
+		status.Endpoints.CI = endpoint(cr.Spec.CI.Hostname)
+	}
+	if isEnabled(cr.Spec.Registry.Enabled) {
+		status.Endpoints.Registry = endpoint(cr.Spec.Registry.Hostname)
+	}
+	if isEnabled(cr.Spec.Clair.Enabled) {
+		status.Endpoints.Clair = endpoint(cr.Spec.Clair.Hostname)
+	}
+
+	// only what was restored is carried over
+	status.Postgres = nil
+	status.Backups = nil
+	status.Archives = nil
+	for _, w := range vcsWorkloads(cr) {
+		if w.kind == "CronJob" && strings.HasSuffix(w.component, "-basebackup") {
+			archive := gitifold.PostgresArchiveStatus{Name: strings.TrimSuffix(w.component, "-basebackup")}
+			if err := observePgArchive(archive.Name, &archive, cr, r); err != nil {
+				return err
+			}
+			status.Archives = append(status.Archives, archive)
+			continue
+		}
+		if w.kind == "CronJob" {
+			backups := gitifold.PostgresBackupStatus{Name: strings.TrimSuffix(w.component, "-backup")}
+			for _, old := range previous.Backups {
+				if old.Name == backups.Name {
+					backups.RestoredFrom = old.RestoredFrom
+				}
+			}
+			if err := observePgBackups(backups.Name, &backups, cr, r); err != nil {
+				return err
+			}
+			status.Backups = append(status.Backups, backups)
+			continue
+		}
+		component := strings.TrimSuffix(w.component, "-postgres")
+		if w.kind != "StatefulSet" || component == w.component || pgSpec(component, cr).Replicas == 0 {
+			continue
+		}
+		replication, err := pgReplicationStatus(component, cr, r)
+		if err != nil {
+			return err
+		}
+		status.Postgres = append(status.Postgres, replication)
+	}
+
+	if equality.Semantic.DeepEqual(status, previous) {
+		return nil
+	}
+	cr.Status = *status
+	return r.Client.Status().Update(context.TODO(), cr)
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// volumeClaim is a claim backing a workload, and the size the VCS asks for.
+type volumeClaim struct {
+	name string
+	size resource.Quantity
+}
+
+func claimSize(storage gitifold.StorageSpec, defaultSize string) resource.Quantity {
+	return claimSpec(storage, defaultSize).Resources.Requests[corev1.ResourceStorage]
+}
+
+// claimSpec builds the spec of a claim from storage, falling back to
+// defaultSize and ReadWriteOnce for whatever is left unset.
+func claimSpec(storage gitifold.StorageSpec, defaultSize string) corev1.PersistentVolumeClaimSpec {
+	size, _ := resource.ParseQuantity(defaultSize)
+	if storage.Size != nil {
+		size = storage.Size.DeepCopy()
+	}
+	accessModes := storage.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []corev1.PersistentVolumeAccessMode{
+			corev1.ReadWriteOnce,
+		}
+	}
+
+	return corev1.PersistentVolumeClaimSpec{
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				"storage": size,
+			},
+		},
+		StorageClassName: storage.StorageClassName,
+		AccessModes:      accessModes,
+		Selector:         storage.Selector.DeepCopy(),
+	}
+}
+
+// growClaim raises the storage request of pvc to size, it never lowers it.
+func growClaim(pvc *corev1.PersistentVolumeClaim, size resource.Quantity) bool {
+	current := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	if size.Cmp(current) <= 0 {
+		return false
+	}
+	if pvc.Spec.Resources.Requests == nil {
+		pvc.Spec.Resources.Requests = corev1.ResourceList{}
+	}
+	pvc.Spec.Resources.Requests[corev1.ResourceStorage] = size
+	return true
+}
+
+// expandClaim grows a claim the operator does not own in place, like the
+// ones created from a StatefulSet's volumeClaimTemplates, which cannot be
+// changed on a live StatefulSet.
+func expandClaim(name string, size resource.Quantity, cr *gitifold.VCS, r *VCSReconciler) error {
+	logger := r.Log.WithValues("Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, pvc)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !growClaim(pvc, size) {
+		return nil
+	}
+	if err = r.Client.Update(context.TODO(), pvc); err != nil {
+		return err
+	}
+	logger.Info("Expanding PersistentVolumeClaim", "Name", name, "Size", size.String())
+	return nil
+}
+
+// claimConditions folds the state of the claims backing a workload into its
+// Ready, Progressing and Degraded conditions: a claim still being resized
+// holds Ready back, and a claim asked to shrink marks it Degraded.
+func claimConditions(claims []volumeClaim, conditions []gitifold.Condition, cr *gitifold.VCS, r *VCSReconciler) error {
+	for _, claim := range claims {
+		pvc := &corev1.PersistentVolumeClaim{}
+		err := r.Client.Get(context.TODO(), types.NamespacedName{Name: claim.name, Namespace: cr.Namespace}, pvc)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if claim.size.Cmp(requested) < 0 {
+			conditions[2] = newCondition(gitifold.ConditionDegraded, true, "ShrinkRefused",
+				fmt.Sprintf("%s is %s, volumes cannot be shrunk to %s", claim.name, requested.String(), claim.size.String()), cr)
+		}
+
+		reason := ""
+		for _, c := range pvc.Status.Conditions {
+			if c.Status != corev1.ConditionTrue {
+				continue
+			}
+			if c.Type == corev1.PersistentVolumeClaimFileSystemResizePending || c.Type == corev1.PersistentVolumeClaimResizing {
+				reason = string(c.Type)
+			}
+		}
+		capacity, bound := pvc.Status.Capacity[corev1.ResourceStorage]
+		if reason == "" && bound && capacity.Cmp(requested) < 0 {
+			reason = "Resizing"
+		}
+		if reason != "" {
+			message := fmt.Sprintf("%s is being expanded to %s", claim.name, requested.String())
+			conditions[0] = newCondition(gitifold.ConditionReady, false, reason, message, cr)
+			conditions[1] = newCondition(gitifold.ConditionProgressing, true, reason, message, cr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// testReconciler is a VCSReconciler backed by a fake client holding objs.
+func testReconciler(objs ...runtime.Object) *VCSReconciler {
+	s := runtime.NewScheme()
+	_ = scheme.AddToScheme(s)
+	_ = gitifold.AddToScheme(s)
+	return &VCSReconciler{
+		Client: fake.NewFakeClientWithScheme(s, objs...),
+		Log:    logf.NullLogger{},
+		Scheme: s,
+	}
+}
+
+func testVCS() *gitifold.VCS {
+	return &gitifold.VCS{ObjectMeta: metav1.ObjectMeta{Name: "vcs", Namespace: "default"}}
+}
+
+func TestClaimConditions(t *testing.T) {
+	claim := func(requested, capacity string, conditions ...corev1.PersistentVolumeClaimConditionType) *corev1.PersistentVolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(requested)},
+				},
+			},
+		}
+		if capacity != "" {
+			pvc.Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)}
+		}
+		for _, c := range conditions {
+			pvc.Status.Conditions = append(pvc.Status.Conditions, corev1.PersistentVolumeClaimCondition{Type: c, Status: corev1.ConditionTrue})
+		}
+		return pvc
+	}
+
+	tests := []struct {
+		name        string
+		pvc         *corev1.PersistentVolumeClaim
+		size        string
+		ready       bool
+		reason      string
+		degraded    bool
+		progressing bool
+	}{
+		{name: "missing", size: "5Gi", ready: true},
+		{name: "bound", pvc: claim("5Gi", "5Gi"), size: "5Gi", ready: true},
+		{name: "pending", pvc: claim("5Gi", ""), size: "5Gi", ready: true},
+		{name: "resizing", pvc: claim("10Gi", "5Gi", corev1.PersistentVolumeClaimResizing), size: "10Gi", reason: "Resizing", progressing: true},
+		{name: "file system resize", pvc: claim("10Gi", "5Gi", corev1.PersistentVolumeClaimFileSystemResizePending), size: "10Gi", reason: "FileSystemResizePending", progressing: true},
+		{name: "capacity behind", pvc: claim("10Gi", "5Gi"), size: "10Gi", reason: "Resizing", progressing: true},
+		{name: "shrink refused", pvc: claim("10Gi", "10Gi"), size: "5Gi", ready: true, degraded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			objs := []runtime.Object{}
+			if tt.pvc != nil {
+				objs = append(objs, tt.pvc)
+			}
+			conditions := []gitifold.Condition{
+				readyCondition(true, 1, 1, cr),
+				progressingCondition(false, cr),
+				newCondition(gitifold.ConditionDegraded, false, "", "", cr),
+			}
+
+			claims := []volumeClaim{{name: "data", size: resource.MustParse(tt.size)}}
+			if err := claimConditions(claims, conditions, cr, testReconciler(objs...)); err != nil {
+				t.Fatal(err)
+			}
+			if ready := conditions[0].Status == corev1.ConditionTrue; ready != tt.ready {
+				t.Errorf("Ready = %v, want %v", ready, tt.ready)
+			}
+			if !tt.ready && conditions[0].Reason != tt.reason {
+				t.Errorf("Ready reason = %q, want %q", conditions[0].Reason, tt.reason)
+			}
+			if progressing := conditions[1].Status == corev1.ConditionTrue; progressing != tt.progressing {
+				t.Errorf("Progressing = %v, want %v", progressing, tt.progressing)
+			}
+			if degraded := conditions[2].Status == corev1.ConditionTrue; degraded != tt.degraded {
+				t.Errorf("Degraded = %v, want %v", degraded, tt.degraded)
+			}
+		})
+	}
+}
+
+func TestGrowClaim(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		size    string
+		want    string
+		grown   bool
+	}{
+		{name: "grow", current: "5Gi", size: "10Gi", want: "10Gi", grown: true},
+		{name: "same", current: "5Gi", size: "5Gi", want: "5Gi"},
+		{name: "same written differently", current: "1Gi", size: "1024Mi", want: "1Gi"},
+		{name: "shrink", current: "10Gi", size: "5Gi", want: "10Gi"},
+		{name: "no request", size: "5Gi", want: "5Gi", grown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			if tt.current != "" {
+				pvc.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(tt.current)}
+			}
+			if grown := growClaim(pvc, resource.MustParse(tt.size)); grown != tt.grown {
+				t.Errorf("growClaim() = %v, want %v", grown, tt.grown)
+			}
+			got := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+			if want := resource.MustParse(tt.want); got.Cmp(want) != 0 {
+				t.Errorf("storage request = %s, want %s", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestExpandStatefulSetClaim(t *testing.T) {
+	tests := []struct {
+		name    string
+		claim   string
+		size    string
+		want    string
+		missing bool
+	}{
+		{name: "grown", claim: "2Gi", size: "5Gi", want: "5Gi"},
+		{name: "unchanged", claim: "2Gi", size: "2Gi", want: "2Gi"},
+		{name: "shrink refused", claim: "5Gi", size: "2Gi", want: "5Gi"},
+		{name: "not created yet", size: "5Gi", missing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := testVCS()
+			live := newAgolaEtcdStatefulSetCr(cr)
+			objs := []runtime.Object{live}
+			if !tt.missing {
+				pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: agolaEtcdClaimName(cr), Namespace: cr.Namespace}}
+				pvc.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(tt.claim)}
+				objs = append(objs, pvc)
+			}
+			r := testReconciler(objs...)
+			template := live.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests[corev1.ResourceStorage]
+
+			size := resource.MustParse(tt.size)
+			cr.Spec.CI.Storage.Size = &size
+			if err := reconcileStatefulSet(cr, r, newAgolaEtcdStatefulSetCr(cr)); err != nil {
+				t.Fatal(err)
+			}
+			if err := expandClaim(agolaEtcdClaimName(cr), claimSize(cr.Spec.CI.Storage, "1Gi"), cr, r); err != nil {
+				t.Fatal(err)
+			}
+
+			// the claim template of a live StatefulSet can not be changed
+			sts := &appsv1.StatefulSet{}
+			if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: live.Name, Namespace: cr.Namespace}, sts); err != nil {
+				t.Fatal(err)
+			}
+			if got := sts.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests[corev1.ResourceStorage]; got.Cmp(template) != 0 {
+				t.Errorf("claim template = %s, want %s", got.String(), template.String())
+			}
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			err := r.Client.Get(context.TODO(), types.NamespacedName{Name: agolaEtcdClaimName(cr), Namespace: cr.Namespace}, pvc)
+			if tt.missing {
+				if !errors.IsNotFound(err) {
+					t.Errorf("claim was created: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := pvc.Spec.Resources.Requests[corev1.ResourceStorage], resource.MustParse(tt.want); got.Cmp(want) != 0 {
+				t.Errorf("claim = %s, want %s", got.String(), want.String())
+			}
+		})
+	}
+}
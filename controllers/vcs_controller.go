@@ -18,19 +18,44 @@ package controllers
 
 import (
 	"context"
-	"strings"
+	erro "errors"
+	"time"
 
 	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1beta1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-
-	"code.gitea.io/sdk/gitea"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	gitifold "hyperspike.io/eng/gitifold/api/v1beta1"
 )
 
+const vcsFinalizer = "gitifold.hyperspike.io/finalizer"
+
+// requeueError marks an expected wait, like a token that has not been
+// bootstrapped yet, the reconcile is retried after the delay instead of
+// being reported as a failure. A degraded wait is one only the operator can
+// end, it is retried all the same but shows in the status.
+type requeueError struct {
+	reason   string
+	after    time.Duration
+	degraded bool
+}
+
+func (e *requeueError) Error() string {
+	return e.reason
+}
+
 // VCSReconciler reconciles a VCS object
 type VCSReconciler struct {
 	client.Client
@@ -42,7 +67,19 @@ type VCSReconciler struct {
 
 // +kubebuilder:rbac:groups=gitifold.hyperspike.io,resources=vcs/status,verbs=get;update;patch
 
-// +kubebuilder:rbac:groups="";networking.k8s.io;apps;rbac.authorization.k8s.io,resources=statefulesets;services;secrets;configmaps;deployments;ingresses;persistentvolumeclaims;serviceaccounts;roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="";networking.k8s.io;apps;rbac.authorization.k8s.io,resources=statefulsets;services;secrets;configmaps;deployments;ingresses;persistentvolumeclaims;serviceaccounts;roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
+
+// +kubebuilder:rbac:groups="";coordination.k8s.io,resources=pods;pods/exec;pods/log;leases,verbs=get;list;watch;create;update;delete
+
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+
+// +kubebuilder:rbac:groups=batch,resources=jobs;cronjobs,verbs=get;list;watch;create;update;patch;delete
+
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create
+
+// +kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;patch;delete
 
 func (r *VCSReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	_ = context.Background()
@@ -58,60 +95,232 @@ func (r *VCSReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
+	if !instance.ObjectMeta.DeletionTimestamp.IsZero() {
+		if containsString(instance.ObjectMeta.Finalizers, vcsFinalizer) {
+			done, err := r.finalizeVCS(instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if !done {
+				logger.Info("waiting on volume snapshots")
+				return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+			}
+			instance.ObjectMeta.Finalizers = removeString(instance.ObjectMeta.Finalizers, vcsFinalizer)
+			if err = r.Client.Update(context.TODO(), instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+	if !containsString(instance.ObjectMeta.Finalizers, vcsFinalizer) {
+		instance.ObjectMeta.Finalizers = append(instance.ObjectMeta.Finalizers, vcsFinalizer)
+		if err = r.Client.Update(context.TODO(), instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	err = r.reconcileComponents(instance)
+	reported := err
+	var wait *requeueError
+	if erro.As(err, &wait) {
+		logger.Info("waiting", "Reason", wait.reason, "RequeueAfter", wait.after)
+		err = nil
+		if !wait.degraded {
+			reported = nil
+		}
+	}
+	if statusErr := updateVCSStatus(instance, r, reported); statusErr != nil {
+		logger.Error(statusErr, "failed to update VCS status")
+		if err == nil {
+			err = statusErr
+		}
+	}
+	if wait != nil && err == nil {
+		return ctrl.Result{RequeueAfter: wait.after}, nil
+	}
+
+	return ctrl.Result{}, err
+}
+
+func (r *VCSReconciler) reconcileComponents(instance *gitifold.VCS) error {
+	logger := r.Log.WithValues("VCS", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	if err := reconcileSharedPg(instance, r); err != nil {
+		return wrapComponent("shared-postgres", err)
+	}
+
 	// Gitea Components
 	dbSecret, err := createPgService("gitea", instance, r)
 	if err != nil {
-		return ctrl.Result{}, err
+		return wrapComponent("gitea-postgres", err)
 	}
-	if err = createKeyDBService("gitea", instance, r); err != nil {
-		return ctrl.Result{}, err
+	keydb, err := createKeyDBService("gitea", instance, r)
+	if err != nil {
+		return wrapComponent("gitea-keydb", err)
 	}
-	if err = createGiteaService(dbSecret, instance, r); err != nil {
-		return ctrl.Result{}, err
+	if err = createGiteaService(dbSecret, keydb, instance, r); err != nil {
+		return wrapComponent("gitea", err)
+	}
+	if err = reconcileGiteaBootstrap(dbSecret, instance, r); err != nil {
+		return wrapComponent("gitea-bootstrap", err)
 	}
-	token, err := fetchGiteaToken(instance, r)
+	gitClient, err := newGiteaClient(instance, r)
 	if err != nil {
-		logger.Info("Gitea Token not ready")
-		return ctrl.Result{}, err
+		return wrapComponent("gitea", err)
 	}
 
-	gitClient := gitea.NewClient(strings.Join([]string{instance.Name, "gitifold", "gitea"}, "-"), token)
-	oauthApp, err := gitClient.CreateOauth2(gitea.CreateOauth2Option{
-		Name: "Drone",
-		RedirectURIs: []string{
-			strings.Join([]string{"https://", instance.Spec.CI.Hostname, "/login"}, ""),
-		},
-	})
-	if err != nil {
-		logger.Error(err, "failed to create drone oauth in gitea")
-		return ctrl.Result{}, err
+	// Ci Components, switching systems removes the one no longer in use
+	switch {
+	case !isEnabled(instance.Spec.CI.Enabled):
+		if err = removeDroneService(gitClient, instance, r); err != nil {
+			return wrapComponent("drone", err)
+		}
+		if err = removeAgolaService(gitClient, instance, r); err != nil {
+			return wrapComponent("agola-gateway", err)
+		}
+	case ciSystem(instance) == "agola":
+		if err = removeDroneService(gitClient, instance, r); err != nil {
+			return wrapComponent("drone", err)
+		}
+		if err = createAgolaService(gitClient, instance, r); err != nil {
+			return wrapComponent("agola-gateway", err)
+		}
+	default:
+		if err = removeAgolaService(gitClient, instance, r); err != nil {
+			return wrapComponent("agola-gateway", err)
+		}
+		// Drone waits on its database, only then is its OAuth2 application
+		// minted, or every pass until then would leave one behind
+		dbSecret, err = createPgService("drone", instance, r)
+		if err != nil {
+			return wrapComponent("drone-postgres", err)
+		}
+		oauthApp, err := reconcileOAuthApp(gitClient, droneOAuthClient(instance), instance, r)
+		if err != nil {
+			logger.Error(err, "failed to reconcile drone oauth in gitea")
+			return wrapComponent("drone", err)
+		}
+		if err = createDroneService(oauthApp, dbSecret, instance, r); err != nil {
+			return wrapComponent("drone", err)
+		}
 	}
-	// Ci Components
-	if _, err = createPgService("drone", instance, r); err != nil {
-		return ctrl.Result{}, err
+
+	// Clair Components
+	if isEnabled(instance.Spec.Clair.Enabled) {
+		dbSecret, err = createPgService("clair", instance, r)
+		if err != nil {
+			return wrapComponent("clair-postgres", err)
+		}
+		if err = createClairService(dbSecret, instance, r); err != nil {
+			return wrapComponent("clair", err)
+		}
+	} else if err = removeClairService(instance, r); err != nil {
+		return wrapComponent("clair", err)
 	}
-	if err = createDroneService(oauthApp, instance, r); err != nil {
-		return ctrl.Result{}, err
+
+	if isEnabled(instance.Spec.Registry.Enabled) {
+		if err = createRegistryService(instance, r); err != nil {
+			return wrapComponent("registry", err)
+		}
+	} else if err = removeRegistryService(instance, r); err != nil {
+		return wrapComponent("registry", err)
 	}
 
-	// Clair Components
-	dbSecret, err = createPgService("clair", instance, r)
+	return nil
+}
+
+// finalizeVCS applies the retention policy and cleans up what lives outside
+// of Kubernetes before the owned objects are garbage collected. It returns
+// false while the teardown is still in progress.
+func (r *VCSReconciler) finalizeVCS(instance *gitifold.VCS) (bool, error) {
+	logger := r.Log.WithValues("VCS", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	done, err := finalizeVolumes(instance, r)
+	if err != nil || !done {
+		return done, err
+	}
+
+	if err = deregisterAgolaRemoteSource(instance, r); err != nil {
+		logger.Error(err, "failed to deregister the gitea remote source in agola")
+	}
+	gitClient, err := newGiteaClient(instance, r)
 	if err != nil {
-		return ctrl.Result{}, err
+		// Gitea never came up, so there is nothing registered in it
+		logger.Info("Gitea Token not available, skipping OAuth2 and webhook cleanup")
+		return true, nil
 	}
-	if err = createClairService(dbSecret, instance, r); err != nil {
-		return ctrl.Result{}, err
+	if err = deleteCIHooks(gitClient, instance, r); err != nil {
+		logger.Error(err, "failed to delete ci webhooks in gitea")
+	}
+	if err = deleteOAuthApp(gitClient, droneOAuthClient(instance), instance, r); err != nil {
+		logger.Error(err, "failed to delete drone oauth in gitea")
 	}
+	if err = deleteOAuthApp(gitClient, agolaOAuthClient(instance), instance, r); err != nil {
+		logger.Error(err, "failed to delete agola oauth in gitea")
+	}
+	return true, nil
+}
 
-	if err = createRegistryService(instance, r); err != nil {
-		return ctrl.Result{}, err
+// isEnabled treats an unset enabled flag as true.
+func isEnabled(enabled *bool) bool {
+	return enabled == nil || *enabled
+}
+
+// ciSystem returns Spec.CI.System, defaulting to drone.
+func ciSystem(cr *gitifold.VCS) string {
+	if cr.Spec.CI.System == "" {
+		return "drone"
 	}
+	return cr.Spec.CI.System
+}
 
-	return ctrl.Result{}, nil
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(slice []string, s string) (result []string) {
+	for _, item := range slice {
+		if item == s {
+			continue
+		}
+		result = append(result, item)
+	}
+	return
 }
 
 func (r *VCSReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&gitifold.VCS{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&batchv1.Job{}).
+		Owns(&batchv1beta1.CronJob{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.Secret{}).
+		Owns(&corev1.PersistentVolumeClaim{}).
+		Owns(&netv1.Ingress{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&policyv1beta1.PodDisruptionBudget{}).
+		// postgres pods are owned by their StatefulSet, a failover can not
+		// wait for the StatefulSet status to change
+		Watches(&source.Kind{Type: &corev1.Pod{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(pgPodRequests),
+		}).
 		Complete(r)
 }
+
+// pgPodRequests maps a postgres pod to the VCS it belongs to.
+func pgPodRequests(o handler.MapObject) []reconcile.Request {
+	labels := o.Meta.GetLabels()
+	if labels["app.kubernetes.io/name"] != "postgres" || labels["app.kubernetes.io/deployment"] != "gitifold" {
+		return nil
+	}
+	return []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Name: labels["app.kubernetes.io/instance"], Namespace: o.Meta.GetNamespace()}},
+	}
+}